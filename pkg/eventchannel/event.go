@@ -20,6 +20,7 @@
 package eventchannel
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 
@@ -43,6 +44,22 @@ type Emitter interface {
 	Close() error
 }
 
+// Flusher is implemented by Emitters that don't deliver messages synchronously
+// in Emit, e.g. because they buffer them.
+type Flusher interface {
+	// Flush blocks until all messages previously passed to Emit have been
+	// delivered, or ctx is done.
+	Flush(ctx context.Context) error
+}
+
+// flush flushes e if it implements Flusher.
+func flush(ctx context.Context, e Emitter) error {
+	if f, ok := e.(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
 // DefaultEmitter is the default emitter. Calls to Emit and AddEmitter are sent
 // to this Emitter.
 var DefaultEmitter = &multiEmitter{}
@@ -53,6 +70,11 @@ func Emit(msg proto.Message) error {
 	return err
 }
 
+// Flush is a helper method that calls DefaultEmitter.Flush.
+func Flush(ctx context.Context) error {
+	return DefaultEmitter.Flush(ctx)
+}
+
 // AddEmitter is a helper method that calls DefaultEmitter.AddEmitter.
 func AddEmitter(e Emitter) {
 	DefaultEmitter.AddEmitter(e)
@@ -73,7 +95,7 @@ func (me *multiEmitter) Emit(msg proto.Message) (bool, error) {
 
 	var err error
 	for e := range me.emitters {
-		hangup, eerr := e.Emit(msg)
+		hangup, eerr := emitRecover(e, msg)
 		if eerr != nil {
 			if err == nil {
 				err = fmt.Errorf("error emitting %v: on %v: %v", msg, e, eerr)
@@ -93,6 +115,33 @@ func (me *multiEmitter) Emit(msg proto.Message) (bool, error) {
 	return false, err
 }
 
+// emitRecover calls e.Emit, turning a panic into an error so that a single
+// broken emitter doesn't keep messages from the other emitters.
+func emitRecover(e Emitter, msg proto.Message) (hangup bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warningf("Eventchannel emitter %v panicked: %v", e, r)
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return e.Emit(msg)
+}
+
+// Flush implements Flusher.Flush by flushing all added emitters that implement
+// Flusher. If any Flush call errors, it returns the first one encountered.
+func (me *multiEmitter) Flush(ctx context.Context) error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+
+	var err error
+	for e := range me.emitters {
+		if eerr := flush(ctx, e); err == nil && eerr != nil {
+			err = eerr
+		}
+	}
+	return err
+}
+
 // AddEmitter adds a new emitter.
 func (me *multiEmitter) AddEmitter(e Emitter) {
 	me.mu.Lock()
@@ -118,7 +167,8 @@ func (me *multiEmitter) Close() error {
 	return err
 }
 
-// socketEmitter emits proto messages on a socket.
+// socketEmitter emits proto messages on a socket. Messages are written to the
+// socket in Emit, so Flush has nothing left to deliver.
 type socketEmitter struct {
 	socket *unet.Socket
 }
@@ -168,6 +218,12 @@ func (s *socketEmitter) Close() error {
 	return s.socket.Close()
 }
 
+// Flush implements Flusher.Flush. Emit has already written all messages to the
+// socket, so Flush only reports whether ctx is done.
+func (s *socketEmitter) Flush(ctx context.Context) error {
+	return ctx.Err()
+}
+
 // debugEmitter wraps an emitter to emit stringified event messages. This is
 // useful for debugging -- when the messages are intended for humans.
 type debugEmitter struct {
@@ -197,3 +253,8 @@ func (d *debugEmitter) Emit(msg proto.Message) (bool, error) {
 func (d *debugEmitter) Close() error {
 	return d.inner.Close()
 }
+
+// Flush implements Flusher.Flush.
+func (d *debugEmitter) Flush(ctx context.Context) error {
+	return flush(ctx, d.inner)
+}
@@ -15,6 +15,7 @@
 package eventchannel
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -107,6 +108,105 @@ func TestMultiEmitter(t *testing.T) {
 	}
 }
 
+// panickingEmitter is an emitter whose Emit panics.
+type panickingEmitter struct{}
+
+// Emit implements Emitter.Emit.
+func (panickingEmitter) Emit(proto.Message) (bool, error) {
+	panic("emit")
+}
+
+// Close implements Emitter.Close.
+func (panickingEmitter) Close() error {
+	return nil
+}
+
+func TestMultiEmitterPanic(t *testing.T) {
+	me := &multiEmitter{}
+	me.AddEmitter(panickingEmitter{})
+	var emitters []*testEmitter
+	for i := 0; i < 3; i++ {
+		te := &testEmitter{}
+		emitters = append(emitters, te)
+		me.AddEmitter(te)
+	}
+
+	m := testMessage{name: "foo"}
+	if _, err := me.Emit(m); err == nil {
+		t.Errorf("me.Emit(%v) got nil error, want error from panicking emitter", m)
+	}
+
+	// The other emitters still got the message, whatever the order in which
+	// emitters were called.
+	for _, te := range emitters {
+		if got := len(te.events); got != 1 {
+			t.Errorf("emitter got %d events, want 1", got)
+		}
+	}
+}
+
+// flushingEmitter is a testEmitter that buffers events until Flush.
+type flushingEmitter struct {
+	testEmitter
+
+	// pending contains events not yet flushed. It is protected by
+	// testEmitter.mu.
+	pending []proto.Message
+}
+
+// Emit implements Emitter.Emit.
+func (fe *flushingEmitter) Emit(msg proto.Message) (bool, error) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	fe.pending = append(fe.pending, msg)
+	return false, nil
+}
+
+// Flush implements Flusher.Flush.
+func (fe *flushingEmitter) Flush(ctx context.Context) error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fe.events = append(fe.events, fe.pending...)
+	fe.pending = nil
+	return nil
+}
+
+func TestMultiEmitterFlush(t *testing.T) {
+	me := &multiEmitter{}
+	te := &testEmitter{}
+	fe := &flushingEmitter{}
+	wrapped := &flushingEmitter{}
+	me.AddEmitter(te)
+	me.AddEmitter(fe)
+	me.AddEmitter(RateLimitedEmitterFrom(wrapped, 1, 10))
+
+	if _, err := me.Emit(testMessage{name: "foo"}); err != nil {
+		t.Fatalf("me.Emit failed: %v", err)
+	}
+	if len(fe.events) != 0 || len(wrapped.events) != 0 {
+		t.Fatalf("flushing emitters got events before Flush")
+	}
+	if err := me.Flush(context.Background()); err != nil {
+		t.Fatalf("me.Flush() failed: %v", err)
+	}
+	// Emitters that don't implement Flusher are left alone, others are
+	// flushed, even if wrapped.
+	for _, events := range [][]proto.Message{te.events, fe.events, wrapped.events} {
+		if len(events) != 1 {
+			t.Errorf("emitter got %d events, want 1", len(events))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := me.Flush(ctx); err != context.Canceled {
+		t.Errorf("me.Flush() with canceled context got err %v, want %v", err, context.Canceled)
+	}
+}
+
 func TestRateLimitedEmitter(t *testing.T) {
 	// Create a RateLimittedEmitter that wraps a testEmitter.
 	te := &testEmitter{}
@@ -144,3 +244,43 @@ func TestRateLimitedEmitter(t *testing.T) {
 		t.Errorf("got %d events, want at most %d", got, wantAtMost)
 	}
 }
+
+func TestRateLimitedEmitterFlush(t *testing.T) {
+	te := &testEmitter{}
+	// Only the first event is allowed during the test.
+	rle := RateLimitedEmitterFrom(te, 0.001, 1)
+	for _, name := range []string{"first", "second", "last"} {
+		if _, err := rle.Emit(testMessage{name: name}); err != nil {
+			t.Fatalf("rle.Emit failed: %v", err)
+		}
+	}
+	if got, want := len(te.events), 1; got != want {
+		t.Fatalf("got %d events before Flush, want %d", got, want)
+	}
+
+	// Flush delivers the last discarded event despite the limits, and only
+	// once.
+	for i := 0; i < 2; i++ {
+		if err := rle.(Flusher).Flush(context.Background()); err != nil {
+			t.Fatalf("rle.Flush() failed: %v", err)
+		}
+		if got, want := len(te.events), 2; got != want {
+			t.Fatalf("got %d events after Flush, want %d", got, want)
+		}
+		if got, want := te.events[1].(testMessage).name, "last"; got != want {
+			t.Errorf("got event %q after Flush, want %q", got, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := rle.Emit(testMessage{name: "canceled"}); err != nil {
+		t.Fatalf("rle.Emit failed: %v", err)
+	}
+	if err := rle.(Flusher).Flush(ctx); err != context.Canceled {
+		t.Errorf("rle.Flush() with canceled context got err %v, want %v", err, context.Canceled)
+	}
+	if got, want := len(te.events), 2; got != want {
+		t.Errorf("got %d events after canceled Flush, want %d", got, want)
+	}
+}
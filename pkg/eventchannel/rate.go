@@ -15,15 +15,26 @@
 package eventchannel
 
 import (
+	"context"
+
 	"golang.org/x/time/rate"
 	"google.golang.org/protobuf/proto"
+	"gvisor.dev/gvisor/pkg/sync"
 )
 
 // rateLimitedEmitter wraps an emitter and limits events to the given limits.
-// Events that would exceed the limit are discarded.
+// Events that would exceed the limit are discarded, except for the last one,
+// which is delivered on Flush.
 type rateLimitedEmitter struct {
 	inner   Emitter
 	limiter *rate.Limiter
+
+	// mu protects dropped.
+	mu sync.Mutex
+
+	// dropped is the last event discarded by Emit, or nil if an event was
+	// passed to inner since then.
+	dropped proto.Message
 }
 
 // RateLimitedEmitterFrom creates a new event channel emitter that wraps the
@@ -32,6 +43,10 @@ type rateLimitedEmitter struct {
 // events. See the golang.org/x/time/rate package and
 // https://en.wikipedia.org/wiki/Token_bucket for more information about token
 // buckets generally.
+//
+// Flush passes the last discarded event, if any, to the existing emitter
+// regardless of the limits, so that the final event sent before exiting is
+// not lost.
 func RateLimitedEmitterFrom(inner Emitter, maxRate float64, burst int) Emitter {
 	return &rateLimitedEmitter{
 		inner:   inner,
@@ -41,10 +56,15 @@ func RateLimitedEmitterFrom(inner Emitter, maxRate float64, burst int) Emitter {
 
 // Emit implements EventEmitter.Emit.
 func (rle *rateLimitedEmitter) Emit(msg proto.Message) (bool, error) {
+	rle.mu.Lock()
 	if !rle.limiter.Allow() {
-		// Drop event.
+		// Drop event, but keep it for Flush.
+		rle.dropped = msg
+		rle.mu.Unlock()
 		return false, nil
 	}
+	rle.dropped = nil
+	rle.mu.Unlock()
 	return rle.inner.Emit(msg)
 }
 
@@ -52,3 +72,21 @@ func (rle *rateLimitedEmitter) Emit(msg proto.Message) (bool, error) {
 func (rle *rateLimitedEmitter) Close() error {
 	return rle.inner.Close()
 }
+
+// Flush implements Flusher.Flush. It bypasses the limits to emit the last
+// discarded event, if any, before flushing the wrapped emitter.
+func (rle *rateLimitedEmitter) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rle.mu.Lock()
+	dropped := rle.dropped
+	rle.dropped = nil
+	rle.mu.Unlock()
+	if dropped != nil {
+		if _, err := rle.inner.Emit(dropped); err != nil {
+			return err
+		}
+	}
+	return flush(ctx, rle.inner)
+}
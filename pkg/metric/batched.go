@@ -0,0 +1,87 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"runtime"
+)
+
+// BatchedCounter accumulates increments of a Uint64Metric locally, and only
+// adds them to the metric once enough of them are pending, or on Flush. This
+// avoids an atomic operation (or, for metrics with fields, a lock) per
+// increment for counters incremented at a very high rate, at the cost of the
+// metric lagging behind by up to the flush threshold.
+//
+// A BatchedCounter is not safe for concurrent use; each goroutine should use
+// its own. Pending increments are flushed when the BatchedCounter is garbage
+// collected, but callers should Flush explicitly when done with it, as the
+// garbage collector gives no guarantee of when (or whether) this happens.
+type BatchedCounter struct {
+	// metric is the metric incremented by Flush.
+	metric *Uint64Metric
+
+	// fieldValues are the field values of the counter in metric.
+	fieldValues []string
+
+	// threshold is the number of pending increments at which Increment
+	// flushes.
+	threshold uint64
+
+	// pending is the number of increments not yet added to metric.
+	pending uint64
+}
+
+// NewBatchedCounter returns a BatchedCounter for the given field values of m,
+// which flushes automatically when at least threshold increments are pending.
+// A threshold of 0 or 1 flushes on every increment.
+func (m *Uint64Metric) NewBatchedCounter(threshold uint64, fieldValues ...string) *BatchedCounter {
+	// Value checks the field values, so that invalid ones are reported here
+	// rather than at the first flush.
+	m.Value(fieldValues...)
+	b := &BatchedCounter{
+		metric:      m,
+		fieldValues: append([]string(nil), fieldValues...),
+		threshold:   threshold,
+	}
+	runtime.SetFinalizer(b, (*BatchedCounter).Flush)
+	return b
+}
+
+// Increment increments the counter by 1.
+func (b *BatchedCounter) Increment() {
+	b.IncrementBy(1)
+}
+
+// IncrementBy increments the counter by v.
+func (b *BatchedCounter) IncrementBy(v uint64) {
+	b.pending += v
+	if b.pending >= b.threshold {
+		b.Flush()
+	}
+}
+
+// Flush adds all pending increments to the metric.
+func (b *BatchedCounter) Flush() {
+	if b.pending == 0 {
+		return
+	}
+	b.metric.IncrementBy(b.pending, b.fieldValues...)
+	b.pending = 0
+}
+
+// Pending returns the number of increments not yet added to the metric.
+func (b *BatchedCounter) Pending() uint64 {
+	return b.pending
+}
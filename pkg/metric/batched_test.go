@@ -0,0 +1,91 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestBatchedCounter(t *testing.T) {
+	defer reset()
+
+	m, err := NewUint64Metric("/counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	b := m.NewBatchedCounter(10, "a")
+	for i := 0; i < 9; i++ {
+		b.Increment()
+	}
+	if got := m.Value("a"); got != 0 {
+		t.Errorf("Value before reaching threshold got %d want 0", got)
+	}
+	if got := b.Pending(); got != 9 {
+		t.Errorf("Pending got %d want 9", got)
+	}
+	b.Increment()
+	if got := m.Value("a"); got != 10 {
+		t.Errorf("Value after reaching threshold got %d want 10", got)
+	}
+	b.IncrementBy(3)
+	b.Flush()
+	if got := m.Value("a"); got != 13 {
+		t.Errorf("Value after Flush got %d want 13", got)
+	}
+	if got := m.Value("b"); got != 0 {
+		t.Errorf("Value of other field got %d want 0", got)
+	}
+
+	// Pending increments are flushed on garbage collection.
+	func() {
+		m.NewBatchedCounter(10, "b").IncrementBy(5)
+	}()
+	for deadline := time.Now().Add(10 * time.Second); m.Value("b") != 5; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Value after garbage collection got %d want 5", m.Value("b"))
+		}
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func BenchmarkCounterIncrement(b *testing.B) {
+	defer reset()
+
+	m, err := NewUint64Metric("/counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription)
+	if err != nil {
+		b.Fatalf("NewUint64Metric: %v", err)
+	}
+	b.Run("Atomic", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				m.Increment()
+			}
+		})
+	})
+	b.Run("Batched", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			c := m.NewBatchedCounter(1024)
+			defer c.Flush()
+			for pb.Next() {
+				c.Increment()
+			}
+		})
+	})
+}
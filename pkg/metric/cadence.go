@@ -0,0 +1,98 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+)
+
+// emitCycle is the number of calls to EmitMetricUpdate so far. It is protected
+// by emitMu.
+var emitCycle uint64
+
+// SetEmitDivisor makes EmitMetricUpdate only consider the given metrics every
+// divisor calls, starting with the first one: with a divisor of 3, they are
+// emitted (if they changed) by the 1st, 4th, 7th, etc. call. Changes made in
+// between are emitted by the next call considering the metrics. This reduces
+// the emit volume of metrics that don't need to be reported frequently. The
+// default divisor is 1, i.e. metrics are considered by every call.
+//
+// Only EmitMetricUpdate is affected; snapshots and UpdateReaders always
+// include all metrics.
+//
+// SetEmitDivisor must be called after the metrics are registered, and before
+// Initialize.
+func SetEmitDivisor(divisor int, names ...string) error {
+	if err := lockRegistration("set emit divisor"); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return ErrInitializationDone
+	}
+	if divisor < 1 {
+		return fmt.Errorf("%w: emit divisor must be positive, got %d", ErrInvalidArgument, divisor)
+	}
+	for _, name := range names {
+		_, isUint64 := allMetrics.uint64Metrics[name]
+		_, isDistribution := allMetrics.distributionMetrics[name]
+		if !isUint64 && !isDistribution {
+			return fmt.Errorf("%w: %q", ErrMetricNotFound, name)
+		}
+	}
+	for _, name := range names {
+		if divisor == 1 {
+			delete(allMetrics.emitDivisors, name)
+		} else {
+			allMetrics.emitDivisors[name] = uint64(divisor)
+		}
+	}
+	return nil
+}
+
+// skipDivisorMetrics replaces the values in snapshot of metrics that are not
+// considered by the given emit cycle (see SetEmitDivisor) with their values in
+// last, so that they are not emitted, and changes are emitted relative to the
+// last emitted values once they are considered again.
+//
+// Preconditions:
+// * emitMu is locked.
+func skipDivisorMetrics(snapshot *metricValues, last metricValues, cycle uint64) {
+	for name, divisor := range allMetrics.emitDivisors {
+		if (cycle-1)%divisor == 0 {
+			continue
+		}
+		// Metrics emitted with their full value are only emitted when
+		// considered, too.
+		delete(snapshot.fullValue, name)
+		if _, ok := snapshot.uint64Metrics[name]; ok {
+			if v, ok := last.uint64Metrics[name]; ok {
+				snapshot.uint64Metrics[name] = v
+			} else {
+				delete(snapshot.uint64Metrics, name)
+			}
+			continue
+		}
+		if _, ok := last.distributionMetrics[name]; ok {
+			snapshot.distributionMetrics[name] = last.distributionMetrics[name]
+			snapshot.distributionTotalSamples[name] = last.distributionTotalSamples[name]
+			snapshot.distributionResets[name] = last.distributionResets[name]
+		} else {
+			delete(snapshot.distributionMetrics, name)
+			delete(snapshot.distributionTotalSamples, name)
+			delete(snapshot.distributionResets, name)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestSetEmitDivisor(t *testing.T) {
+	defer reset()
+
+	slow, err := NewUint64Metric("/slow", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	fast, err := NewUint64Metric("/fast", false, pb.MetricMetadata_UNITS_NONE, barDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(3, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if err := SetEmitDivisor(0, "/slow"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("SetEmitDivisor(0) got err %v want %v", err, ErrInvalidArgument)
+	}
+	if err := SetEmitDivisor(3, "/unknown"); !errors.Is(err, ErrMetricNotFound) {
+		t.Errorf("SetEmitDivisor of unknown metric got err %v want %v", err, ErrMetricNotFound)
+	}
+	if err := SetEmitDivisor(3, "/slow", "/distrib"); err != nil {
+		t.Fatalf("SetEmitDivisor: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+
+	// Change all metrics before every emit, except the 5th.
+	var emitted [][]string
+	for cycle := 1; cycle <= 8; cycle++ {
+		if cycle != 5 {
+			slow.Increment()
+			fast.Increment()
+			distrib.AddSample(1)
+		}
+		emitter.Reset()
+		EmitMetricUpdate()
+		var names []string
+		if len(emitter) == 1 {
+			for _, m := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+				names = append(names, m.GetName())
+			}
+		}
+		emitted = append(emitted, names)
+		if cycle == 7 {
+			// Changes skipped in cycles 5 and 6 are emitted as a whole.
+			for _, m := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+				switch m.GetName() {
+				case "/slow":
+					if got := m.GetUint64Value(); got != 6 {
+						t.Errorf("cycle 7: /slow got %d want 6", got)
+					}
+				case "/distrib":
+					if got := m.GetDistributionValue().GetNewSamples(); !reflect.DeepEqual(got, []uint64{0, 2, 0, 0, 0}) {
+						t.Errorf("cycle 7: /distrib got new samples %v want 2 in bucket 1", got)
+					}
+				}
+			}
+		}
+	}
+	want := [][]string{
+		{"/distrib", "/fast", "/slow"},
+		{"/fast"},
+		{"/fast"},
+		{"/distrib", "/fast", "/slow"},
+		nil,
+		{"/fast"},
+		{"/distrib", "/fast", "/slow"},
+		{"/fast"},
+	}
+	for i := range emitted {
+		sort.Strings(emitted[i])
+	}
+	if !reflect.DeepEqual(emitted, want) {
+		t.Errorf("emitted metrics per cycle got %v want %v", emitted, want)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"time"
+
+	"gvisor.dev/gvisor/pkg/metric/internal/fakeclock"
+)
+
+// nowNano returns the current unix timestamp in nanoseconds, for the purpose
+// of timing operations. Tests built with the metric_fakeclock tag may fake it
+// through package metrictest; otherwise, fakeclock.NowNano is the constant 0
+// and this is just CheapNowNano.
+// +checkescape:all
+//go:nosplit
+func nowNano() int64 {
+	if ns := fakeclock.NowNano(); ns != 0 {
+		return ns
+	}
+	return CheapNowNano()
+}
+
+// stageNow returns the current time, for the purpose of timing initialization
+// stages.
+func stageNow() time.Time {
+	if ns := fakeclock.NowNano(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Now()
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// Suffixes of the names of the metrics registered for a CountSumMetric.
+const (
+	countSuffix = "/count"
+	sumSuffix   = "/sum"
+)
+
+// CountSumMetric counts events and sums up their magnitude, e.g. the number of
+// writes and the total number of bytes written. It is similar to a Prometheus
+// summary without quantiles.
+//
+// A CountSumMetric named "/foo" is registered as two cumulative uint64
+// metrics: "/foo/count", the number of observed events, and "/foo/sum", the
+// sum of their magnitudes. Both are exported and emitted like any other uint64
+// metric.
+//
+// Metrics are not saved across save/restore and thus reset to zero on restore.
+type CountSumMetric struct {
+	// numFields is the number of metric fields. It is immutable once
+	// initialized.
+	numFields int
+
+	// values maps field values to their count and sum. Metrics without fields
+	// use the empty string as key. The map is immutable once initialized; the
+	// values it points to are accessed atomically.
+	values map[string]*countSum
+}
+
+// countSum is the value of a CountSumMetric for one field value.
+type countSum struct {
+	count uint64
+	sum   uint64
+}
+
+// NewCountSumMetric creates and registers a new cumulative count and sum
+// metric with the given name. units applies to the sum of magnitudes; the
+// count is unitless.
+//
+// Metrics must be statically defined (i.e., at init).
+func NewCountSumMetric(name string, sync bool, units pb.MetricMetadata_Units, description string, fields ...Field) (*CountSumMetric, error) {
+	if l := len(fields); l > 1 {
+		return nil, fmt.Errorf("%w: %d fields provided, must be <= 1", ErrTooManyFields, l)
+	}
+	if err := checkEnumeratedFields(fields); err != nil {
+		return nil, err
+	}
+	// Both metrics are registered in a single critical section, after
+	// checking both names, so that a failure or a concurrent registration
+	// can't leave the count registered without its sum.
+	if err := lockRegistration(fmt.Sprintf("register %q", name)); err != nil {
+		return nil, err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return nil, ErrInitializationDone
+	}
+	if err := checkNames(name+countSuffix, name+sumSuffix); err != nil {
+		return nil, err
+	}
+	if err := validateUnits(units, nil); err != nil {
+		return nil, err
+	}
+	m := &CountSumMetric{
+		numFields: len(fields),
+		values:    make(map[string]*countSum),
+	}
+	if m.numFields == 0 {
+		m.values[""] = &countSum{}
+	} else {
+		for _, fieldValue := range fields[0].allowedValues {
+			m.values[fieldValue] = &countSum{}
+		}
+	}
+	if err := registerUint64MetricLocked(name+countSuffix, true /* cumulative */, sync, pb.MetricMetadata_UNITS_NONE, description+" (count)", m.Count, nil /* fieldValues */, fields...); err != nil {
+		return nil, err
+	}
+	if err := registerUint64MetricLocked(name+sumSuffix, true /* cumulative */, sync, units, description+" (sum)", m.Sum, nil /* fieldValues */, fields...); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MustCreateNewCountSumMetric calls NewCountSumMetric and panics if it
+// returns an error.
+func MustCreateNewCountSumMetric(name string, sync bool, units pb.MetricMetadata_Units, description string, fields ...Field) *CountSumMetric {
+	m, err := NewCountSumMetric(name, sync, units, description, fields...)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to create metric %q: %s", name, err))
+	}
+	return m
+}
+
+// lookup returns the value of the metric for the given field values.
+func (m *CountSumMetric) lookup(fieldValues []string) *countSum {
+	if m.numFields != len(fieldValues) {
+		panic(fmt.Sprintf("Number of fieldValues %d is not equal to the number of metric fields %d", len(fieldValues), m.numFields))
+	}
+	key := ""
+	if m.numFields == 1 {
+		key = fieldValues[0]
+	}
+	v, ok := m.values[key]
+	if !ok {
+		panic(fmt.Sprintf("Metric does not allow to have field value %s", key))
+	}
+	return v
+}
+
+// Observe records one event of the given magnitude.
+func (m *CountSumMetric) Observe(magnitude uint64, fieldValues ...string) {
+	v := m.lookup(fieldValues)
+	atomic.AddUint64(&v.count, 1)
+	atomic.AddUint64(&v.sum, magnitude)
+}
+
+// Count returns the number of observed events.
+func (m *CountSumMetric) Count(fieldValues ...string) uint64 {
+	return atomic.LoadUint64(&m.lookup(fieldValues).count)
+}
+
+// Sum returns the sum of the magnitude of observed events.
+func (m *CountSumMetric) Sum(fieldValues ...string) uint64 {
+	return atomic.LoadUint64(&m.lookup(fieldValues).sum)
+}
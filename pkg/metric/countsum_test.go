@@ -0,0 +1,138 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+func TestCountSumMetric(t *testing.T) {
+	defer reset()
+
+	writes, err := NewCountSumMetric("/writes", false, pb.MetricMetadata_UNITS_NONE, "Writes", NewField("fs", []string{"tmpfs", "gofer"}))
+	if err != nil {
+		t.Fatalf("NewCountSumMetric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+
+	writes.Observe(100, "gofer")
+	writes.Observe(28, "gofer")
+	writes.Observe(7, "tmpfs")
+	if got := writes.Count("gofer"); got != 2 {
+		t.Errorf("Count(gofer) got %d want 2", got)
+	}
+	if got := writes.Sum("gofer"); got != 128 {
+		t.Errorf("Sum(gofer) got %d want 128", got)
+	}
+
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	got := make(map[string]uint64)
+	for _, m := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+		got[m.GetName()+fmt.Sprint(m.GetFieldValues())] = m.GetUint64Value()
+	}
+	want := map[string]uint64{
+		"/writes/count[gofer]": 2,
+		"/writes/sum[gofer]":   128,
+		"/writes/count[tmpfs]": 1,
+		"/writes/sum[tmpfs]":   7,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EmitMetricUpdate got %v want %v", got, want)
+	}
+}
+
+func TestCountSumMetricNoFields(t *testing.T) {
+	defer reset()
+
+	m := MustCreateNewCountSumMetric("/reads", false, pb.MetricMetadata_UNITS_NONE, "Reads")
+	m.Observe(3)
+	m.Observe(4)
+	if got := m.Count(); got != 2 {
+		t.Errorf("Count() got %d want 2", got)
+	}
+	if got := m.Sum(); got != 7 {
+		t.Errorf("Sum() got %d want 7", got)
+	}
+
+	if _, err := NewCountSumMetric("/reads", false, pb.MetricMetadata_UNITS_NONE, "Reads"); err == nil {
+		t.Errorf("NewCountSumMetric with duplicate name got nil error")
+	}
+}
+
+func TestCountSumMetricPartialNameClash(t *testing.T) {
+	defer reset()
+
+	if _, err := NewUint64Metric("/reads/sum", false, pb.MetricMetadata_UNITS_NONE, "Reads sum"); err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	if _, err := NewCountSumMetric("/reads", false, pb.MetricMetadata_UNITS_NONE, "Reads"); !errors.Is(err, ErrNameInUse) {
+		t.Errorf("NewCountSumMetric with sum name in use got err %v want %v", err, ErrNameInUse)
+	}
+	// The count wasn't registered either.
+	if _, err := NewUint64Metric("/reads/count", false, pb.MetricMetadata_UNITS_NONE, "Reads count"); err != nil {
+		t.Errorf("NewUint64Metric(/reads/count) got err %v want nil", err)
+	}
+}
+
+func TestCountSumMetricConcurrentRegistration(t *testing.T) {
+	defer reset()
+
+	// A registration racing with NewCountSumMetric for one of its names either
+	// wins, and no part of the CountSumMetric is registered, or loses.
+	const n = 20
+	var wg sync.WaitGroup
+	countSumErrs := make([]error, n)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, countSumErrs[i] = NewCountSumMetric(fmt.Sprintf("/ops%d", i), false, pb.MetricMetadata_UNITS_NONE, "Ops")
+		}()
+		go func() {
+			defer wg.Done()
+			NewUint64Metric(fmt.Sprintf("/ops%d/sum", i), false, pb.MetricMetadata_UNITS_NONE, "Ops sum")
+		}()
+	}
+	wg.Wait()
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	registered := make(map[string]bool)
+	for _, md := range emitter[0].(*pb.MetricRegistration).GetMetrics() {
+		registered[md.GetName()] = true
+	}
+	for i, err := range countSumErrs {
+		count := fmt.Sprintf("/ops%d/count", i)
+		if err == nil && !registered[count] {
+			t.Errorf("NewCountSumMetric(/ops%d) succeeded but %s isn't registered", i, count)
+		}
+		if err != nil && registered[count] {
+			t.Errorf("NewCountSumMetric(/ops%d) got err %v but left %s registered", i, err, count)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"strings"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// MetricDelta is the change of the value of a metric for one combination of
+// field values between two snapshots.
+type MetricDelta struct {
+	// Name is the name of the metric.
+	Name string
+
+	// FieldValues contains the value of each of the metric's fields.
+	FieldValues []string
+
+	// Uint64 is the change of the value of TYPE_UINT64 metrics. It is
+	// negative if the value decreased, e.g. for gauges.
+	Uint64 int64
+
+	// Samples is the change of the number of samples in each bucket of
+	// TYPE_DISTRIBUTION metrics, with the same layout as MetricPoint.Samples.
+	Samples []int64
+}
+
+// String returns a human-readable representation of d, e.g.
+// "/fs/opens{read}: +3" or "/fs/latency: [+0 +2 -1 +0]".
+func (d MetricDelta) String() string {
+	var b strings.Builder
+	b.WriteString(d.Name)
+	if len(d.FieldValues) > 0 {
+		fmt.Fprintf(&b, "{%s}", strings.Join(d.FieldValues, ","))
+	}
+	if d.Samples == nil {
+		fmt.Fprintf(&b, ": %+d", d.Uint64)
+		return b.String()
+	}
+	b.WriteString(": [")
+	for i, delta := range d.Samples {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%+d", delta)
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// Diff returns the changes of the values of metrics between prev and s, e.g.
+// to see which metrics some code updated while debugging. Only the metric
+// points that changed are returned, in the same order as in s. Points that
+// are not in prev are compared to zero.
+//
+// Unlike metric updates, which contain absolute values for uint64 metrics,
+// deltas are returned for all metrics.
+func (s Snapshot) Diff(prev Snapshot) []MetricDelta {
+	prevPoints := make(map[string]MetricPoint)
+	for _, m := range prev.Metrics {
+		for _, p := range m.Points {
+			prevPoints[pointID(m.Metadata.GetName(), p.FieldValues)] = p
+		}
+	}
+	var deltas []MetricDelta
+	for _, m := range s.Metrics {
+		name := m.Metadata.GetName()
+		for _, p := range m.Points {
+			old := prevPoints[pointID(name, p.FieldValues)]
+			delta := MetricDelta{
+				Name:        name,
+				FieldValues: p.FieldValues,
+			}
+			changed := false
+			switch m.Metadata.GetType() {
+			case pb.MetricMetadata_TYPE_UINT64:
+				delta.Uint64 = int64(p.Uint64 - old.Uint64)
+				changed = delta.Uint64 != 0
+			case pb.MetricMetadata_TYPE_DISTRIBUTION:
+				delta.Samples = make([]int64, len(p.Samples))
+				for i, n := range p.Samples {
+					if i < len(old.Samples) {
+						n -= old.Samples[i]
+					}
+					delta.Samples[i] = int64(n)
+					changed = changed || delta.Samples[i] != 0
+				}
+			}
+			if changed {
+				deltas = append(deltas, delta)
+			}
+		}
+	}
+	return deltas
+}
+
+// pointID returns a key identifying the point of the given metric with the
+// given field values.
+func pointID(name string, fieldValues []string) string {
+	return name + "\x00" + strings.Join(fieldValues, ",")
+}
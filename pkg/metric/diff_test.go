@@ -0,0 +1,69 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"reflect"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	defer reset()
+
+	counter, err := NewUint64Metric("/counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	gauge := uint64(10)
+	MustRegisterGaugeFunc("/gauge", "A gauge", func(...string) uint64 { return gauge })
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(3, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	counter.Increment("b")
+	distrib.AddSample(3)
+
+	prev := GetSnapshot()
+	counter.IncrementBy(3, "a")
+	gauge = 7
+	distrib.AddSample(1)
+	distrib.AddSample(100)
+	got := GetSnapshot().Diff(prev)
+	want := []MetricDelta{
+		{Name: "/counter", FieldValues: []string{"a"}, Uint64: 3},
+		{Name: "/distrib", Samples: []int64{0, 1, 0, 0, 1}},
+		{Name: "/gauge", Uint64: -3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff got %v want %v", got, want)
+	}
+	var strs []string
+	for _, d := range got {
+		strs = append(strs, d.String())
+	}
+	if want := []string{"/counter{a}: +3", "/distrib: [+0 +1 +0 +0 +1]", "/gauge: -3"}; !reflect.DeepEqual(strs, want) {
+		t.Errorf("String() got %q want %q", strs, want)
+	}
+
+	// Compared to an empty snapshot, all non-zero points changed.
+	if got := len(GetSnapshot().Diff(Snapshot{})); got != 4 {
+		t.Errorf("Diff from empty snapshot got %d deltas want 4", got)
+	}
+}
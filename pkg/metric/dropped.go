@@ -0,0 +1,68 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// Reasons for which the metric package drops samples, as values of the reason
+// field of droppedSamples. Any feature that drops samples, or redirects them
+// away from where they were recorded, must increment droppedSamples with its
+// own reason, so that lossy telemetry is visible to its consumers.
+const (
+	// dropInvalidFieldValue is used when an increment of a
+	// DynamicUint64Metric, or a value returned by the callback of a metric
+	// registered with RegisterCustomUint64MapMetric, is dropped because its
+	// field value is invalid. The latter are counted once per distinct
+	// field value rather than once per snapshot.
+	dropInvalidFieldValue = "invalid_field_value"
+
+	// dropCardinalityCap is used when an increment of a DynamicUint64Metric
+	// is dropped because the metric already has its maximum number of field
+	// values.
+	dropCardinalityCap = "cardinality_cap"
+
+	// dropValuePanic is used when the value of a metric is omitted from
+	// snapshots because its value function panicked. It is incremented once
+	// per faulty metric, the first time it panics, rather than for every
+	// snapshot that omits it, so that it doesn't grow with the snapshot rate.
+	dropValuePanic = "value_panic"
+)
+
+// droppedSamplesField is the field of droppedSamples.
+var droppedSamplesField = NewField("reason", []string{
+	dropInvalidFieldValue,
+	dropCardinalityCap,
+	dropValuePanic,
+})
+
+// droppedSamples counts samples dropped by the metric package, by reason. For
+// dropValuePanic, it counts faulty metrics rather than samples. It always
+// counts, but is only exported as /metric/dropped_samples once registered by
+// RegisterDroppedSamplesMetric, so that binaries importing this package don't
+// get a metric they didn't ask for.
+var droppedSamples = newUint64Metric(droppedSamplesField)
+
+// RegisterDroppedSamplesMetric registers the /metric/dropped_samples metric,
+// which counts the samples dropped by the metric package, by reason, e.g.
+// increments of a DynamicUint64Metric past its cardinality cap. Samples
+// dropped before registration are counted too.
+//
+// Preconditions:
+// * Initialize has not been called.
+func RegisterDroppedSamplesMetric() error {
+	return RegisterCustomUint64Metric("/metric/dropped_samples", true /* cumulative */, false /* sync */, pb.MetricMetadata_UNITS_NONE, "Number of metric samples dropped by the metric package, by reason.", droppedSamples.Value, droppedSamplesField)
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestDroppedSamples(t *testing.T) {
+	defer reset()
+
+	dynamic, err := NewDynamicUint64Metric("/cpu/ticks", false, pb.MetricMetadata_UNITS_NONE, "Ticks per CPU", 1, NewFieldMatching("cpu", `cpu[0-9]+`))
+	if err != nil {
+		t.Fatalf("NewDynamicUint64Metric: %v", err)
+	}
+	MustRegisterCustomUint64Metric("/bad", true, false, barDescription, func(...string) uint64 {
+		panic("bad value function")
+	})
+	if err := RegisterDroppedSamplesMetric(); err != nil {
+		t.Fatalf("RegisterDroppedSamplesMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	found := false
+	for _, md := range emitter[0].(*pb.MetricRegistration).GetMetrics() {
+		found = found || md.GetName() == "/metric/dropped_samples"
+	}
+	if !found {
+		t.Errorf("/metric/dropped_samples not found in registration: %v", emitter[0])
+	}
+
+	for _, test := range []struct {
+		reason string
+		drop   func()
+	}{
+		{
+			reason: dropInvalidFieldValue,
+			drop: func() {
+				dynamic.Increment("gpu0")
+			},
+		},
+		{
+			reason: dropCardinalityCap,
+			drop: func() {
+				dynamic.Increment("cpu0")
+				dynamic.Increment("cpu1")
+			},
+		},
+		{
+			// A faulty metric is only counted once, however many
+			// snapshots omit it.
+			reason: dropValuePanic,
+			drop: func() {
+				allMetrics.Values()
+				allMetrics.Values()
+			},
+		},
+	} {
+		t.Run(test.reason, func(t *testing.T) {
+			before := make(map[string]uint64)
+			for _, reason := range []string{dropInvalidFieldValue, dropCardinalityCap, dropValuePanic} {
+				before[reason] = droppedSamples.Value(reason)
+			}
+			test.drop()
+			for reason, prev := range before {
+				want := prev
+				if reason == test.reason {
+					want++
+				}
+				if got := droppedSamples.Value(reason); got != want {
+					t.Errorf("dropped samples for reason %q got %d want %d", reason, got, want)
+				}
+			}
+		})
+	}
+
+	// The registered metric reports the counts.
+	s := GetSnapshot()
+	for _, m := range s.Metrics {
+		if m.Metadata.GetName() != "/metric/dropped_samples" {
+			continue
+		}
+		for _, p := range m.Points {
+			if want := droppedSamples.Value(p.FieldValues[0]); p.Uint64 != want {
+				t.Errorf("/metric/dropped_samples{reason=%s} got %d want %d", p.FieldValues[0], p.Uint64, want)
+			}
+		}
+	}
+}
+
+func TestDroppedSamplesNotRegistered(t *testing.T) {
+	defer reset()
+
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if metrics := emitter[0].(*pb.MetricRegistration).GetMetrics(); len(metrics) != 0 {
+		t.Errorf("got registered metrics %v want none", metrics)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// NewFieldMatching defines a dynamic Field, whose values are not enumerated
+// but must fully match the regular expression pattern, e.g. `cpu[0-9]+`. It
+// panics if pattern is not a valid regular expression.
+//
+// Dynamic fields can only be used with DynamicUint64Metric.
+func NewFieldMatching(name, pattern string) Field {
+	re := regexp.MustCompile("^(?:" + pattern + ")$")
+	return Field{
+		name:    name,
+		valid:   re.MatchString,
+		pattern: pattern,
+	}
+}
+
+// NewFieldWithValidator defines a dynamic Field, whose values are not
+// enumerated but must be accepted by valid.
+//
+// Dynamic fields can only be used with DynamicUint64Metric.
+func NewFieldWithValidator(name string, valid func(string) bool) Field {
+	return Field{
+		name:  name,
+		valid: valid,
+	}
+}
+
+// checkEnumeratedFields returns an error if any of fields is dynamic, or has
+// no allowed values.
+func checkEnumeratedFields(fields []Field) error {
+	for _, f := range fields {
+		if f.valid != nil {
+			return fmt.Errorf("%w: %q", ErrDynamicField, f.name)
+		}
+		if len(f.allowedValues) == 0 {
+			return fmt.Errorf("%w: %q", ErrNoFieldValues, f.name)
+		}
+	}
+	return nil
+}
+
+// DynamicUint64Metric is a cumulative uint64 metric with exactly one dynamic
+// field, whose values are only known at runtime (e.g. "cpu0".."cpuN") and
+// validated against the field's pattern or validator.
+//
+// The number of distinct field values is capped, to bound the memory and
+// emit cost of the metric. Increments with field values that are invalid, or
+// that would exceed the cap, are dropped rather than panicking, as dynamic
+// field values often come from untrusted input; see Dropped.
+//
+// Metrics are not saved across save/restore and thus reset to zero on restore.
+type DynamicUint64Metric struct {
+	// valid reports whether a field value is allowed. It is immutable.
+	valid func(string) bool
+
+	// maxValues is the maximum number of distinct field values. It is
+	// immutable.
+	maxValues int
+
+	// counters maps field values to a *uint64 counter, which must be accessed
+	// atomically.
+	counters sync.Map
+
+	// mu serializes the addition of counters, so that there are never more
+	// than maxValues of them.
+	mu sync.Mutex
+
+	// numValues is the number of counters. It is protected by mu.
+	numValues int
+
+	// dropped is the number of dropped increments. It is accessed
+	// atomically.
+	dropped uint64
+}
+
+// NewDynamicUint64Metric creates and registers a new cumulative metric with
+// the given name, broken down by the dynamic field, with at most maxValues
+// distinct field values.
+//
+// Metrics must be statically defined (i.e., at init).
+func NewDynamicUint64Metric(name string, sync bool, units pb.MetricMetadata_Units, description string, maxValues int, field Field) (*DynamicUint64Metric, error) {
+	if field.valid == nil {
+		return nil, fmt.Errorf("%w: field %q of metric %q is not dynamic", ErrInvalidArgument, field.name, name)
+	}
+	if maxValues <= 0 {
+		return nil, fmt.Errorf("%w: maximum number of field values must be positive, got %d", ErrInvalidArgument, maxValues)
+	}
+	m := &DynamicUint64Metric{
+		valid:     field.valid,
+		maxValues: maxValues,
+	}
+	if err := registerUint64Metric(name, true /* cumulative */, sync, units, description, m.Value, m.values, field); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MustCreateNewDynamicUint64Metric calls NewDynamicUint64Metric and panics if
+// it returns an error.
+func MustCreateNewDynamicUint64Metric(name string, sync bool, description string, maxValues int, field Field) *DynamicUint64Metric {
+	m, err := NewDynamicUint64Metric(name, sync, pb.MetricMetadata_UNITS_NONE, description, maxValues, field)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to create metric %q: %s", name, err))
+	}
+	return m
+}
+
+// Value returns the current value of the metric for the given field value.
+// It is 0 for field values that were never incremented.
+func (m *DynamicUint64Metric) Value(fieldValues ...string) uint64 {
+	if len(fieldValues) != 1 {
+		panic(fmt.Sprintf("Number of fieldValues %d is not equal to the number of metric fields 1", len(fieldValues)))
+	}
+	counter, ok := m.counters.Load(fieldValues[0])
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(counter.(*uint64))
+}
+
+// Increment increments the metric for the given field value by 1.
+func (m *DynamicUint64Metric) Increment(fieldValue string) {
+	m.IncrementBy(1, fieldValue)
+}
+
+// IncrementBy increments the metric for the given field value by v. If
+// fieldValue is not valid for the field, or if it is new and the metric
+// already has the maximum number of field values, the increment is dropped.
+func (m *DynamicUint64Metric) IncrementBy(v uint64, fieldValue string) {
+	counter, ok := m.counters.Load(fieldValue)
+	if !ok {
+		var dropReason string
+		if counter, dropReason = m.newCounter(fieldValue); counter == nil {
+			atomic.AddUint64(&m.dropped, 1)
+			droppedSamples.Increment(dropReason)
+			return
+		}
+	}
+	atomic.AddUint64(counter.(*uint64), v)
+}
+
+// newCounter returns the counter of fieldValue, adding it if needed. If
+// fieldValue is invalid or if there are already maxValues counters, it
+// returns nil and the reason for dropping the increment.
+func (m *DynamicUint64Metric) newCounter(fieldValue string) (interface{}, string) {
+	if !m.valid(fieldValue) {
+		return nil, dropInvalidFieldValue
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if counter, ok := m.counters.Load(fieldValue); ok {
+		return counter, ""
+	}
+	if m.numValues >= m.maxValues {
+		return nil, dropCardinalityCap
+	}
+	m.numValues++
+	counter := new(uint64)
+	m.counters.Store(fieldValue, counter)
+	return counter, ""
+}
+
+// Dropped returns the number of increments that were dropped because their
+// field value was invalid or over the maximum number of field values.
+func (m *DynamicUint64Metric) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// values returns the current value of all field values that have been
+// incremented.
+func (m *DynamicUint64Metric) values() map[string]uint64 {
+	values := make(map[string]uint64)
+	m.counters.Range(func(fieldValue, counter interface{}) bool {
+		values[fieldValue.(string)] = atomic.LoadUint64(counter.(*uint64))
+		return true
+	})
+	return values
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestFieldMatching(t *testing.T) {
+	f := NewFieldMatching("cpu", `cpu[0-9]+`)
+	for value, want := range map[string]bool{
+		"cpu0":    true,
+		"cpu42":   true,
+		"cpu":     false,
+		"cpux":    false,
+		"xcpu1":   false,
+		"cpu1 ":   false,
+		"":        false,
+		"cpu1\n2": false,
+	} {
+		if got := f.valid(value); got != want {
+			t.Errorf("valid(%q) got %t want %t", value, got, want)
+		}
+	}
+}
+
+func TestDynamicUint64Metric(t *testing.T) {
+	defer reset()
+
+	m, err := NewDynamicUint64Metric("/cpu/ticks", false, pb.MetricMetadata_UNITS_NONE, "Ticks per CPU", 2, NewFieldMatching("cpu", `cpu[0-9]+`))
+	if err != nil {
+		t.Fatalf("NewDynamicUint64Metric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	md := emitter[0].(*pb.MetricRegistration).GetMetrics()[0]
+	if got := md.GetFields()[0].GetValuePattern(); got != `cpu[0-9]+` {
+		t.Errorf("registered value pattern got %q want %q", got, `cpu[0-9]+`)
+	}
+
+	m.IncrementBy(3, "cpu0")
+	m.Increment("cpu1")
+	m.Increment("cpu0")
+	// Invalid values, and values over the cap, are dropped.
+	m.Increment("gpu0")
+	m.Increment("cpu2")
+	if got := m.Value("cpu0"); got != 4 {
+		t.Errorf("Value(cpu0) got %d want 4", got)
+	}
+	if got := m.Value("cpu2"); got != 0 {
+		t.Errorf("Value(cpu2) got %d want 0", got)
+	}
+	if got := m.Dropped(); got != 2 {
+		t.Errorf("Dropped() got %d want 2", got)
+	}
+
+	emitter.Reset()
+	EmitMetricUpdate()
+	got := make(map[string]uint64)
+	for _, v := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+		got[v.GetFieldValues()[0]] = v.GetUint64Value()
+	}
+	if want := map[string]uint64{"cpu0": 4, "cpu1": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("EmitMetricUpdate got %v want %v", got, want)
+	}
+}
+
+func TestDynamicFieldErrors(t *testing.T) {
+	defer reset()
+
+	prefixed := NewFieldWithValidator("path", func(v string) bool { return strings.HasPrefix(v, "/") })
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription, prefixed); !errors.Is(err, ErrDynamicField) {
+		t.Errorf("NewUint64Metric with dynamic field got err %v want %v", err, ErrDynamicField)
+	}
+	if _, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, prefixed); !errors.Is(err, ErrDynamicField) {
+		t.Errorf("NewDistributionMetric with dynamic field got err %v want %v", err, ErrDynamicField)
+	}
+	if _, err := NewDynamicUint64Metric("/bar", false, pb.MetricMetadata_UNITS_NONE, barDescription, 10, NewField("field", []string{"a"})); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("NewDynamicUint64Metric with enumerated field got err %v want %v", err, ErrInvalidArgument)
+	}
+	if _, err := NewDynamicUint64Metric("/bar", false, pb.MetricMetadata_UNITS_NONE, barDescription, 0, prefixed); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("NewDynamicUint64Metric with no values got err %v want %v", err, ErrInvalidArgument)
+	}
+	m, err := NewDynamicUint64Metric("/bar", false, pb.MetricMetadata_UNITS_NONE, barDescription, 10, prefixed)
+	if err != nil {
+		t.Fatalf("NewDynamicUint64Metric got err %v want nil", err)
+	}
+	m.Increment("/a")
+	m.Increment("a")
+	if got := m.Value("/a"); got != 1 {
+		t.Errorf("Value(/a) got %d want 1", got)
+	}
+	if got := m.Dropped(); got != 1 {
+		t.Errorf("Dropped() got %d want 1", got)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// jsonSnapshot is the JSON representation of a Snapshot.
+type jsonSnapshot struct {
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+// jsonMetric is the JSON representation of a MetricSnapshot.
+type jsonMetric struct {
+	Name              string      `json:"name"`
+	Description       string      `json:"description,omitempty"`
+	Type              string      `json:"type"`
+	Units             string      `json:"units"`
+	Subsystem         string      `json:"subsystem,omitempty"`
+	Cumulative        bool        `json:"cumulative,omitempty"`
+	Fields            []string    `json:"fields,omitempty"`
+	BucketLowerBounds []int64     `json:"bucket_lower_bounds,omitempty"`
+	Points            []jsonPoint `json:"points"`
+}
+
+// jsonPoint is the JSON representation of a MetricPoint.
+type jsonPoint struct {
+	FieldValues []string `json:"field_values,omitempty"`
+	Value       *uint64  `json:"value,omitempty"`
+	Samples     []uint64 `json:"samples,omitempty"`
+}
+
+// WriteJSON writes s to w as a single JSON object.
+//
+// Distribution points have one more sample count than their metric has
+// bucket lower bounds: the first one is the underflow bucket, from negative
+// infinity to the first lower bound.
+func (s Snapshot) WriteJSON(w io.Writer) error {
+	js := jsonSnapshot{Metrics: make([]jsonMetric, 0, len(s.Metrics))}
+	for _, m := range s.Metrics {
+		md := m.Metadata
+		jm := jsonMetric{
+			Name:              md.GetName(),
+			Description:       md.GetDescription(),
+			Type:              md.GetType().String(),
+			Units:             md.GetUnits().String(),
+			Subsystem:         md.GetSubsystem(),
+			Cumulative:        md.GetCumulative(),
+			BucketLowerBounds: md.GetDistributionBucketLowerBounds(),
+			Points:            make([]jsonPoint, 0, len(m.Points)),
+		}
+		for _, f := range md.GetFields() {
+			jm.Fields = append(jm.Fields, f.GetFieldName())
+		}
+		for i := range m.Points {
+			p := &m.Points[i]
+			jp := jsonPoint{FieldValues: p.FieldValues}
+			if md.GetType() == pb.MetricMetadata_TYPE_DISTRIBUTION {
+				jp.Samples = p.Samples
+			} else {
+				jp.Value = &p.Uint64
+			}
+			jm.Points = append(jm.Points, jp)
+		}
+		js.Metrics = append(js.Metrics, jm)
+	}
+	return json.NewEncoder(w).Encode(&js)
+}
+
+// csvHeader is the header row written by Snapshot.WriteCSV.
+var csvHeader = []string{"name", "fields", "bucket_lower_bound", "value"}
+
+// WriteCSV writes s to w in CSV format, with a header row followed by one row
+// per value.
+//
+// Field values are written as a single "name=value" list separated by ";".
+// Uint64 metrics have one row per point, with an empty bucket lower bound.
+// Distribution metrics have one row per bucket of each point; the underflow
+// bucket has a lower bound of "-Inf".
+func (s Snapshot) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, m := range s.Metrics {
+		md := m.Metadata
+		for _, p := range m.Points {
+			fields := make([]string, len(p.FieldValues))
+			for i, v := range p.FieldValues {
+				fields[i] = md.GetFields()[i].GetFieldName() + "=" + v
+			}
+			row := []string{md.GetName(), strings.Join(fields, ";"), "", ""}
+			if md.GetType() != pb.MetricMetadata_TYPE_DISTRIBUTION {
+				row[3] = strconv.FormatUint(p.Uint64, 10)
+				if err := cw.Write(row); err != nil {
+					return err
+				}
+				continue
+			}
+			lowerBounds := m.BucketLowerBounds()
+			for i, samples := range p.Samples {
+				row[2] = formatLowerBound(lowerBounds[i])
+				row[3] = strconv.FormatUint(samples, 10)
+				if err := cw.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatLowerBound formats the lower bound of a distribution bucket, with the
+// lower bound of the underflow bucket written as "-Inf".
+func formatLowerBound(bound int64) string {
+	if bound == UnderflowLowerBound {
+		return "-Inf"
+	}
+	return strconv.FormatInt(bound, 10)
+}
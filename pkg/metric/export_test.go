@@ -0,0 +1,106 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// exportSnapshot returns a snapshot of a counter with one field and a
+// distribution, for export tests.
+func exportSnapshot(t *testing.T) Snapshot {
+	t.Helper()
+	foo, err := NewUint64Metric("/foo", true, pb.MetricMetadata_UNITS_NONE, fooDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	foo.IncrementBy(2, "b")
+	distrib.AddSample(3)
+	return GetSnapshot()
+}
+
+func TestSnapshotWriteJSON(t *testing.T) {
+	defer reset()
+	s := exportSnapshot(t)
+
+	var buf bytes.Buffer
+	if err := s.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var got jsonSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", buf.String(), err)
+	}
+	zero, two := uint64(0), uint64(2)
+	want := jsonSnapshot{Metrics: []jsonMetric{
+		{
+			Name:              "/distrib",
+			Description:       distribDescription,
+			Type:              "TYPE_DISTRIBUTION",
+			Units:             "UNITS_NONE",
+			Cumulative:        true,
+			BucketLowerBounds: []int64{0, 2, 4},
+			Points:            []jsonPoint{{Samples: []uint64{0, 0, 1, 0}}},
+		},
+		{
+			Name:        "/foo",
+			Description: fooDescription,
+			Type:        "TYPE_UINT64",
+			Units:       "UNITS_NONE",
+			Cumulative:  true,
+			Fields:      []string{"field"},
+			Points: []jsonPoint{
+				{FieldValues: []string{"a"}, Value: &zero},
+				{FieldValues: []string{"b"}, Value: &two},
+			},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WriteJSON got %s want %+v", buf.String(), want)
+	}
+}
+
+func TestSnapshotWriteCSV(t *testing.T) {
+	defer reset()
+	s := exportSnapshot(t)
+
+	var buf bytes.Buffer
+	if err := s.WriteCSV(&buf); err != nil {
+		t.Fatalf("WriteCSV: %v", err)
+	}
+	want := `name,fields,bucket_lower_bound,value
+/distrib,,-Inf,0
+/distrib,,0,0
+/distrib,,2,1
+/distrib,,4,0
+/foo,field=a,,0
+/foo,field=b,,2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("WriteCSV got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package metric
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// FuzzFieldKeyRoundTrip checks that keyToMultiField is the exact inverse of
+// multiFieldToKey, which the emit path relies on to reconstruct the field
+// values of metrics from their keys.
+//
+// The fuzzed string is split on NUL bytes to form the field values, so that
+// the fuzzer explores both the number of fields and their contents.
+func FuzzFieldKeyRoundTrip(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"foo",
+		"foo\x00bar",
+		"foo\x00\x00bar",
+		"\x00",
+		"foo,bar",
+		"\xff\x00é",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		var fields []string
+		if s != "" {
+			fields = strings.Split(s, "\x00")
+		}
+		key, err := multiFieldToKey(fields...)
+		switch {
+		case strings.Contains(s, ","):
+			if !errors.Is(err, ErrFieldValueContainsIllegalChar) {
+				t.Fatalf("multiFieldToKey(%q) got err %v want %v", fields, err, ErrFieldValueContainsIllegalChar)
+			}
+			return
+		case len(fields) == 1 && fields[0] == "":
+			if !errors.Is(err, ErrEmptyFieldValue) {
+				t.Fatalf("multiFieldToKey(%q) got err %v want %v", fields, err, ErrEmptyFieldValue)
+			}
+			return
+		case err != nil:
+			t.Fatalf("multiFieldToKey(%q) got err %v want nil", fields, err)
+		}
+		if got := keyToMultiField(key); !reflect.DeepEqual(got, fields) {
+			t.Errorf("keyToMultiField(multiFieldToKey(%q)) got %q", fields, got)
+		}
+	})
+}
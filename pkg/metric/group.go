@@ -0,0 +1,90 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// UpdateGroup makes updates to several correlated metrics visible atomically,
+// e.g. the count, bytes and latency of a read. Snapshots of metric values
+// (EmitMetricUpdate, GetSnapshot) observe either all or none of the updates
+// made within a single call to UpdateGroup.Update.
+//
+// Update groups are opt-in and have a cost: each call to Update takes a
+// shared lock, and snapshots take the exclusive lock of every group, so they
+// wait for in-progress updates and block new ones while metric values are
+// read. Updates within the same group do not block each other. Metrics are
+// not tied to groups; only updates made within Update are atomic with
+// respect to snapshots.
+type UpdateGroup struct {
+	// mu is held for reading by Update, and for writing while taking a
+	// snapshot of metric values.
+	mu sync.RWMutex
+}
+
+// NewUpdateGroup creates and registers a new update group.
+//
+// Update groups must be statically defined (i.e., at init).
+func NewUpdateGroup() (*UpdateGroup, error) {
+	if err := lockRegistration("register an update group"); err != nil {
+		return nil, err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return nil, ErrInitializationDone
+	}
+	g := &UpdateGroup{}
+	allMetrics.groups = append(allMetrics.groups, g)
+	return g, nil
+}
+
+// MustCreateNewUpdateGroup calls NewUpdateGroup and panics if it returns an
+// error.
+func MustCreateNewUpdateGroup() *UpdateGroup {
+	g, err := NewUpdateGroup()
+	if err != nil {
+		panic(fmt.Sprintf("Unable to create update group: %s", err))
+	}
+	return g
+}
+
+// Update calls f, which is expected to update metrics (e.g. with Increment or
+// AddSample). Snapshots of metric values observe either all or none of these
+// updates.
+//
+// f must not take snapshots of metric values, or call Update on any group.
+func (g *UpdateGroup) Update(f func()) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	f()
+}
+
+// lockGroups locks all update groups of m for writing, and returns a function
+// that unlocks them.
+func (m *metricSet) lockGroups() func() {
+	// Groups are always locked in registration order. Update only ever holds
+	// one group at a time, so this can't deadlock.
+	for _, g := range m.groups {
+		g.mu.Lock()
+	}
+	return func() {
+		for _, g := range m.groups {
+			g.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestUpdateGroup(t *testing.T) {
+	defer reset()
+
+	group := MustCreateNewUpdateGroup()
+	reads := MustCreateNewUint64Metric("/reads", false, counterDescription)
+	bytes := MustCreateNewUint64Metric("/read_bytes", false, counterDescription)
+	latency := MustRegisterDistributionMetric("/read_latency", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if _, err := NewUpdateGroup(); err != ErrInitializationDone {
+		t.Errorf("NewUpdateGroup after Initialize got err %v want %v", err, ErrInitializationDone)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			group.Update(func() {
+				reads.Increment()
+				bytes.IncrementBy(10)
+				latency.AddSample(1)
+			})
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		vals := allMetrics.Values()
+		numReads := vals.uint64Metrics["/reads"].(uint64)
+		numBytes := vals.uint64Metrics["/read_bytes"].(uint64)
+		numSamples := vals.distributionTotalSamples["/read_latency"][""]
+		if numBytes != 10*numReads || numSamples != numReads {
+			t.Fatalf("inconsistent snapshot: %d reads, %d bytes, %d latency samples", numReads, numBytes, numSamples)
+		}
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"gvisor.dev/gvisor/pkg/goid"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+var (
+	// registrationMu serializes metric registration, every other function
+	// that must be called before Initialize (e.g. SetEmitDivisor or
+	// NewUpdateGroup), and calls to registration hooks. It protects
+	// initialized and registrationHooks, and until Initialize is called, the
+	// state of allMetrics that these functions write to. See
+	// metricSet.metadataMu for the maps of metrics, which are also protected
+	// by metadataMu.
+	registrationMu sync.Mutex
+
+	// registrationHooks are the hooks added by RegisterOnRegistration.
+	registrationHooks []func(name string, md *pb.MetricMetadata)
+
+	// hookGoroutine is the ID of the goroutine calling registration hooks,
+	// or 0 if no hook is being called. It is accessed atomically.
+	hookGoroutine int64
+)
+
+// lockRegistration locks registrationMu. It returns an error wrapping
+// ErrRegistrationHook, rather than deadlocking, if called from a registration
+// hook. what describes the attempted registration.
+func lockRegistration(what string) error {
+	if atomic.LoadInt64(&hookGoroutine) == goid.Get() {
+		return fmt.Errorf("%w: cannot %s", ErrRegistrationHook, what)
+	}
+	registrationMu.Lock()
+	return nil
+}
+
+// RegisterOnRegistration adds a hook that is called synchronously whenever a
+// metric is registered, with its name and metadata, e.g. so that an exporter
+// created before all metrics are registered can index them incrementally
+// rather than waiting for Initialize. The hook is immediately called for all
+// metrics registered so far, in name order. It is called again for a metric
+// whose metadata is replaced by ChangeDescription.
+//
+// md is shared with the metric and must not be modified. Metadata set after
+// registration (e.g. by SetSubsystem) is reflected in md until Initialize is
+// called.
+//
+// Registrations are serialized with each other and with hooks, so hooks are
+// never called concurrently. Hooks must not register metrics or other hooks;
+// such calls fail with ErrRegistrationHook.
+//
+// RegisterOnRegistration is thread-safe.
+func RegisterOnRegistration(hook func(name string, md *pb.MetricMetadata)) error {
+	if err := lockRegistration("add a registration hook"); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+
+	existing := make(map[string]*pb.MetricMetadata, len(allMetrics.uint64Metrics)+len(allMetrics.distributionMetrics))
+	for name, m := range allMetrics.uint64Metrics {
+		existing[name] = m.metadata
+	}
+	for name, m := range allMetrics.distributionMetrics {
+		existing[name] = m.metadata
+	}
+	names := make([]string, 0, len(existing))
+	for name := range existing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	atomic.StoreInt64(&hookGoroutine, goid.Get())
+	defer atomic.StoreInt64(&hookGoroutine, 0)
+	for _, name := range names {
+		hook(name, existing[name])
+	}
+	registrationHooks = append(registrationHooks, hook)
+	return nil
+}
+
+// notifyRegistration calls the registration hooks for the newly-registered
+// metric with the given name and metadata.
+//
+// Preconditions:
+// * registrationMu is locked.
+func notifyRegistration(name string, md *pb.MetricMetadata) {
+	if len(registrationHooks) == 0 {
+		return
+	}
+	atomic.StoreInt64(&hookGoroutine, goid.Get())
+	defer atomic.StoreInt64(&hookGoroutine, 0)
+	for _, hook := range registrationHooks {
+		hook(name, md)
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+func TestRegisterOnRegistration(t *testing.T) {
+	defer reset()
+
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if _, err := NewUint64Metric("/bar", false, pb.MetricMetadata_UNITS_NONE, barDescription); err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+
+	var names []string
+	var hookErrs []error
+	if err := RegisterOnRegistration(func(name string, md *pb.MetricMetadata) {
+		if md.GetName() != name {
+			t.Errorf("hook called with name %q and metadata for %q", name, md.GetName())
+		}
+		names = append(names, name)
+		// Registration from a hook is rejected.
+		_, err := NewUint64Metric(name+"/nested", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+		hookErrs = append(hookErrs, err)
+		hookErrs = append(hookErrs, RegisterOnRegistration(func(string, *pb.MetricMetadata) {}))
+	}); err != nil {
+		t.Fatalf("RegisterOnRegistration: %v", err)
+	}
+	// Existing metrics are replayed in name order.
+	if want := []string{"/bar", "/foo"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("replayed names got %v want %v", names, want)
+	}
+
+	names = nil
+	if _, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(3, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription); err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if _, err := NewSparseUint64Metric("/sparse", false, pb.MetricMetadata_UNITS_NONE, counterDescription, NewField("field", []string{"a", "b"})); err != nil {
+		t.Fatalf("NewSparseUint64Metric: %v", err)
+	}
+	if err := RegisterAlias("/foo", "/foo_alias"); err != nil {
+		t.Fatalf("RegisterAlias: %v", err)
+	}
+	if want := []string{"/distrib", "/sparse", "/foo_alias"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("registered names got %v want %v", names, want)
+	}
+
+	for _, err := range hookErrs {
+		if !errors.Is(err, ErrRegistrationHook) {
+			t.Errorf("registration from a hook got err %v want %v", err, ErrRegistrationHook)
+		}
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	// Nested registrations left nothing behind.
+	if got := len(emitter[0].(*pb.MetricRegistration).GetMetrics()); got != 5 {
+		t.Errorf("got %d registered metrics want 5", got)
+	}
+}
+
+func TestRegisterOnRegistrationConcurrent(t *testing.T) {
+	defer reset()
+
+	// A registration from another goroutine while a hook runs waits for the
+	// hook rather than failing.
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	if err := RegisterOnRegistration(func(name string, md *pb.MetricMetadata) {
+		if name != "/foo" {
+			return
+		}
+		go func() {
+			close(started)
+			_, err := NewUint64Metric("/bar", false, pb.MetricMetadata_UNITS_NONE, barDescription)
+			done <- err
+		}()
+		<-started
+	}); err != nil {
+		t.Fatalf("RegisterOnRegistration: %v", err)
+	}
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("NewUint64Metric from another goroutine during a hook got err %v want nil", err)
+	}
+
+	// Hooks and registrations can be added concurrently, and every hook sees
+	// every metric exactly once.
+	const n = 10
+	var wg sync.WaitGroup
+	seen := make([]map[string]int, n)
+	for i := 0; i < n; i++ {
+		i := i
+		seen[i] = make(map[string]int)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := RegisterOnRegistration(func(name string, _ *pb.MetricMetadata) {
+				seen[i][name]++
+			}); err != nil {
+				t.Errorf("RegisterOnRegistration: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := NewUint64Metric(fmt.Sprintf("/concurrent/%d", i), false, pb.MetricMetadata_UNITS_NONE, counterDescription); err != nil {
+				t.Errorf("NewUint64Metric: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i, names := range seen {
+		if len(names) != n+2 {
+			t.Errorf("hook %d saw %d metrics want %d", i, len(names), n+2)
+		}
+		for name, count := range names {
+			if count != 1 {
+				t.Errorf("hook %d saw %s %d times want once", i, name, count)
+			}
+		}
+	}
+}
+
+func TestPreInitializeConcurrent(t *testing.T) {
+	defer reset()
+
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	timer, err := NewTimerMetric("/timer", NewDurationBucketer(5, time.Microsecond, time.Second), "a timer metric")
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+
+	// Every function that must be called before Initialize either succeeds
+	// or fails with ErrInitializationDone when racing with Initialize.
+	setters := map[string]func() error{
+		"SetEmitDivisor": func() error {
+			return SetEmitDivisor(2, "/foo")
+		},
+		"SetScalarBatchThreshold": func() error {
+			return SetScalarBatchThreshold(2)
+		},
+		"NewUpdateGroup": func() error {
+			_, err := NewUpdateGroup()
+			return err
+		},
+		"RecordOutliers": func() error {
+			return distrib.RecordOutliers(10, 4)
+		},
+		"TrackInFlight": func() error {
+			return timer.TrackInFlight(0)
+		},
+		"SetSubsystem": func() error {
+			return SetSubsystem("subsystem", "/foo")
+		},
+		"RegisterAlias": func() error {
+			return RegisterAlias("/foo", "/foo_alias")
+		},
+		"NewCountSumMetric": func() error {
+			_, err := NewCountSumMetric("/ops", false, pb.MetricMetadata_UNITS_NONE, counterDescription)
+			return err
+		},
+	}
+	var wg sync.WaitGroup
+	for name, set := range setters {
+		name, set := name, set
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := set(); err != nil && err != ErrInitializationDone {
+				t.Errorf("%s got err %v want nil or %v", name, err, ErrInitializationDone)
+			}
+		}()
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	wg.Wait()
+	GetSnapshot()
+	EmitMetricUpdate()
+}
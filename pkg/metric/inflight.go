@@ -0,0 +1,104 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// inFlightSuffix is the suffix of the name of the gauge registered by
+// TimerMetric.TrackInFlight.
+const inFlightSuffix = "/in_flight"
+
+// inFlightGauge counts the in-flight operations of a TimerMetric.
+type inFlightGauge struct {
+	// fieldsToKey maps the fields passed to TimerMetric.Start to a key of
+	// counts. It is immutable.
+	fieldsToKey fieldMapper
+
+	// counts maps field keys to the number of operations in flight. The map
+	// is immutable; the values it points to are accessed atomically.
+	counts map[string]*int64
+}
+
+// TrackInFlight makes t maintain a companion gauge of the number of
+// operations in flight, i.e. started with Start but not finished yet. The
+// gauge is registered as "<name>/in_flight", and is broken down by the first
+// numStartFields fields of t, which must be exactly the fields passed to
+// Start. As uint64 metrics support at most one field, numStartFields must be
+// 0 or 1.
+//
+// Operations that are never finished are counted as in flight forever, so
+// every call to Start must eventually be followed by a call to Finish, e.g.
+// with defer, including on error paths.
+// Operations started with a MultiTimer are not counted.
+//
+// TrackInFlight must be called when the metric is defined (i.e., at init).
+func (t *TimerMetric) TrackInFlight(numStartFields int) error {
+	if err := lockRegistration(fmt.Sprintf("track in-flight operations of %q", t.metadata.GetName())); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return ErrInitializationDone
+	}
+	if t.inFlight != nil {
+		return fmt.Errorf("%w: in-flight operations of %q are already tracked", ErrInvalidArgument, t.metadata.GetName())
+	}
+	protoFields := t.metadata.GetFields()
+	if numStartFields < 0 || numStartFields > len(protoFields) {
+		return fmt.Errorf("%w: %d start fields provided, metric has %d fields", ErrInvalidArgument, numStartFields, len(protoFields))
+	}
+	fields := make([]Field, numStartFields)
+	for i, f := range protoFields[:numStartFields] {
+		fields[i] = NewField(f.GetFieldName(), f.GetAllowedValues())
+	}
+	fieldsToKey, err := newFieldMapper(fields...)
+	if err != nil {
+		return err
+	}
+	g := &inFlightGauge{
+		fieldsToKey: fieldsToKey,
+		counts:      make(map[string]*int64),
+	}
+	for _, key := range fieldsToKey.all() {
+		g.counts[key] = new(int64)
+	}
+	if err := registerUint64MetricLocked(t.metadata.GetName()+inFlightSuffix, false /* cumulative */, false /* sync */, pb.MetricMetadata_UNITS_NONE, "Number of operations in flight for "+t.metadata.GetName(), g.value, nil /* fieldValues */, fields...); err != nil {
+		return err
+	}
+	t.inFlight = g
+	return nil
+}
+
+// InFlight returns the number of operations of t in flight for the given
+// fields, as passed to Start. t must track in-flight operations.
+func (t *TimerMetric) InFlight(fields ...string) uint64 {
+	return t.inFlight.value(fields...)
+}
+
+// value returns the number of operations in flight for the given fields.
+func (g *inFlightGauge) value(fields ...string) uint64 {
+	n := atomic.LoadInt64(g.counts[g.fieldsToKey.lookup(fields...)])
+	if n < 0 {
+		// Finish and Start may race with this load such that only the
+		// decrement is visible.
+		return 0
+	}
+	return uint64(n)
+}
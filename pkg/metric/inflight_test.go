@@ -0,0 +1,94 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestTrackInFlight(t *testing.T) {
+	defer reset()
+	bucketer := NewDurationBucketer(5, time.Microsecond, time.Second)
+	timer, err := NewTimerMetric("/timer", bucketer, "a timer metric", NewField("op", []string{"read", "write"}), NewField("result", []string{"ok", "error"}))
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	if err := timer.TrackInFlight(2); err == nil {
+		t.Errorf("TrackInFlight(2) got nil error, want one")
+	}
+	if err := timer.TrackInFlight(1); err != nil {
+		t.Fatalf("TrackInFlight(1): %v", err)
+	}
+	if err := timer.TrackInFlight(1); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("second TrackInFlight(1) got err %v want %v", err, ErrInvalidArgument)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	emitter.Reset()
+
+	read1 := timer.Start("read")
+	read2 := timer.Start("read")
+	write := timer.Start("write")
+	if got := timer.InFlight("read"); got != 2 {
+		t.Errorf("InFlight(read) got %d want 2", got)
+	}
+	if got := timer.InFlight("write"); got != 1 {
+		t.Errorf("InFlight(write) got %d want 1", got)
+	}
+
+	read1.Finish("ok")
+	// Finishing an operation twice only decrements the gauge once.
+	read1.Finish("ok")
+	write.Finish("error")
+	read3 := timer.Start("read")
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	got := make(map[string]uint64)
+	for _, m := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+		if m.GetName() == "/timer/in_flight" {
+			got[m.GetFieldValues()[0]] = m.GetUint64Value()
+		}
+	}
+	if got["read"] != 2 || got["write"] != 0 {
+		t.Errorf("emitted in-flight gauge got %v want read=2, write=0", got)
+	}
+
+	read2.Finish("ok")
+	read3.Finish("ok")
+	if got := timer.InFlight("read"); got != 0 {
+		t.Errorf("InFlight(read) after finishing all operations got %d want 0", got)
+	}
+}
+
+func TestTrackInFlightAfterInitialize(t *testing.T) {
+	defer reset()
+	timer, err := NewTimerMetric("/timer", NewDurationBucketer(5, time.Microsecond, time.Second), "a timer metric")
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if err := timer.TrackInFlight(0); !errors.Is(err, ErrInitializationDone) {
+		t.Errorf("TrackInFlight after Initialize got err %v want %v", err, ErrInitializationDone)
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package emitstate lets package metrictest reset the emit state of package
+// metric without emitting anything. It is internal so that code outside of
+// package metric and its tests can't affect which changes are emitted.
+package emitstate
+
+// Reset makes the next metric update only contain changes made after it is
+// called, as if an update had just been emitted. It is set by package metric.
+var Reset func()
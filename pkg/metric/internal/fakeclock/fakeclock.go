@@ -0,0 +1,24 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+// Package fakeclock holds the fake time observed by timer metrics and
+// initialization stages in tests. It is set by package metrictest, and is
+// internal so that code outside of package metric and its tests can't fake
+// the time of metrics.
+//
+// The fake time is only available when building with the metric_fakeclock
+// tag. Otherwise, NowNano always returns 0, so that package metric reads the
+// real clock directly and timers pay nothing for the fake one.
+package fakeclock
@@ -0,0 +1,42 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+//go:build !metric_fakeclock
+// +build !metric_fakeclock
+
+package fakeclock
+
+import (
+	"time"
+)
+
+// Enabled is true if the fake time can be set.
+const Enabled = false
+
+// Set panics: the fake time requires the metric_fakeclock build tag.
+func Set(now time.Time) {
+	panic("fakeclock: the fake time requires building with the metric_fakeclock tag")
+}
+
+// Clear does nothing, since no fake time can be set.
+func Clear() {}
+
+// NowNano returns 0, as no fake time can be set. It is inlined into its
+// callers, which then compile down to reading the real clock.
+// +checkescape:all
+//go:nosplit
+func NowNano() int64 {
+	return 0
+}
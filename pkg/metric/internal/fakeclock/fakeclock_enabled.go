@@ -0,0 +1,50 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+
+//go:build metric_fakeclock
+// +build metric_fakeclock
+
+package fakeclock
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Enabled is true if the fake time can be set.
+const Enabled = true
+
+// nowNs is the fake current time, in nanoseconds since the Unix epoch, or 0 if
+// no fake time is set. It is accessed atomically.
+var nowNs int64
+
+// Set makes package metric observe now as the current time, until Clear is
+// called.
+func Set(now time.Time) {
+	atomic.StoreInt64(&nowNs, now.UnixNano())
+}
+
+// Clear undoes Set, so that the real time is observed again.
+func Clear() {
+	atomic.StoreInt64(&nowNs, 0)
+}
+
+// NowNano returns the fake current time, in nanoseconds since the Unix epoch,
+// or 0 if no fake time is set.
+// +checkescape:all
+//go:nosplit
+func NowNano() int64 {
+	return atomic.LoadInt64(&nowNs)
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// MergeSnapshots merges the metrics of src into dst, e.g. to build a
+// federated view of the metrics of several sandboxes, as collected from their
+// respective GetSnapshot. It returns the merged snapshot; dst and src are not
+// modified.
+//
+// Metrics of src whose name is not in dst are added as is. For metrics in
+// both:
+//   - If sum is true and both metrics are compatible (same type, units,
+//     fields and bucket bounds), their values are summed for each combination
+//     of field values.
+//   - Otherwise, the metric of src is kept separate, and renamed by prefixing
+//     its name with "/" + srcName, e.g. "/fs/opens" becomes
+//     "/sandbox2/fs/opens". It is an error if the new name is also in dst.
+func MergeSnapshots(dst, src Snapshot, srcName string, sum bool) (Snapshot, error) {
+	if srcName == "" || strings.Contains(srcName, "/") {
+		return Snapshot{}, fmt.Errorf("%w: %q", ErrInvalidSourceName, srcName)
+	}
+	byName := make(map[string]int, len(dst.Metrics))
+	merged := Snapshot{Metrics: make([]MetricSnapshot, len(dst.Metrics), len(dst.Metrics)+len(src.Metrics))}
+	for i, m := range dst.Metrics {
+		merged.Metrics[i] = m
+		byName[m.Metadata.GetName()] = i
+	}
+	for _, m := range src.Metrics {
+		name := m.Metadata.GetName()
+		i, ok := byName[name]
+		if !ok {
+			byName[name] = len(merged.Metrics)
+			merged.Metrics = append(merged.Metrics, m)
+			continue
+		}
+		if sum && compatibleMetadata(merged.Metrics[i].Metadata, m.Metadata) {
+			merged.Metrics[i] = MetricSnapshot{
+				Metadata: merged.Metrics[i].Metadata,
+				Points:   sumPoints(merged.Metrics[i].Points, m.Points),
+			}
+			continue
+		}
+		renamed := "/" + srcName + name
+		if _, ok := byName[renamed]; ok {
+			return Snapshot{}, fmt.Errorf("%w: cannot rename metric %q of %q to %q", ErrNameInUse, name, srcName, renamed)
+		}
+		metadata := proto.Clone(m.Metadata).(*pb.MetricMetadata)
+		metadata.Name = renamed
+		byName[renamed] = len(merged.Metrics)
+		merged.Metrics = append(merged.Metrics, MetricSnapshot{
+			Metadata: metadata,
+			Points:   m.Points,
+		})
+	}
+	sort.Slice(merged.Metrics, func(i, j int) bool {
+		return merged.Metrics[i].Metadata.GetName() < merged.Metrics[j].Metadata.GetName()
+	})
+	return merged, nil
+}
+
+// compatibleMetadata returns whether metrics with the given metadata can be
+// summed.
+func compatibleMetadata(a, b *pb.MetricMetadata) bool {
+	if a.GetType() != b.GetType() || a.GetCumulative() != b.GetCumulative() || a.GetUnits() != b.GetUnits() || len(a.GetFields()) != len(b.GetFields()) {
+		return false
+	}
+	for i, f := range a.GetFields() {
+		if f.GetFieldName() != b.GetFields()[i].GetFieldName() {
+			return false
+		}
+	}
+	aBounds, bBounds := a.GetDistributionBucketLowerBounds(), b.GetDistributionBucketLowerBounds()
+	if len(aBounds) != len(bBounds) {
+		return false
+	}
+	for i := range aBounds {
+		if aBounds[i] != bBounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sumPoints returns the point-wise sum of a and b, matching points by field
+// values. a and b must be points of compatible metrics.
+func sumPoints(a, b []MetricPoint) []MetricPoint {
+	byKey := make(map[string]int, len(a))
+	points := make([]MetricPoint, 0, len(a)+len(b))
+	for _, p := range append(append([]MetricPoint(nil), a...), b...) {
+		key := strings.Join(p.FieldValues, ",")
+		i, ok := byKey[key]
+		if !ok {
+			byKey[key] = len(points)
+			p.Samples = append([]uint64(nil), p.Samples...)
+			points = append(points, p)
+			continue
+		}
+		points[i].Uint64 += p.Uint64
+		for j, s := range p.Samples {
+			points[i].Samples[j] += s
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return strings.Join(points[i].FieldValues, ",") < strings.Join(points[j].FieldValues, ",")
+	})
+	return points
+}
+
+// CollapseField returns a view of the metric of s with the given name without
+// the given field, whose points are the sum of the points of the metric over
+// all values of that field. For example, collapsing field "fs_type" of a
+// metric with fields (fs_type, operation) results in a metric with field
+// (operation), whose value for each operation is summed across filesystem
+// types. Bucket counts of distributions are summed bucket-wise.
+func (s Snapshot) CollapseField(metricName, fieldName string) (MetricSnapshot, error) {
+	var m *MetricSnapshot
+	for i := range s.Metrics {
+		if s.Metrics[i].Metadata.GetName() == metricName {
+			m = &s.Metrics[i]
+			break
+		}
+	}
+	if m == nil {
+		return MetricSnapshot{}, fmt.Errorf("%w: %q", ErrMetricNotFound, metricName)
+	}
+	fieldIndex := -1
+	for i, f := range m.Metadata.GetFields() {
+		if f.GetFieldName() == fieldName {
+			fieldIndex = i
+			break
+		}
+	}
+	if fieldIndex < 0 {
+		return MetricSnapshot{}, fmt.Errorf("%w: metric %q has no field %q", ErrInvalidArgument, metricName, fieldName)
+	}
+
+	metadata := proto.Clone(m.Metadata).(*pb.MetricMetadata)
+	metadata.Fields = append(metadata.Fields[:fieldIndex:fieldIndex], metadata.Fields[fieldIndex+1:]...)
+	points := make([]MetricPoint, len(m.Points))
+	for i, p := range m.Points {
+		p.FieldValues = append(p.FieldValues[:fieldIndex:fieldIndex], p.FieldValues[fieldIndex+1:]...)
+		points[i] = p
+	}
+	return MetricSnapshot{
+		Metadata: metadata,
+		Points:   sumPoints(points, nil),
+	}, nil
+}
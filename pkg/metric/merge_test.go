@@ -0,0 +1,200 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func counterSnapshot(name string, points ...MetricPoint) MetricSnapshot {
+	return MetricSnapshot{
+		Metadata: &pb.MetricMetadata{
+			Name:   name,
+			Type:   pb.MetricMetadata_TYPE_UINT64,
+			Fields: []*pb.MetricMetadata_Field{{FieldName: "field", AllowedValues: []string{"a", "b"}}},
+		},
+		Points: points,
+	}
+}
+
+func distribSnapshot(name string, lowerBounds []int64, samples []uint64) MetricSnapshot {
+	return MetricSnapshot{
+		Metadata: &pb.MetricMetadata{
+			Name:                          name,
+			Type:                          pb.MetricMetadata_TYPE_DISTRIBUTION,
+			DistributionBucketLowerBounds: lowerBounds,
+		},
+		Points: []MetricPoint{{Samples: samples}},
+	}
+}
+
+// names returns the names of the metrics in s.
+func names(s Snapshot) []string {
+	var names []string
+	for _, m := range s.Metrics {
+		names = append(names, m.Metadata.GetName())
+	}
+	return names
+}
+
+func TestMergeSnapshots(t *testing.T) {
+	dst := Snapshot{Metrics: []MetricSnapshot{
+		counterSnapshot("/counter", MetricPoint{FieldValues: []string{"a"}, Uint64: 1}),
+		distribSnapshot("/distrib", []int64{0, 10}, []uint64{0, 1, 2}),
+		distribSnapshot("/other", []int64{0, 10}, []uint64{0, 1, 2}),
+	}}
+	src := Snapshot{Metrics: []MetricSnapshot{
+		counterSnapshot("/counter", MetricPoint{FieldValues: []string{"a"}, Uint64: 2}, MetricPoint{FieldValues: []string{"b"}, Uint64: 3}),
+		distribSnapshot("/distrib", []int64{0, 10}, []uint64{1, 1, 1}),
+		// Incompatible bucket bounds.
+		distribSnapshot("/other", []int64{0, 20}, []uint64{0, 0, 1}),
+		distribSnapshot("/new", []int64{0, 10}, []uint64{0, 0, 1}),
+	}}
+
+	t.Run("sum", func(t *testing.T) {
+		merged, err := MergeSnapshots(dst, src, "src", true)
+		if err != nil {
+			t.Fatalf("MergeSnapshots: %v", err)
+		}
+		if got, want := names(merged), []string{"/counter", "/distrib", "/new", "/other", "/src/other"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got metrics %v want %v", got, want)
+		}
+		wantCounter := []MetricPoint{
+			{FieldValues: []string{"a"}, Uint64: 3},
+			{FieldValues: []string{"b"}, Uint64: 3},
+		}
+		if got := merged.Metrics[0].Points; !reflect.DeepEqual(got, wantCounter) {
+			t.Errorf("/counter: got %+v want %+v", got, wantCounter)
+		}
+		if got, want := merged.Metrics[1].Points[0].Samples, []uint64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+			t.Errorf("/distrib: got samples %v want %v", got, want)
+		}
+		if got, want := merged.Metrics[4].Points[0].Samples, []uint64{0, 0, 1}; !reflect.DeepEqual(got, want) {
+			t.Errorf("/src/other: got samples %v want %v", got, want)
+		}
+		// Inputs are not modified.
+		if got, want := dst.Metrics[1].Points[0].Samples, []uint64{0, 1, 2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("dst /distrib: got samples %v want unmodified %v", got, want)
+		}
+		if got := src.Metrics[2].Metadata.GetName(); got != "/other" {
+			t.Errorf("src /other: got name %q want unmodified", got)
+		}
+	})
+
+	t.Run("separate", func(t *testing.T) {
+		merged, err := MergeSnapshots(dst, src, "src", false)
+		if err != nil {
+			t.Fatalf("MergeSnapshots: %v", err)
+		}
+		if got, want := names(merged), []string{"/counter", "/distrib", "/new", "/other", "/src/counter", "/src/distrib", "/src/other"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got metrics %v want %v", got, want)
+		}
+	})
+
+	t.Run("collision", func(t *testing.T) {
+		dst := Snapshot{Metrics: []MetricSnapshot{
+			counterSnapshot("/counter"),
+			counterSnapshot("/src/counter"),
+		}}
+		src := Snapshot{Metrics: []MetricSnapshot{counterSnapshot("/counter")}}
+		if _, err := MergeSnapshots(dst, src, "src", false); !errors.Is(err, ErrNameInUse) {
+			t.Errorf("MergeSnapshots got err %v want %v", err, ErrNameInUse)
+		}
+	})
+}
+
+func TestCollapseField(t *testing.T) {
+	defer reset()
+
+	fsType := NewField("fs_type", []string{"tmpfs", "gofer"})
+	operation := NewField("operation", []string{"read", "write"})
+	counter, err := NewUint64Metric("/counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription, fsType)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, fsType, operation)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	counter.IncrementBy(1, "tmpfs")
+	counter.IncrementBy(2, "gofer")
+	distrib.AddSample(1, "tmpfs", "read")
+	distrib.AddSample(3, "gofer", "read")
+	distrib.AddSample(3, "gofer", "write")
+	distrib.AddSample(5, "gofer", "write")
+	snapshot := GetSnapshot()
+
+	collapsed, err := snapshot.CollapseField("/distrib", "fs_type")
+	if err != nil {
+		t.Fatalf("CollapseField: %v", err)
+	}
+	if got := collapsed.Metadata.GetFields(); len(got) != 1 || got[0].GetFieldName() != "operation" {
+		t.Errorf("collapsed fields got %v want only operation", got)
+	}
+	want := []MetricPoint{
+		{FieldValues: []string{"read"}, Samples: []uint64{0, 1, 1, 0}},
+		{FieldValues: []string{"write"}, Samples: []uint64{0, 0, 1, 1}},
+	}
+	if !reflect.DeepEqual(collapsed.Points, want) {
+		t.Errorf("collapsed distribution got %+v want %+v", collapsed.Points, want)
+	}
+
+	collapsed, err = snapshot.CollapseField("/distrib", "operation")
+	if err != nil {
+		t.Fatalf("CollapseField: %v", err)
+	}
+	want = []MetricPoint{
+		{FieldValues: []string{"gofer"}, Samples: []uint64{0, 0, 2, 1}},
+		{FieldValues: []string{"tmpfs"}, Samples: []uint64{0, 1, 0, 0}},
+	}
+	if !reflect.DeepEqual(collapsed.Points, want) {
+		t.Errorf("collapsed distribution got %+v want %+v", collapsed.Points, want)
+	}
+
+	// Collapsing the only field results in the total.
+	collapsed, err = snapshot.CollapseField("/counter", "fs_type")
+	if err != nil {
+		t.Fatalf("CollapseField: %v", err)
+	}
+	if want := []MetricPoint{{FieldValues: []string{}, Uint64: 3}}; !reflect.DeepEqual(collapsed.Points, want) {
+		t.Errorf("collapsed counter got %+v want %+v", collapsed.Points, want)
+	}
+
+	// The snapshot is not modified.
+	for _, m := range snapshot.Metrics {
+		for _, p := range m.Points {
+			if len(p.FieldValues) != len(m.Metadata.GetFields()) {
+				t.Errorf("point %+v of %s modified by CollapseField", p, m.Metadata.GetName())
+			}
+		}
+	}
+	if got := len(snapshot.Metrics[1].Metadata.GetFields()); got != 2 {
+		t.Errorf("/distrib has %d fields after CollapseField want 2", got)
+	}
+
+	if _, err := snapshot.CollapseField("/unknown", "fs_type"); !errors.Is(err, ErrMetricNotFound) {
+		t.Errorf("CollapseField of unknown metric got err %v want %v", err, ErrMetricNotFound)
+	}
+	if _, err := snapshot.CollapseField("/counter", "unknown"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("CollapseField of unknown field got err %v want %v", err, ErrInvalidArgument)
+	}
+}
@@ -16,6 +16,7 @@
 package metric
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -24,9 +25,11 @@ import (
 	"sync/atomic"
 	"time"
 
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	"gvisor.dev/gvisor/pkg/eventchannel"
 	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/metric/internal/emitstate"
 	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
 	"gvisor.dev/gvisor/pkg/sync"
 )
@@ -44,6 +47,68 @@ var (
 	// field had an invalid character in it.
 	ErrFieldValueContainsIllegalChar = errors.New("metric field value contains illegal character")
 
+	// ErrEmptyFieldValue indicates that the value of the single field of a
+	// metric was empty, which can't be distinguished from the metric having
+	// no fields.
+	ErrEmptyFieldValue = errors.New("metric field value is empty")
+
+	// ErrNoFieldValues indicates that a metric field had no allowed values,
+	// so the metric could never be updated.
+	ErrNoFieldValues = errors.New("metric field has no allowed values")
+
+	// ErrRegistrationHook indicates that a metric registration hook tried to
+	// register a metric or another hook.
+	ErrRegistrationHook = errors.New("metric registration attempted from a registration hook")
+
+	// ErrInvalidArgument indicates that a metric was created with invalid
+	// parameters.
+	ErrInvalidArgument = errors.New("invalid metric argument")
+
+	// ErrDynamicField indicates that a field whose values are not enumerated
+	// was used with a metric that requires enumerated field values.
+	ErrDynamicField = errors.New("metric field values are not enumerated")
+
+	// ErrInvalidUnits indicates that the units of a metric are unknown, or
+	// are inconsistent with what the metric measures.
+	ErrInvalidUnits = errors.New("metric units are invalid")
+
+	// ErrAlreadyInitialized indicates that Initialize or Disable was called
+	// after either of them had already been called.
+	ErrAlreadyInitialized = errors.New("metrics already initialized or disabled")
+
+	// ErrNotInitialized indicates that the caller tried to shut down metrics
+	// before they were initialized.
+	ErrNotInitialized = errors.New("metrics not initialized")
+
+	// ErrMetricNotFound indicates that no metric is defined for the given
+	// name.
+	ErrMetricNotFound = errors.New("metric not found")
+
+	// ErrTooManyFields indicates that a metric was created with more fields
+	// than it supports.
+	ErrTooManyFields = errors.New("too many metric fields")
+
+	// ErrDuplicateField indicates that a metric was created with several
+	// fields of the same name.
+	ErrDuplicateField = errors.New("duplicate metric field")
+
+	// ErrInvalidBucketer indicates that a bucketer is not supported, or was
+	// constructed with invalid parameters.
+	ErrInvalidBucketer = errors.New("invalid bucketer")
+
+	// ErrNonMonotonicBounds indicates that bucket bounds are not strictly
+	// increasing.
+	ErrNonMonotonicBounds = errors.New("bucket bounds are not strictly increasing")
+
+	// ErrInvalidDistribution indicates that distribution samples are
+	// inconsistent with their bucket bounds, or that the requested operation
+	// on them is invalid.
+	ErrInvalidDistribution = errors.New("invalid distribution")
+
+	// ErrInvalidSourceName indicates that the name of a source of metrics is
+	// empty or contains illegal characters.
+	ErrInvalidSourceName = errors.New("invalid metric source name")
+
 	// WeirdnessMetric is a metric with fields created to track the number
 	// of weird occurrences such as time fallback, partial_result, vsyscall
 	// count, watchdog startup timeouts and stuck tasks.
@@ -106,7 +171,7 @@ type Uint64Metric struct {
 
 var (
 	// initialized indicates that all metrics are registered. allMetrics is
-	// immutable once initialized is true.
+	// immutable once initialized is true. It is protected by registrationMu.
 	initialized bool
 
 	// allMetrics are the registered metrics.
@@ -119,25 +184,23 @@ var (
 //  * All metrics are registered.
 //  * Initialize/Disable has not been called.
 func Initialize() error {
+	if err := lockRegistration("initialize metrics"); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
 	if initialized {
-		return errors.New("metric.Initialize called after metric.Initialize or metric.Disable")
+		return fmt.Errorf("%w: metric.Initialize called after metric.Initialize or metric.Disable", ErrAlreadyInitialized)
 	}
 
-	m := pb.MetricRegistration{}
-	for _, v := range allMetrics.uint64Metrics {
-		m.Metrics = append(m.Metrics, v.metadata)
-	}
-	for _, v := range allMetrics.distributionMetrics {
-		m.Metrics = append(m.Metrics, v.metadata)
-	}
-	m.Stages = make([]string, 0, len(allStages))
-	for _, s := range allStages {
-		m.Stages = append(m.Stages, string(s))
-	}
-	if err := eventchannel.Emit(&m); err != nil {
+	m := allMetrics.registration()
+	if err := eventchannel.Emit(m); err != nil {
 		return fmt.Errorf("unable to emit metric initialize event: %w", err)
 	}
 
+	allMetrics.registrationIndex = make(map[string]uint32, len(m.Metrics))
+	for i, md := range m.Metrics {
+		allMetrics.registrationIndex[md.GetName()] = uint32(i)
+	}
 	initialized = true
 	return nil
 }
@@ -149,8 +212,12 @@ func Initialize() error {
 //  * All metrics are registered.
 //  * Initialize/Disable has not been called.
 func Disable() error {
+	if err := lockRegistration("disable metrics"); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
 	if initialized {
-		return errors.New("metric.Disable called after metric.Initialize or metric.Disable")
+		return fmt.Errorf("%w: metric.Disable called after metric.Initialize or metric.Disable", ErrAlreadyInitialized)
 	}
 
 	m := pb.MetricRegistration{}
@@ -162,13 +229,264 @@ func Disable() error {
 	return nil
 }
 
+// ReemitRegistration sends the current metric registration over the event
+// channel again, e.g. after metric metadata was changed following a restore.
+//
+// Metric metadata is not saved across save/restore. Restoring in a new process
+// re-registers all metrics at init time, and Initialize then sends their
+// metadata as usual. However, if the same process is reused after a restore,
+// metadata changes (e.g. through ChangeDescription) are only visible to
+// consumers once ReemitRegistration is called.
+//
+// Consumers must treat a new MetricRegistration as replacing the previous one.
+// Accordingly, the next MetricUpdate is relative to an empty state, as the
+// first MetricUpdate following Initialize is.
+//
+// ReemitRegistration is thread-safe and strongly ordered with
+// EmitMetricUpdate.
+//
+// Preconditions:
+// * Initialize has been called.
+func ReemitRegistration() error {
+	emitMu.Lock()
+	defer emitMu.Unlock()
+
+	if err := eventchannel.Emit(allMetrics.registration()); err != nil {
+		return fmt.Errorf("unable to emit metric registration event: %w", err)
+	}
+	metricsAtLastEmit = metricValues{}
+	return nil
+}
+
+// ChangeDescription changes the description of the metric with the given
+// name. The new description is sent to consumers in the next
+// ReemitRegistration. Registration hooks (see RegisterOnRegistration) are
+// called again with the new metadata.
+//
+// ChangeDescription is thread-safe.
+func ChangeDescription(name, description string) error {
+	if err := lockRegistration(fmt.Sprintf("change the description of %q", name)); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+	metadata, err := replaceDescription(name, description)
+	if err != nil {
+		return err
+	}
+	notifyRegistration(name, metadata)
+	return nil
+}
+
+// replaceDescription replaces the metadata of the metric with the given name
+// with a copy that has the given description, and returns it.
+//
+// Preconditions:
+// * registrationMu is locked.
+func replaceDescription(name, description string) (*pb.MetricMetadata, error) {
+	allMetrics.metadataMu.Lock()
+	defer allMetrics.metadataMu.Unlock()
+
+	// Metadata protos are shared with previously-taken snapshots, so they are
+	// replaced rather than modified.
+	if m, ok := allMetrics.uint64Metrics[name]; ok {
+		m.metadata = proto.Clone(m.metadata).(*pb.MetricMetadata)
+		m.metadata.Description = description
+		allMetrics.uint64Metrics[name] = m
+		return m.metadata, nil
+	}
+	if m, ok := allMetrics.distributionMetrics[name]; ok {
+		metadata := proto.Clone(m.metadata).(*pb.MetricMetadata)
+		metadata.Description = description
+		m.metadata = metadata
+		return metadata, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrMetricNotFound, name)
+}
+
+// IsCumulative returns whether the metric with the given name is cumulative,
+// i.e. a counter rather than a gauge, or a distribution whose buckets never
+// decrease other than by Reset.
+//
+// IsCumulative is thread-safe, and may be called concurrently with
+// registration.
+func IsCumulative(name string) (bool, error) {
+	allMetrics.metadataMu.RLock()
+	defer allMetrics.metadataMu.RUnlock()
+
+	if m, ok := allMetrics.uint64Metrics[name]; ok {
+		return m.metadata.GetCumulative(), nil
+	}
+	if m, ok := allMetrics.distributionMetrics[name]; ok {
+		return m.metadata.GetCumulative(), nil
+	}
+	return false, fmt.Errorf("%w: %q", ErrMetricNotFound, name)
+}
+
+// SetSubsystem sets the subsystem that owns the given metrics, which is
+// carried in their metadata for consumers to group metrics by.
+//
+// SetSubsystem must be called after the metrics are registered, and before
+// Initialize.
+func SetSubsystem(subsystem string, names ...string) error {
+	return setMetadata(names, func(md *pb.MetricMetadata) {
+		md.Subsystem = subsystem
+	})
+}
+
+// SetFullValue marks the given metrics as always emitted with their full
+// value by EmitMetricUpdate, rather than with the delta since the last update.
+// Such metrics are included in every MetricUpdate, even if they did not
+// change, which trades bandwidth for consumers not having to track previous
+// values.
+//
+// SetFullValue must be called after the metrics are registered, and before
+// Initialize.
+func SetFullValue(names ...string) error {
+	return setMetadata(names, func(md *pb.MetricMetadata) {
+		md.FullValue = true
+	})
+}
+
+// SetTrimZeroBuckets makes MetricUpdates omit the trailing buckets without
+// samples of the given distribution metrics, which consumers reconstruct by
+// zero-filling. This reduces the size of updates of distributions whose
+// highest buckets are usually empty, like latency distributions.
+//
+// SetTrimZeroBuckets must be called after the metrics are registered, and
+// before Initialize.
+func SetTrimZeroBuckets(names ...string) error {
+	return setMetadata(names, func(md *pb.MetricMetadata) {
+		md.TrimZeroBuckets = true
+	})
+}
+
+// setMetadata calls set on the metadata of each of the given metrics.
+//
+// Preconditions:
+// * Initialize has not been called.
+func setMetadata(names []string, set func(*pb.MetricMetadata)) error {
+	if err := lockRegistration("set metric metadata"); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return ErrInitializationDone
+	}
+	allMetrics.metadataMu.Lock()
+	defer allMetrics.metadataMu.Unlock()
+	for _, name := range names {
+		if m, ok := allMetrics.uint64Metrics[name]; ok {
+			set(m.metadata)
+			continue
+		}
+		if m, ok := allMetrics.distributionMetrics[name]; ok {
+			set(m.metadata)
+			continue
+		}
+		return fmt.Errorf("%w: %q", ErrMetricNotFound, name)
+	}
+	return nil
+}
+
+// RegisterAlias registers aliasName as another name for the metric named
+// existingName, e.g. to report a renamed metric under both its old and new
+// names during a migration. The alias appears as a separate metric in the
+// registration, in metric updates and in snapshots, with the same metadata
+// and values as the existing metric.
+//
+// The alias copies the metadata of the existing metric at the time of the
+// call, so metadata changes must be made to each name separately. Aliases
+// double the emit traffic of the metric, and are intended to be temporary.
+//
+// Preconditions:
+// * Initialize has not been called.
+func RegisterAlias(existingName, aliasName string) error {
+	if err := lockRegistration(fmt.Sprintf("register %q", aliasName)); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return ErrInitializationDone
+	}
+	if err := allMetrics.checkName(aliasName); err != nil {
+		return err
+	}
+	var metadata *pb.MetricMetadata
+	if m, ok := allMetrics.uint64Metrics[existingName]; ok {
+		m.metadata = proto.Clone(m.metadata).(*pb.MetricMetadata)
+		m.metadata.Name = aliasName
+		allMetrics.addUint64Metric(aliasName, m)
+		metadata = m.metadata
+	} else if m, ok := allMetrics.distributionMetrics[existingName]; ok {
+		// The copy shares the samples of the existing metric.
+		alias := *m
+		alias.metadata = proto.Clone(m.metadata).(*pb.MetricMetadata)
+		alias.metadata.Name = aliasName
+		allMetrics.addDistributionMetric(aliasName, &alias)
+		metadata = alias.metadata
+	} else {
+		return fmt.Errorf("%w: %q", ErrMetricNotFound, existingName)
+	}
+	notifyRegistration(aliasName, metadata)
+	return nil
+}
+
 type customUint64Metric struct {
-	// metadata describes the metric. It is immutable.
+	// metadata describes the metric. It is immutable, but may be replaced
+	// by ChangeDescription; see metricSet.metadataMu.
 	metadata *pb.MetricMetadata
 
 	// value returns the current value of the metric for the given set of
 	// fields. It takes a variadic number of field values as argument.
 	value func(fieldValues ...string) uint64
+
+	// fieldValues, if not nil, returns the current value of the metric for
+	// every field value that may be non-zero. It is used instead of calling
+	// value for every allowed field value, for metrics with a single field
+	// that has many allowed values.
+	fieldValues func() map[string]uint64
+
+	// panicked is set to 1 the first time the value functions of the metric
+	// panic. It is shared by all copies of the metric, and accessed
+	// atomically.
+	panicked *uint32
+}
+
+// current returns the current value of m, as stored in
+// metricValues.uint64Metrics. If the value functions of m panic, current
+// returns false, so that a single faulty metric can't prevent all other
+// metrics from being read and emitted. Only the first panic of each metric is
+// logged as a warning and counted in droppedSamples, as a faulty metric
+// usually panics in every snapshot.
+func (m customUint64Metric) current() (val interface{}, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if atomic.CompareAndSwapUint32(m.panicked, 0, 1) {
+				log.Warningf("Value function of metric %s panicked, omitting it: %v", m.metadata.GetName(), r)
+				droppedSamples.Increment(dropValuePanic)
+			} else {
+				log.Debugf("Value function of metric %s panicked, omitting it: %v", m.metadata.GetName(), r)
+			}
+			val, ok = nil, false
+		}
+	}()
+	fields := m.metadata.GetFields()
+	switch len(fields) {
+	case 0:
+		return m.value(), true
+	case 1:
+		if m.fieldValues != nil {
+			return m.fieldValues(), true
+		}
+		values := fields[0].GetAllowedValues()
+		fieldsMap := make(map[string]uint64)
+		for _, fieldValue := range values {
+			fieldsMap[fieldValue] = m.value(fieldValue)
+		}
+		return fieldsMap, true
+	default:
+		panic(fmt.Sprintf("Unsupported number of metric fields: %d", len(fields)))
+	}
 }
 
 // Field contains the field name and allowed values for the metric which is
@@ -179,6 +497,19 @@ type Field struct {
 
 	// allowedValues is the list of allowed values for the field.
 	allowedValues []string
+
+	// valueDescriptions maps allowed values to their human-readable
+	// description. It may be nil, and need not describe all values.
+	valueDescriptions map[string]string
+
+	// valid, if not nil, reports whether a value is allowed for dynamic
+	// fields, whose values are not enumerated in allowedValues. Dynamic fields
+	// can only be used with DynamicUint64Metric.
+	valid func(string) bool
+
+	// pattern is the regular expression that values of dynamic fields
+	// created with NewFieldMatching match.
+	pattern string
 }
 
 // NewField defines a new Field that can be used to break down a metric.
@@ -189,22 +520,48 @@ func NewField(name string, allowedValues []string) Field {
 	}
 }
 
+// NewFieldWithDescriptions is like NewField, but also attaches a
+// human-readable description to some or all of the allowed values. It panics
+// if valueDescriptions describes values that are not allowed.
+func NewFieldWithDescriptions(name string, allowedValues []string, valueDescriptions map[string]string) Field {
+	allowed := make(map[string]struct{}, len(allowedValues))
+	for _, v := range allowedValues {
+		allowed[v] = struct{}{}
+	}
+	for v := range valueDescriptions {
+		if _, ok := allowed[v]; !ok {
+			panic(fmt.Sprintf("description for value %q which is not allowed for field %q", v, name))
+		}
+	}
+	return Field{
+		name:              name,
+		allowedValues:     allowedValues,
+		valueDescriptions: valueDescriptions,
+	}
+}
+
 // toProto returns the proto definition of this field, for use in metric
 // metadata.
 func (f Field) toProto() *pb.MetricMetadata_Field {
 	return &pb.MetricMetadata_Field{
-		FieldName:     f.name,
-		AllowedValues: f.allowedValues,
+		FieldName:         f.name,
+		AllowedValues:     f.allowedValues,
+		ValueDescriptions: f.valueDescriptions,
+		ValuePattern:      f.pattern,
 	}
 }
 
 // multiFieldToKey returns a concatenated version of the given fields.
 // It can be used as a unique key within multi-dimensional metrics.
-// Does not allow commas as valid character within field values.
+// Does not allow commas as valid character within field values, nor a single
+// empty field value, so that keyToMultiField is its exact inverse.
 func multiFieldToKey(fields ...string) (string, error) {
 	if len(fields) == 0 {
 		return "", nil
 	}
+	if len(fields) == 1 && fields[0] == "" {
+		return "", ErrEmptyFieldValue
+	}
 	for _, f := range fields {
 		if strings.ContainsRune(f, ',') {
 			return "", ErrFieldValueContainsIllegalChar
@@ -240,6 +597,16 @@ type fieldMapper struct {
 
 // newFieldMapper returns a new fieldMapper for the given set of fields.
 func newFieldMapper(fields ...Field) (fieldMapper, error) {
+	if err := checkEnumeratedFields(fields); err != nil {
+		return fieldMapper{}, err
+	}
+	names := make(map[string]struct{}, len(fields))
+	for _, f := range fields {
+		if _, ok := names[f.name]; ok {
+			return fieldMapper{}, fmt.Errorf("%w: %q", ErrDuplicateField, f.name)
+		}
+		names[f.name] = struct{}{}
+	}
 	var initFieldMapper func(values []string, remaining ...Field) (fieldMapper, error)
 	initFieldMapper = func(values []string, remaining ...Field) (fieldMapper, error) {
 		depth := len(remaining)
@@ -344,37 +711,119 @@ func (m fieldMapper) all() []string {
 // * Initialize/Disable have not been called.
 // * value is expected to accept exactly len(fields) arguments.
 func RegisterCustomUint64Metric(name string, cumulative, sync bool, units pb.MetricMetadata_Units, description string, value func(...string) uint64, fields ...Field) error {
-	if initialized {
-		return ErrInitializationDone
+	if err := checkEnumeratedFields(fields); err != nil {
+		return err
 	}
+	return registerUint64Metric(name, cumulative, sync, units, description, value, nil /* fieldValues */, fields...)
+}
 
-	if _, ok := allMetrics.uint64Metrics[name]; ok {
-		return ErrNameInUse
+// RegisterCustomUint64MapMetric registers a metric with the given name and a
+// single field, like RegisterCustomUint64Metric. Instead of computing the
+// value for each allowed field value separately, values returns the values
+// for all of them at once, so that metrics backed by a single expensive
+// computation only perform it once per snapshot. Allowed field values missing
+// from the returned map have the value 0, and values for other field values
+// are dropped. Each distinct field value that isn't allowed is counted once in
+// /metric/dropped_samples, however many snapshots drop its value.
+//
+// Preconditions are the same as RegisterCustomUint64Metric.
+func RegisterCustomUint64MapMetric(name string, cumulative, sync bool, units pb.MetricMetadata_Units, description string, values func() map[string]uint64, field Field) error {
+	if err := checkEnumeratedFields([]Field{field}); err != nil {
+		return err
+	}
+	value := func(fieldValues ...string) uint64 {
+		return values()[fieldValues[0]]
+	}
+	var invalid invalidFieldValues
+	fieldValues := func() map[string]uint64 {
+		got := values()
+		valid := make(map[string]uint64, len(field.allowedValues))
+		for _, fieldValue := range field.allowedValues {
+			valid[fieldValue] = got[fieldValue]
+		}
+		for fieldValue := range got {
+			if _, ok := valid[fieldValue]; ok {
+				continue
+			}
+			invalid.drop(fieldValue)
+		}
+		return valid
 	}
-	if _, ok := allMetrics.distributionMetrics[name]; ok {
-		return ErrNameInUse
+	return registerUint64Metric(name, cumulative, sync, units, description, value, fieldValues, field)
+}
+
+// invalidFieldValues records the field values that are not allowed but were
+// returned by the callback of a RegisterCustomUint64MapMetric metric, so that
+// each is only counted once in /metric/dropped_samples.
+type invalidFieldValues struct {
+	// mu protects seen, as snapshots may be taken concurrently.
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// drop records that the value for fieldValue was dropped.
+func (v *invalidFieldValues) drop(fieldValue string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.seen[fieldValue]; ok {
+		return
+	}
+	if v.seen == nil {
+		v.seen = make(map[string]struct{})
 	}
+	v.seen[fieldValue] = struct{}{}
+	droppedSamples.Increment(dropInvalidFieldValue)
+}
 
-	allMetrics.uint64Metrics[name] = customUint64Metric{
-		metadata: &pb.MetricMetadata{
-			Name:        name,
-			Description: description,
-			Cumulative:  cumulative,
-			Sync:        sync,
-			Type:        pb.MetricMetadata_TYPE_UINT64,
-			Units:       units,
-		},
-		value: value,
+// registerUint64Metric registers a uint64 metric with the given name. See
+// customUint64Metric for value and fieldValues. Unlike
+// RegisterCustomUint64Metric, it accepts dynamic fields.
+func registerUint64Metric(name string, cumulative, sync bool, units pb.MetricMetadata_Units, description string, value func(...string) uint64, fieldValues func() map[string]uint64, fields ...Field) error {
+	if err := lockRegistration(fmt.Sprintf("register %q", name)); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return ErrInitializationDone
 	}
+	return registerUint64MetricLocked(name, cumulative, sync, units, description, value, fieldValues, fields...)
+}
 
+// registerUint64MetricLocked implements registerUint64Metric.
+//
+// Preconditions:
+// * registrationMu is locked.
+// * Initialize/Disable have not been called.
+func registerUint64MetricLocked(name string, cumulative, sync bool, units pb.MetricMetadata_Units, description string, value func(...string) uint64, fieldValues func() map[string]uint64, fields ...Field) error {
+	if err := allMetrics.checkName(name); err != nil {
+		return err
+	}
+	if err := validateUnits(units, nil); err != nil {
+		return err
+	}
 	// Metrics can exist without fields.
 	if l := len(fields); l > 1 {
-		return fmt.Errorf("%d fields provided, must be <= 1", l)
+		return fmt.Errorf("%w: %d fields provided, must be <= 1", ErrTooManyFields, l)
 	}
 
-	for _, field := range fields {
-		allMetrics.uint64Metrics[name].metadata.Fields = append(allMetrics.uint64Metrics[name].metadata.Fields, field.toProto())
+	metadata := &pb.MetricMetadata{
+		Name:        name,
+		Description: description,
+		Cumulative:  cumulative,
+		Sync:        sync,
+		Type:        pb.MetricMetadata_TYPE_UINT64,
+		Units:       units,
 	}
+	for _, field := range fields {
+		metadata.Fields = append(metadata.Fields, field.toProto())
+	}
+	allMetrics.addUint64Metric(name, customUint64Metric{
+		metadata:    metadata,
+		value:       value,
+		fieldValues: fieldValues,
+		panicked:    new(uint32),
+	})
+	notifyRegistration(name, metadata)
 	return nil
 }
 
@@ -386,11 +835,29 @@ func MustRegisterCustomUint64Metric(name string, cumulative, sync bool, descript
 	}
 }
 
+// MustRegisterGaugeFunc registers a non-cumulative metric whose value is
+// computed on demand by calling value, e.g. the current heap size. It panics
+// if registration fails.
+//
+// Unlike cumulative metrics, the value returned may decrease over time. Like
+// all uint64 metrics, it is emitted as an absolute value whenever it changes,
+// so decreases are reported as-is.
+func MustRegisterGaugeFunc(name, description string, value func(...string) uint64, fields ...Field) {
+	MustRegisterCustomUint64Metric(name, false /* cumulative */, false /* sync */, description, value, fields...)
+}
+
 // NewUint64Metric creates and registers a new cumulative metric with the given
 // name.
 //
 // Metrics must be statically defined (i.e., at init).
 func NewUint64Metric(name string, sync bool, units pb.MetricMetadata_Units, description string, fields ...Field) (*Uint64Metric, error) {
+	m := newUint64Metric(fields...)
+	return m, RegisterCustomUint64Metric(name, true /* cumulative */, sync, units, description, m.Value, fields...)
+}
+
+// newUint64Metric returns a new Uint64Metric with the given fields, without
+// registering it.
+func newUint64Metric(fields ...Field) *Uint64Metric {
 	m := Uint64Metric{
 		numFields: len(fields),
 	}
@@ -401,7 +868,7 @@ func NewUint64Metric(name string, sync bool, units pb.MetricMetadata_Units, desc
 			m.fields[fieldValue] = 0
 		}
 	}
-	return &m, RegisterCustomUint64Metric(name, true /* cumulative */, sync, units, description, m.Value, fields...)
+	return &m
 }
 
 // MustCreateNewUint64Metric calls NewUint64Metric and panics if it returns an
@@ -476,6 +943,43 @@ func (m *Uint64Metric) IncrementBy(v uint64, fieldValues ...string) {
 	}
 }
 
+// IncrementMulti increments the metric by v for each of the given sets of
+// field values, e.g. for an event that falls into several categories. A set
+// of field values may be repeated, in which case it is incremented once per
+// occurrence.
+//
+// All field values are validated before any increment. The increments are
+// made under a single lock acquisition, which is cheaper than calling
+// Increment repeatedly. This is best-effort atomicity only: snapshots read
+// field values one at a time, and may observe some of the increments but not
+// others, unless IncrementMulti is called within UpdateGroup.Update.
+func (m *Uint64Metric) IncrementMulti(v uint64, fieldValueSets ...[]string) {
+	for _, fieldValues := range fieldValueSets {
+		if m.numFields != len(fieldValues) {
+			panic(fmt.Sprintf("Number of fieldValues %d is not equal to the number of metric fields %d", len(fieldValues), m.numFields))
+		}
+	}
+
+	switch m.numFields {
+	case 0:
+		atomic.AddUint64(&m.value, v*uint64(len(fieldValueSets)))
+	case 1:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		for _, fieldValues := range fieldValueSets {
+			if _, ok := m.fields[fieldValues[0]]; !ok {
+				panic(fmt.Sprintf("Metric does not allow to have field value %s", fieldValues[0]))
+			}
+		}
+		for _, fieldValues := range fieldValueSets {
+			m.fields[fieldValues[0]] += v
+		}
+	default:
+		panic("Sentry metrics do not support more than one field")
+	}
+}
+
 // Bucketer is an interface to bucket values into finite, distinct buckets.
 type Bucketer interface {
 	// NumFiniteBuckets is the number of finite buckets in the distribution.
@@ -524,15 +1028,20 @@ type ExponentialBucketer struct {
 	// Bucket sizes are floored, so `width` and `growth` must be large enough
 	// such that the second bucket is actually wider than the first after
 	// flooring (unless, of course, fixed-width buckets are what's desired).
+	// growth is at least 1; a growth of 1 makes the exponential portion
+	// constant, so that all finite buckets but the first have the same width.
 	growth float64
 
-	// growthLog is math.Log(growth).
-	growthLog float64
-
 	// maxSample is the max sample value which can be represented in a finite
 	// bucket.
 	maxSample int64
 
+	// durations is true if this bucketer is meant to bucket durations in
+	// nanoseconds, i.e. it was created by NewDurationBucketer, or for a
+	// TimerMetric or a distribution with nanosecond units by
+	// NewAutoDistributionMetric.
+	durations bool
+
 	// lowerbounds is a precomputed set of lower bounds of the buckets.
 	// The "underflow" bucket has no lower bound, so it is not included here.
 	// lowerBounds[0] is the lower bound of the first finite bucket, which is
@@ -541,6 +1050,15 @@ type ExponentialBucketer struct {
 	lowerBounds []int64
 }
 
+// safeLowerBound returns b.LowerBound(bucketIndex), or false if bucketIndex is
+// out of range.
+func safeLowerBound(b Bucketer, bucketIndex int) (int64, bool) {
+	if bucketIndex < 0 || bucketIndex > b.NumFiniteBuckets() {
+		return 0, false
+	}
+	return b.LowerBound(bucketIndex), true
+}
+
 // Minimum/maximum finite buckets for exponential bucketers.
 const (
 	exponentialMinBuckets = 1
@@ -548,26 +1066,62 @@ const (
 )
 
 // NewExponentialBucketer returns a new Bucketer with exponential buckets.
+// growth must be at least 1, as buckets would otherwise shrink, and their
+// bounds might not be increasing. A growth of 1 results in linear buckets.
 func NewExponentialBucketer(numFiniteBuckets int, width uint64, scale, growth float64) *ExponentialBucketer {
 	if numFiniteBuckets < exponentialMinBuckets || numFiniteBuckets > exponentialMaxBuckets {
 		panic(fmt.Sprintf("number of finite buckets must be in [%d, %d]", exponentialMinBuckets, exponentialMaxBuckets))
 	}
+	if !(growth >= 1) {
+		panic(fmt.Sprintf("growth must be at least 1, got %v", growth))
+	}
 	b := &ExponentialBucketer{
 		numFiniteBuckets: numFiniteBuckets,
 		width:            float64(width),
 		scale:            scale,
 		growth:           growth,
-		growthLog:        math.Log(growth),
 		lowerBounds:      make([]int64, numFiniteBuckets+1),
 	}
 	b.lowerBounds[0] = 0
 	for i := 1; i <= numFiniteBuckets; i++ {
-		b.lowerBounds[i] = int64(b.width*float64(i) + b.scale*math.Pow(b.growth, float64(i-1)))
+		lowerBound := b.width*float64(i) + b.scale*math.Pow(b.growth, float64(i-1))
+		// Converting an out-of-range float to int64 does not saturate, and
+		// would make lower bounds (and maxSample) wrap around. Saturate
+		// explicitly instead; the resulting buckets are empty.
+		if lowerBound >= math.MaxInt64 {
+			b.lowerBounds[i] = math.MaxInt64
+		} else {
+			b.lowerBounds[i] = int64(lowerBound)
+		}
 	}
 	b.maxSample = b.lowerBounds[numFiniteBuckets] - 1
 	return b
 }
 
+// newRangeBucketer returns an ExponentialBucketer with numFiniteBuckets finite
+// buckets, whose first finite bucket is [0, min) and whose other finite
+// buckets grow geometrically up to the overflow bucket, starting at max.
+func newRangeBucketer(numFiniteBuckets int, min, max int64) (*ExponentialBucketer, error) {
+	if numFiniteBuckets < 2 || numFiniteBuckets > exponentialMaxBuckets {
+		return nil, fmt.Errorf("%w: number of buckets must be in [2, %d], got %d", ErrInvalidArgument, exponentialMaxBuckets, numFiniteBuckets)
+	}
+	if min <= 0 || max <= min {
+		return nil, fmt.Errorf("%w: expected sample range must satisfy 0 < min < max, got [%d, %d]", ErrInvalidArgument, min, max)
+	}
+	// Bucket i >= 1 starts at min * growth^(i-1).
+	growth := math.Pow(float64(max)/float64(min), 1/float64(numFiniteBuckets-1))
+	if float64(min)*(growth-1) < 1 {
+		// Bucket bounds are floored, so buckets narrower than 1 would be
+		// empty.
+		return nil, fmt.Errorf("%w: expected sample range [%d, %d] is too narrow for %d buckets", ErrInvalidArgument, min, max, numFiniteBuckets)
+	}
+	b := NewExponentialBucketer(numFiniteBuckets, 0 /* width */, float64(min), growth)
+	// Don't let rounding errors move the overflow bucket.
+	b.lowerBounds[numFiniteBuckets] = max
+	b.maxSample = max - 1
+	return b, nil
+}
+
 // NumFiniteBuckets implements Bucketer.NumFiniteBuckets.
 func (b *ExponentialBucketer) NumFiniteBuckets() int {
 	return int(b.numFiniteBuckets)
@@ -578,6 +1132,12 @@ func (b *ExponentialBucketer) LowerBound(bucketIndex int) int64 {
 	return b.lowerBounds[bucketIndex]
 }
 
+// SafeLowerBound is like LowerBound, but returns false rather than panicking
+// if bucketIndex is not within [0, NumFiniteBuckets()].
+func (b *ExponentialBucketer) SafeLowerBound(bucketIndex int) (int64, bool) {
+	return safeLowerBound(b, bucketIndex)
+}
+
 // BucketIndex implements Bucketer.BucketIndex.
 // +checkescape:all
 //go:nosplit
@@ -612,20 +1172,164 @@ func (b *ExponentialBucketer) BucketIndex(sample int64) int {
 	}
 }
 
+// ExplicitBucketer implements Bucketer, with buckets whose bounds are
+// explicitly given. As with ExponentialBucketer, the first finite bucket
+// starts at 0, and negative samples fall in the underflow bucket.
+type ExplicitBucketer struct {
+	// lowerBounds contains the lower bound of all finite buckets, followed by
+	// the lower bound of the overflow bucket. It is strictly increasing and
+	// lowerBounds[0] is 0.
+	lowerBounds []int64
+
+	// durations is true if this bucketer is meant to bucket durations in
+	// nanoseconds, i.e. it is used by a TimerMetric.
+	durations bool
+}
+
+// NewExplicitBucketer returns a new Bucketer with the given bucket bounds.
+// bounds contains the upper bound of each finite bucket, which is also the
+// lower bound of the next bucket; the last bound is the lower bound of the
+// overflow bucket. For example, bounds {10, 100} define the finite buckets
+// [0, 10) and [10, 100), and the overflow bucket [100, +inf).
+//
+// bounds must be strictly increasing and positive, so that no bucket is
+// empty.
+func NewExplicitBucketer(bounds []int64) (*ExplicitBucketer, error) {
+	if len(bounds) == 0 {
+		return nil, fmt.Errorf("%w: explicit bucketer must have at least one bound", ErrInvalidBucketer)
+	}
+	if bounds[0] <= 0 {
+		return nil, fmt.Errorf("%w: bound 0 (%d) must be positive, as the first bucket starts at 0", ErrInvalidBucketer, bounds[0])
+	}
+	for i := 1; i < len(bounds); i++ {
+		switch {
+		case bounds[i] == bounds[i-1]:
+			return nil, fmt.Errorf("%w: bound %d (%d) duplicates bound %d, which would create an empty bucket", ErrNonMonotonicBounds, i, bounds[i], i-1)
+		case bounds[i] < bounds[i-1]:
+			return nil, fmt.Errorf("%w: bound %d (%d) is lower than bound %d (%d), bounds must be sorted in increasing order", ErrNonMonotonicBounds, i, bounds[i], i-1, bounds[i-1])
+		}
+	}
+	b := &ExplicitBucketer{
+		lowerBounds: make([]int64, len(bounds)+1),
+	}
+	copy(b.lowerBounds[1:], bounds)
+	return b, nil
+}
+
+// NumFiniteBuckets implements Bucketer.NumFiniteBuckets.
+func (b *ExplicitBucketer) NumFiniteBuckets() int {
+	return len(b.lowerBounds) - 1
+}
+
+// LowerBound implements Bucketer.LowerBound.
+func (b *ExplicitBucketer) LowerBound(bucketIndex int) int64 {
+	return b.lowerBounds[bucketIndex]
+}
+
+// SafeLowerBound is like LowerBound, but returns false rather than panicking
+// if bucketIndex is not within [0, NumFiniteBuckets()].
+func (b *ExplicitBucketer) SafeLowerBound(bucketIndex int) (int64, bool) {
+	return safeLowerBound(b, bucketIndex)
+}
+
+// BucketIndex implements Bucketer.BucketIndex.
+// +checkescape:all
+//go:nosplit
+func (b *ExplicitBucketer) BucketIndex(sample int64) int {
+	if sample < 0 {
+		return -1
+	}
+	numFiniteBuckets := len(b.lowerBounds) - 1
+	if sample >= b.lowerBounds[numFiniteBuckets] {
+		return numFiniteBuckets
+	}
+	// Binary search for the last lower bound <= sample. As in
+	// ExponentialBucketer.BucketIndex, we can't use sort.Search.
+	lowIndex := 0
+	highIndex := numFiniteBuckets
+	for highIndex-lowIndex > 1 {
+		pivotIndex := (highIndex + lowIndex) >> 1
+		if sample < b.lowerBounds[pivotIndex] {
+			highIndex = pivotIndex
+		} else {
+			lowIndex = pivotIndex
+		}
+	}
+	return lowIndex
+}
+
 // Verify that ExponentialBucketer implements Bucketer.
 var _ = (Bucketer)((*ExponentialBucketer)(nil))
 
+// validateUnits checks that units is a known unit, and that it is consistent
+// with what the metric measures. bucketer is the bucketer of distribution
+// metrics, and nil for other metric types.
+//
+// Distributions of durations must have nanosecond units, and only
+// distributions of durations may have them. Uint64 metrics may have
+// nanosecond units, e.g. for the total time spent in an operation.
+func validateUnits(units pb.MetricMetadata_Units, bucketer Bucketer) error {
+	if _, ok := pb.MetricMetadata_Units_name[int32(units)]; !ok {
+		return fmt.Errorf("%w: unknown units %d", ErrInvalidUnits, units)
+	}
+	if bucketer == nil {
+		return nil
+	}
+	durations := isDurationBucketer(bucketer)
+	if durations && units != pb.MetricMetadata_UNITS_NANOSECONDS {
+		return fmt.Errorf("%w: duration bucketer requires units %v, got %v", ErrInvalidUnits, pb.MetricMetadata_UNITS_NANOSECONDS, units)
+	}
+	if !durations && units == pb.MetricMetadata_UNITS_NANOSECONDS {
+		return fmt.Errorf("%w: units %v require a duration bucketer (see NewDurationBucketer) or a TimerMetric", ErrInvalidUnits, units)
+	}
+	return nil
+}
+
+// isDurationBucketer returns whether b is meant to bucket durations in
+// nanoseconds.
+func isDurationBucketer(b Bucketer) bool {
+	switch b := b.(type) {
+	case *ExponentialBucketer:
+		return b.durations
+	case *ExplicitBucketer:
+		return b.durations
+	default:
+		return false
+	}
+}
+
+// durationBucketer returns a copy of b that is meant to bucket durations in
+// nanoseconds. Bucketers of unsupported types are returned as-is, to be
+// rejected at registration.
+func durationBucketer(b Bucketer) Bucketer {
+	switch b := b.(type) {
+	case *ExponentialBucketer:
+		// The copy shares the immutable lower bounds of b.
+		durations := *b
+		durations.durations = true
+		return &durations
+	case *ExplicitBucketer:
+		durations := *b
+		durations.durations = true
+		return &durations
+	default:
+		return b
+	}
+}
+
 // DistributionMetric represents a distribution of values in finite buckets.
 // It also separately keeps track of min/max in order to ascertain whether the
 // buckets can faithfully represent the range of values encountered in the
 // distribution.
 type DistributionMetric struct {
-	// exponentialBucketer is the bucketing scheme used for this metric.
+	// exponentialBucketer or explicitBucketer is the bucketing scheme used for
+	// this metric; exactly one of them is non-nil.
 	// Because we need DistributionMetric.AddSample to be go:nosplit-compatible,
 	// we cannot use an interface reference here, as we would not be able to call
 	// it in AddSample. Instead, we need one field per Bucketer implementation,
 	// and we call whichever one is in use in AddSample.
 	exponentialBucketer *ExponentialBucketer
+	explicitBucketer    *ExplicitBucketer
 
 	// metadata is the metadata about this metric.
 	metadata *pb.MetricMetadata
@@ -644,25 +1348,84 @@ type DistributionMetric struct {
 	// The last value is the number of samples that fell into the bucketer's
 	// last (i.e. infinite) bucket.
 	samples map[string][]uint64
+
+	// resets is the number of times the distribution was reset. It is
+	// accessed atomically. It is a pointer so that it is shared with copies
+	// of the DistributionMetric, like the one embedded in TimerMetric.
+	resets *uint64
+
+	// fieldResets is the number of times the distribution was reset for each
+	// key of samples with ResetField. Its values are accessed atomically.
+	fieldResets map[string]*uint64
+
+	// outliers records the exact value of the samples exceeding a threshold,
+	// if enabled with RecordOutliers. Otherwise, it is nil. It is set with
+	// registrationMu held before Initialize, and immutable afterwards.
+	outliers *outlierBuffer
 }
 
-// NewDistributionMetric creates and registers a new distribution metric.
+// NewDistributionMetric creates and registers a new cumulative distribution
+// metric, i.e. one whose buckets never decrease other than by Reset. Metric
+// updates contain the number of samples added to each bucket since the last
+// update.
 func NewDistributionMetric(name string, sync bool, bucketer Bucketer, unit pb.MetricMetadata_Units, description string, fields ...Field) (*DistributionMetric, error) {
+	return newDistributionMetric(name, true /* cumulative */, sync, bucketer, unit, description, fields...)
+}
+
+// NewNonCumulativeDistributionMetric creates and registers a new
+// non-cumulative distribution metric, i.e. one whose buckets may decrease,
+// such as a windowed or decaying distribution. Metric updates contain the
+// absolute number of samples in each bucket, with Samples.was_reset set,
+// whenever it changed since the last update.
+func NewNonCumulativeDistributionMetric(name string, sync bool, bucketer Bucketer, unit pb.MetricMetadata_Units, description string, fields ...Field) (*DistributionMetric, error) {
+	return newDistributionMetric(name, false /* cumulative */, sync, bucketer, unit, description, fields...)
+}
+
+// NewAutoDistributionMetric creates and registers a new cumulative
+// distribution metric, like NewDistributionMetric, with an exponential
+// bucketer chosen to cover samples in [minExpected, maxExpected] with
+// targetBuckets finite buckets. Samples below minExpected fall in the first
+// finite bucket, samples at or above maxExpected fall in the overflow bucket.
+// The metric is not sync.
+//
+// minExpected and maxExpected are in the given unit, so the bucketer measures
+// durations if unit is UNITS_NANOSECONDS.
+func NewAutoDistributionMetric(name string, minExpected, maxExpected int64, targetBuckets int, unit pb.MetricMetadata_Units, description string, fields ...Field) (*DistributionMetric, error) {
+	bucketer, err := newRangeBucketer(targetBuckets, minExpected, maxExpected)
+	if err != nil {
+		return nil, err
+	}
+	bucketer.durations = unit == pb.MetricMetadata_UNITS_NANOSECONDS
+	return NewDistributionMetric(name, false /* sync */, bucketer, unit, description, fields...)
+}
+
+// newDistributionMetric creates and registers a new distribution metric.
+func newDistributionMetric(name string, cumulative, sync bool, bucketer Bucketer, unit pb.MetricMetadata_Units, description string, fields ...Field) (*DistributionMetric, error) {
+	if err := lockRegistration(fmt.Sprintf("register %q", name)); err != nil {
+		return nil, err
+	}
+	defer registrationMu.Unlock()
 	if initialized {
 		return nil, ErrInitializationDone
 	}
-	if _, ok := allMetrics.uint64Metrics[name]; ok {
-		return nil, ErrNameInUse
-	}
-	if _, ok := allMetrics.distributionMetrics[name]; ok {
-		return nil, ErrNameInUse
+	if err := allMetrics.checkName(name); err != nil {
+		return nil, err
 	}
 
-	var exponentialBucketer *ExponentialBucketer
-	if expBucketer, ok := bucketer.(*ExponentialBucketer); ok {
-		exponentialBucketer = expBucketer
-	} else {
-		return nil, fmt.Errorf("unsupported bucketer implementation: %T", bucketer)
+	var (
+		exponentialBucketer *ExponentialBucketer
+		explicitBucketer    *ExplicitBucketer
+	)
+	switch b := bucketer.(type) {
+	case *ExponentialBucketer:
+		exponentialBucketer = b
+	case *ExplicitBucketer:
+		explicitBucketer = b
+	default:
+		return nil, fmt.Errorf("%w: unsupported implementation %T", ErrInvalidBucketer, bucketer)
+	}
+	if err := validateUnits(unit, bucketer); err != nil {
+		return nil, err
 	}
 	fieldsToKey, err := newFieldMapper(fields...)
 	if err != nil {
@@ -670,26 +1433,37 @@ func NewDistributionMetric(name string, sync bool, bucketer Bucketer, unit pb.Me
 	}
 	allKeys := fieldsToKey.all()
 	samples := make(map[string][]uint64, len(allKeys))
+	fieldResets := make(map[string]*uint64, len(allKeys))
 	numFiniteBuckets := bucketer.NumFiniteBuckets()
 	for _, key := range allKeys {
 		samples[key] = make([]uint64, numFiniteBuckets+2)
+		fieldResets[key] = new(uint64)
 	}
 	protoFields := make([]*pb.MetricMetadata_Field, len(fields))
 	for i, f := range fields {
 		protoFields[i] = f.toProto()
 	}
-	lowerBounds := make([]int64, numFiniteBuckets+1)
-	for i := 0; i <= numFiniteBuckets; i++ {
-		lowerBounds[i] = bucketer.LowerBound(i)
+	// The lower bounds are precomputed by the bucketer, and shared with all
+	// metrics using it, as they are immutable. The capacity of the slice is
+	// capped so that appending to it never modifies the bucketer.
+	var lowerBounds []int64
+	if exponentialBucketer != nil {
+		lowerBounds = exponentialBucketer.lowerBounds
+	} else {
+		lowerBounds = explicitBucketer.lowerBounds
 	}
-	allMetrics.distributionMetrics[name] = &DistributionMetric{
+	lowerBounds = lowerBounds[: numFiniteBuckets+1 : numFiniteBuckets+1]
+	d := &DistributionMetric{
 		exponentialBucketer: exponentialBucketer,
+		explicitBucketer:    explicitBucketer,
 		fieldsToKey:         fieldsToKey,
 		samples:             samples,
+		resets:              new(uint64),
+		fieldResets:         fieldResets,
 		metadata: &pb.MetricMetadata{
 			Name:                          name,
 			Description:                   description,
-			Cumulative:                    false,
+			Cumulative:                    cumulative,
 			Sync:                          sync,
 			Type:                          pb.MetricMetadata_TYPE_DISTRIBUTION,
 			Units:                         unit,
@@ -697,7 +1471,9 @@ func NewDistributionMetric(name string, sync bool, bucketer Bucketer, unit pb.Me
 			DistributionBucketLowerBounds: lowerBounds,
 		},
 	}
-	return allMetrics.distributionMetrics[name], nil
+	allMetrics.addDistributionMetric(name, d)
+	notifyRegistration(name, d.metadata)
+	return d, nil
 }
 
 // MustRegisterDistributionMetric creates and registers a distribution metric.
@@ -710,8 +1486,18 @@ func MustRegisterDistributionMetric(name string, sync bool, bucketer Bucketer, u
 	return distrib
 }
 
-// AddSample adds a sample to the distribution.
-// This *must* be called with the correct number of fields, or it will panic.
+// MustRegisterNonCumulativeDistributionMetric creates and registers a
+// non-cumulative distribution metric. If an error occurs, it panics.
+func MustRegisterNonCumulativeDistributionMetric(name string, sync bool, bucketer Bucketer, unit pb.MetricMetadata_Units, description string, fields ...Field) *DistributionMetric {
+	distrib, err := NewNonCumulativeDistributionMetric(name, sync, bucketer, unit, description, fields...)
+	if err != nil {
+		panic(err)
+	}
+	return distrib
+}
+
+// AddSample adds a sample to the distribution.
+// This *must* be called with the correct number of fields, or it will panic.
 // +checkescape:all
 //go:nosplit
 func (d *DistributionMetric) AddSample(sample int64, fields ...string) {
@@ -722,8 +1508,114 @@ func (d *DistributionMetric) AddSample(sample int64, fields ...string) {
 // +checkescape:all
 //go:nosplit
 func (d *DistributionMetric) addSampleByKey(sample int64, key string) {
-	bucket := d.exponentialBucketer.BucketIndex(sample)
+	d.addLabeledSampleByKey(sample, key, nil)
+}
+
+// addLabeledSampleByKey works like addSampleByKey, attaching label, if not nil,
+// to the sample if it is recorded as an outlier.
+// +checkescape:all
+//go:nosplit
+func (d *DistributionMetric) addLabeledSampleByKey(sample int64, key string, label *string) {
+	bucket := d.bucketIndex(sample)
 	atomic.AddUint64(&d.samples[key][bucket+1], 1)
+	if o := d.outliers; o != nil && sample > o.threshold {
+		o.record(sample, label)
+	}
+}
+
+// NumBuckets returns the total number of buckets of the distribution,
+// including the underflow and overflow buckets, i.e. the number of finite
+// buckets of its Bucketer plus 2. This is the length of the per-bucket
+// sample counts in snapshots and metric updates.
+func (d *DistributionMetric) NumBuckets() int {
+	if d.exponentialBucketer != nil {
+		return d.exponentialBucketer.NumFiniteBuckets() + 2
+	}
+	return d.explicitBucketer.NumFiniteBuckets() + 2
+}
+
+// Unit returns the unit of the samples of the distribution.
+func (d *DistributionMetric) Unit() pb.MetricMetadata_Units {
+	allMetrics.metadataMu.RLock()
+	defer allMetrics.metadataMu.RUnlock()
+	return d.metadata.GetUnits()
+}
+
+// EstimatedMean returns an estimate of the mean of the samples of the
+// distribution for the given field values, or NaN if it has no samples.
+//
+// The distribution does not track the sum of its samples, so the mean is
+// estimated by assuming that every sample lies at the midpoint of its bucket.
+// The underflow and overflow buckets have no midpoint; samples in them are
+// assumed to be equal to the closest bound, i.e. the lower bound of the first
+// finite bucket and the lower bound of the overflow bucket respectively. The
+// estimate is thus biased towards the bounds of the distribution if it has
+// samples out of the range of its finite buckets.
+func (d *DistributionMetric) EstimatedMean(fields ...string) float64 {
+	samples := snapshotDistribution(d.samples[d.fieldsToKey.lookup(fields...)])
+	allMetrics.metadataMu.RLock()
+	lowerBounds := d.metadata.GetDistributionBucketLowerBounds()
+	allMetrics.metadataMu.RUnlock()
+	var total uint64
+	var sum float64
+	for i, count := range samples {
+		if count == 0 {
+			continue
+		}
+		var value float64
+		switch {
+		case i == 0:
+			value = float64(lowerBounds[0])
+		case i == len(samples)-1:
+			value = float64(lowerBounds[len(lowerBounds)-1])
+		default:
+			value = (float64(lowerBounds[i-1]) + float64(lowerBounds[i])) / 2
+		}
+		total += count
+		sum += float64(count) * value
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	return sum / float64(total)
+}
+
+// bucketIndex returns the index of the bucket that sample falls into, as
+// returned by Bucketer.BucketIndex.
+// +checkescape:all
+//go:nosplit
+func (d *DistributionMetric) bucketIndex(sample int64) int {
+	if d.exponentialBucketer != nil {
+		return d.exponentialBucketer.BucketIndex(sample)
+	}
+	return d.explicitBucketer.BucketIndex(sample)
+}
+
+// Reset clears all samples of the distribution, for all field values.
+//
+// The next MetricUpdate contains the absolute number of samples in each bucket
+// of the distribution, with Samples.reset set, rather than a delta. Samples
+// added concurrently with Reset may or may not be cleared.
+func (d *DistributionMetric) Reset() {
+	for _, samples := range d.samples {
+		for i := range samples {
+			atomic.StoreUint64(&samples[i], 0)
+		}
+	}
+	atomic.AddUint64(d.resets, 1)
+}
+
+// ResetField clears the samples of the distribution for the given field
+// values only, e.g. once they become stale. Like Reset, it makes the next
+// MetricUpdate contain absolute numbers of samples, only for these field
+// values.
+func (d *DistributionMetric) ResetField(fields ...string) {
+	key := d.fieldsToKey.lookup(fields...)
+	samples := d.samples[key]
+	for i := range samples {
+		atomic.StoreUint64(&samples[i], 0)
+	}
+	atomic.AddUint64(d.fieldResets[key], 1)
 }
 
 // Minimum number of buckets for NewDurationBucket.
@@ -741,14 +1633,23 @@ func NewDurationBucketer(numFiniteBuckets int, minDuration, maxDuration time.Dur
 	exponentCoversNs := float64(maxDuration.Nanoseconds()-int64(numFiniteBuckets-durationMinBuckets)*minNs) / float64(minNs)
 	exponent := math.Log(exponentCoversNs) / math.Log(float64(numFiniteBuckets-durationMinBuckets))
 	minNs = int64(float64(minNs) / exponent)
-	return NewExponentialBucketer(numFiniteBuckets, uint64(minNs), float64(minNs), exponent)
+	b := NewExponentialBucketer(numFiniteBuckets, uint64(minNs), float64(minNs), exponent)
+	b.durations = true
+	return b
 }
 
 // TimerMetric wraps a distribution metric with convenience functions for
 // latency measurements, which is a popular specialization of distribution
 // metrics.
 type TimerMetric struct {
-	DistributionMetric
+	// DistributionMetric is the registered distribution metric holding the
+	// samples of the timer.
+	*DistributionMetric
+
+	// inFlight counts the operations in flight, if enabled with
+	// TrackInFlight. Otherwise, it is nil. It is set with registrationMu
+	// held before Initialize, and immutable afterwards.
+	inFlight *inFlightGauge
 }
 
 // NewTimerMetric provides a convenient way to measure latencies.
@@ -757,12 +1658,12 @@ type TimerMetric struct {
 //                   durations in nanoseconds. Adjust parameters accordingly.
 //                   NewDurationBucketer may be helpful here.
 func NewTimerMetric(name string, nanoBucketer Bucketer, description string, fields ...Field) (*TimerMetric, error) {
-	distrib, err := NewDistributionMetric(name, false, nanoBucketer, pb.MetricMetadata_UNITS_NANOSECONDS, description, fields...)
+	distrib, err := NewDistributionMetric(name, false, durationBucketer(nanoBucketer), pb.MetricMetadata_UNITS_NANOSECONDS, description, fields...)
 	if err != nil {
 		return nil, err
 	}
 	return &TimerMetric{
-		DistributionMetric: *distrib,
+		DistributionMetric: distrib,
 	}, nil
 }
 
@@ -779,7 +1680,8 @@ func MustRegisterTimerMetric(name string, nanoBucketer Bucketer, description str
 // TimedOperation is used by TimerMetric to keep track of the time elapsed
 // between an operation starting and stopping.
 type TimedOperation struct {
-	// metric is a reference to the timer metric for the operation.
+	// metric is a reference to the timer metric for the operation. It is nil
+	// once the operation is finished.
 	metric *TimerMetric
 
 	// partialFields is a prefix of the fields used in this operation.
@@ -788,6 +1690,10 @@ type TimedOperation struct {
 
 	// startedNs is the number of nanoseconds measured in TimerMetric.Start().
 	startedNs int64
+
+	// inFlight is the in-flight operation counter incremented by
+	// TimerMetric.Start, if any.
+	inFlight *int64
 }
 
 // Start starts a timer measurement for the given combination of fields.
@@ -801,10 +1707,16 @@ type TimedOperation struct {
 // +checkescape:all
 //go:nosplit
 func (t *TimerMetric) Start(fields ...string) TimedOperation {
+	var inFlight *int64
+	if g := t.inFlight; g != nil {
+		inFlight = g.counts[g.fieldsToKey.lookup(fields...)]
+		atomic.AddInt64(inFlight, 1)
+	}
 	return TimedOperation{
 		metric:        t,
 		partialFields: fields,
-		startedNs:     CheapNowNano(),
+		startedNs:     nowNano(),
+		inFlight:      inFlight,
 	}
 }
 
@@ -812,12 +1724,106 @@ func (t *TimerMetric) Start(fields ...string) TimedOperation {
 // `extraFields` is the rest of the fields appended to the fields passed to
 // `TimerMetric.Start`. The concatenation of these two must be the exact
 // number of fields that the underlying metric has.
+//
+// Only the first call to Finish records a sample; subsequent calls on the
+// same TimedOperation are no-ops. Copies of a TimedOperation are tracked
+// independently, so it should not be copied once started.
 // +checkescape:all
 //go:nosplit
-func (o TimedOperation) Finish(extraFields ...string) {
-	ended := CheapNowNano()
+func (o *TimedOperation) Finish(extraFields ...string) {
+	if o.metric == nil {
+		return
+	}
+	ended := nowNano()
 	fieldKey := o.metric.fieldsToKey.lookupConcat(o.partialFields, extraFields)
 	o.metric.addSampleByKey(ended-o.startedNs, fieldKey)
+	if o.inFlight != nil {
+		atomic.AddInt64(o.inFlight, -1)
+	}
+	o.metric = nil
+}
+
+// Observe records a duration that was measured externally, e.g. a processing
+// time reported by an event, without going through Start and Finish. fields
+// must be the exact number of fields of the metric.
+//
+// As with Finish when the clock goes backwards, negative durations are
+// recorded in the underflow bucket.
+// +checkescape:all
+//go:nosplit
+func (t *TimerMetric) Observe(d time.Duration, fields ...string) {
+	t.addSampleByKey(int64(d), t.fieldsToKey.lookup(fields...))
+}
+
+// MultiTimer records the duration of a single operation into several timer
+// metrics, e.g. an aggregate latency metric and a per-operation one. All
+// metrics record the exact same duration.
+type MultiTimer struct {
+	// timers is the list of timer metrics to record durations into. It is
+	// immutable.
+	timers []*TimerMetric
+}
+
+// NewMultiTimer returns a MultiTimer recording into the given timer metrics.
+func NewMultiTimer(timers ...*TimerMetric) *MultiTimer {
+	return &MultiTimer{timers: timers}
+}
+
+// MultiTimedOperation is used by MultiTimer to keep track of the time elapsed
+// between an operation starting and stopping.
+type MultiTimedOperation struct {
+	// timer is the MultiTimer for the operation. It is nil once the operation
+	// is finished.
+	timer *MultiTimer
+
+	// startedNs is the number of nanoseconds measured in MultiTimer.Start().
+	startedNs int64
+}
+
+// Start starts a timer measurement. Once the operation is finished, call
+// Finish on the returned MultiTimedOperation.
+func (m *MultiTimer) Start() MultiTimedOperation {
+	return MultiTimedOperation{
+		timer:     m,
+		startedNs: nowNano(),
+	}
+}
+
+// Finish marks an operation as finished and records its duration into all
+// timer metrics of the MultiTimer. fields contains the field values to use
+// for each timer metric, in the order passed to NewMultiTimer. If none of the
+// timer metrics have fields, fields may be omitted.
+//
+// As with TimedOperation.Finish, only the first call to Finish records
+// samples.
+func (o *MultiTimedOperation) Finish(fields ...[]string) {
+	if o.timer == nil {
+		return
+	}
+	ended := nowNano()
+	if len(fields) != 0 && len(fields) != len(o.timer.timers) {
+		panic(fmt.Sprintf("got field values for %d timer metrics, want %d", len(fields), len(o.timer.timers)))
+	}
+	for i, t := range o.timer.timers {
+		var timerFields []string
+		if len(fields) != 0 {
+			timerFields = fields[i]
+		}
+		t.addSampleByKey(ended-o.startedNs, t.fieldsToKey.lookup(timerFields...))
+	}
+	o.timer = nil
+}
+
+// BucketForDuration returns the index of the bucket that an operation lasting
+// d would be recorded in, as returned by Bucketer.BucketIndex.
+func (t *TimerMetric) BucketForDuration(d time.Duration) int {
+	return t.bucketIndex(d.Nanoseconds())
+}
+
+// Distribution returns the registered distribution metric that holds the
+// samples of t, for code that handles distribution metrics generically.
+func (t *TimerMetric) Distribution() *DistributionMetric {
+	return t.DistributionMetric
 }
 
 // stageTiming contains timing data for an initialization stage.
@@ -828,6 +1834,21 @@ type stageTiming struct {
 	ended time.Time
 }
 
+// toProto returns the protobuf representation of s.
+func (s stageTiming) toProto() *pb.StageTiming {
+	return &pb.StageTiming{
+		Stage: string(s.stage),
+		Started: &timestamppb.Timestamp{
+			Seconds: s.started.Unix(),
+			Nanos:   int32(s.started.Nanosecond()),
+		},
+		Ended: &timestamppb.Timestamp{
+			Seconds: s.ended.Unix(),
+			Nanos:   int32(s.ended.Nanosecond()),
+		},
+	}
+}
+
 // inProgress returns whether this stage hasn't ended yet.
 func (s stageTiming) inProgress() bool {
 	return !s.started.IsZero() && s.ended.IsZero()
@@ -841,13 +1862,53 @@ type metricSet struct {
 	// Map of distribution metrics.
 	distributionMetrics map[string]*DistributionMetric
 
+	// groups are the registered update groups. It is protected by
+	// registrationMu until initialized is true, and immutable afterwards.
+	groups []*UpdateGroup
+
+	// sanitizedNames maps the sanitized key of the name of all metrics (see
+	// sanitizedKey) to their name, to detect names that collide once
+	// sanitized.
+	sanitizedNames map[string]string
+
+	// scalarBatchThreshold is the minimum number of uint64 metrics without
+	// fields that must change in an update for their values to be sent in a
+	// ScalarBatch, or 0 if ScalarBatches are not used; see
+	// SetScalarBatchThreshold. It is protected by registrationMu until
+	// initialized is true, and immutable afterwards.
+	scalarBatchThreshold int
+
+	// registrationIndex maps the name of metrics to their index within
+	// MetricRegistration.Metrics. It is set by Initialize.
+	registrationIndex map[string]uint32
+
+	// emitDivisors maps the name of metrics that are only considered by every
+	// Nth call to EmitMetricUpdate to N; see SetEmitDivisor. It is protected
+	// by registrationMu until initialized is true, and immutable afterwards.
+	emitDivisors map[string]uint64
+
+	// metadataMu protects uint64Metrics, distributionMetrics and
+	// sanitizedNames, and the metadata of the metrics they contain. They are
+	// only written with both registrationMu and metadataMu held, in that
+	// order, so they may be read with either held: registration reads them
+	// with registrationMu, and readers that must not block registration
+	// (e.g. IsCumulative and snapshots) with metadataMu. Once Initialize is
+	// called, metadata protos are never modified; ChangeDescription replaces
+	// them instead, so they remain valid after metadataMu is released.
+	metadataMu sync.RWMutex
+
 	// mu protects the fields below.
 	mu sync.RWMutex
 
 	// Information about the stages reached by the Sentry. Only appended to, so
 	// reading a shallow copy of the slice header concurrently is safe.
+	// ResetStages replaces it rather than truncating it.
 	finished []stageTiming
 
+	// stageGeneration is incremented by ResetStages, so that metric updates
+	// can tell that finished was replaced.
+	stageGeneration uint64
+
 	// The current stage in progress.
 	currentStage stageTiming
 }
@@ -857,51 +1918,188 @@ func makeMetricSet() metricSet {
 	return metricSet{
 		uint64Metrics:       make(map[string]customUint64Metric),
 		distributionMetrics: make(map[string]*DistributionMetric),
+		sanitizedNames:      make(map[string]string),
+		emitDivisors:        make(map[string]uint64),
 		finished:            make([]stageTiming, 0, len(allStages)),
 	}
 }
 
+// addUint64Metric adds a uint64 metric with the given name to m.
+//
+// Preconditions:
+// * registrationMu is locked.
+// * name was checked with checkName.
+func (m *metricSet) addUint64Metric(name string, metric customUint64Metric) {
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+	m.uint64Metrics[name] = metric
+	m.sanitizedNames[sanitizedKey(name)] = name
+}
+
+// addDistributionMetric adds a distribution metric with the given name to m.
+//
+// Preconditions:
+// * registrationMu is locked.
+// * name was checked with checkName.
+func (m *metricSet) addDistributionMetric(name string, d *DistributionMetric) {
+	m.metadataMu.Lock()
+	defer m.metadataMu.Unlock()
+	m.distributionMetrics[name] = d
+	m.sanitizedNames[sanitizedKey(name)] = name
+}
+
+// checkName returns an error if name cannot be used for a new metric in m.
+//
+// Preconditions:
+// * registrationMu is locked.
+func (m *metricSet) checkName(name string) error {
+	if _, ok := m.uint64Metrics[name]; ok {
+		return ErrNameInUse
+	}
+	if _, ok := m.distributionMetrics[name]; ok {
+		return ErrNameInUse
+	}
+	if other, ok := m.sanitizedNames[sanitizedKey(name)]; ok {
+		return fmt.Errorf("%w: %q collides with %q once sanitized", ErrNameInUse, name, other)
+	}
+	return nil
+}
+
+// checkNames returns an error if any of names cannot be used for a new metric.
+//
+// Preconditions:
+// * registrationMu is locked.
+func checkNames(names ...string) error {
+	for _, name := range names {
+		if err := allMetrics.checkName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SanitizeName converts a metric or field name to a name made only of ASCII
+// letters, digits and underscores that does not start with a digit, as
+// required by many monitoring systems (e.g. Prometheus). Invalid characters
+// are replaced by underscores, and leading and trailing underscores are
+// trimmed, so that "/fs/opens" becomes "fs_opens".
+//
+// Metric names that are identical once sanitized, regardless of case, are
+// rejected at registration.
+func SanitizeName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	sanitized = strings.Trim(sanitized, "_")
+	if sanitized != "" && sanitized[0] >= '0' && sanitized[0] <= '9' {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
+
+// sanitizedKey returns the key of name in metricSet.sanitizedNames. Names are
+// compared case-insensitively, as some monitoring systems treat names that
+// only differ by case as equal.
+func sanitizedKey(name string) string {
+	return strings.ToLower(SanitizeName(name))
+}
+
+// registration returns the MetricRegistration describing all metrics in m.
+func (m *metricSet) registration() *pb.MetricRegistration {
+	m.metadataMu.RLock()
+	defer m.metadataMu.RUnlock()
+
+	r := pb.MetricRegistration{}
+	for _, v := range m.uint64Metrics {
+		r.Metrics = append(r.Metrics, v.metadata)
+	}
+	for _, v := range m.distributionMetrics {
+		r.Metrics = append(r.Metrics, v.metadata)
+	}
+	// Metrics are sorted by name so that their index is stable across
+	// registrations; see ScalarBatch.
+	sort.Slice(r.Metrics, func(i, j int) bool {
+		return r.Metrics[i].GetName() < r.Metrics[j].GetName()
+	})
+	r.Stages = make([]string, 0, len(allStages))
+	for _, s := range allStages {
+		r.Stages = append(r.Stages, string(s))
+	}
+	return &r
+}
+
 // Values returns a snapshot of all values in m.
 func (m *metricSet) Values() metricValues {
 	m.mu.Lock()
 	stages := m.finished[:]
+	stageGeneration := m.stageGeneration
+	currentStage := m.currentStage
 	m.mu.Unlock()
 
+	m.metadataMu.RLock()
+	defer m.metadataMu.RUnlock()
+
+	// Block updates made through update groups, so that they are observed
+	// atomically.
+	defer m.lockGroups()()
+
 	vals := metricValues{
-		uint64Metrics:            make(map[string]interface{}, len(m.uint64Metrics)),
-		distributionMetrics:      make(map[string]map[string][]uint64, len(m.distributionMetrics)),
-		distributionTotalSamples: make(map[string]map[string]uint64, len(m.distributionMetrics)),
-		stages:                   stages,
+		uint64Metrics:              make(map[string]interface{}, len(m.uint64Metrics)),
+		distributionMetrics:        make(map[string]map[string][]uint64, len(m.distributionMetrics)),
+		distributionTotalSamples:   make(map[string]map[string]uint64, len(m.distributionMetrics)),
+		distributionResets:         make(map[string]map[string]uint64, len(m.distributionMetrics)),
+		fullValue:                  make(map[string]bool),
+		nonCumulativeDistributions: make(map[string]bool),
+		trimZeroBuckets:            make(map[string]bool),
+		scalarBatchThreshold:       m.scalarBatchThreshold,
+		registrationIndex:          m.registrationIndex,
+		stages:                     stages,
+		stageGeneration:            stageGeneration,
+		currentStage:               currentStage,
 	}
 	for k, v := range m.uint64Metrics {
-		fields := v.metadata.GetFields()
-		switch len(fields) {
-		case 0:
-			vals.uint64Metrics[k] = v.value()
-		case 1:
-			values := fields[0].GetAllowedValues()
-			fieldsMap := make(map[string]uint64)
-			for _, fieldValue := range values {
-				fieldsMap[fieldValue] = v.value(fieldValue)
-			}
-			vals.uint64Metrics[k] = fieldsMap
-		default:
-			panic(fmt.Sprintf("Unsupported number of metric fields: %d", len(fields)))
+		val, ok := v.current()
+		if !ok {
+			continue
 		}
+		if v.metadata.GetFullValue() {
+			vals.fullValue[k] = true
+		}
+		vals.uint64Metrics[k] = val
 	}
 	for name, metric := range m.distributionMetrics {
+		fullValue := metric.metadata.GetFullValue()
+		if fullValue {
+			vals.fullValue[name] = true
+		}
+		if !metric.metadata.GetCumulative() {
+			vals.nonCumulativeDistributions[name] = true
+		}
+		if metric.metadata.GetTrimZeroBuckets() {
+			vals.trimZeroBuckets[name] = true
+		}
+		// Load the number of resets before the samples, so that a reset
+		// racing with this snapshot is detected by the next one at worst.
+		resets := atomic.LoadUint64(metric.resets)
+		fieldKeysToResets := make(map[string]uint64, len(metric.samples))
 		fieldKeysToValues := make(map[string][]uint64, len(metric.samples))
 		fieldKeysToTotalSamples := make(map[string]uint64, len(metric.samples))
 		for fieldKey, samples := range metric.samples {
+			fieldKeysToResets[fieldKey] = resets + atomic.LoadUint64(metric.fieldResets[fieldKey])
 			samplesSnapshot := snapshotDistribution(samples)
 			totalSamples := uint64(0)
 			for _, bucket := range samplesSnapshot {
 				totalSamples += bucket
 			}
-			if totalSamples == 0 {
+			if totalSamples == 0 && !fullValue {
 				// No samples recorded for this combination of field, so leave
 				// the maps for this fieldKey as nil. This lessens the memory cost
-				// of distributions with unused field combinations.
+				// of distributions with unused field combinations. Metrics
+				// emitted with their full value keep them, as they are
+				// emitted regardless.
 				fieldKeysToTotalSamples[fieldKey] = 0
 				fieldKeysToValues[fieldKey] = nil
 			} else {
@@ -911,6 +2109,7 @@ func (m *metricSet) Values() metricValues {
 		}
 		vals.distributionMetrics[name] = fieldKeysToValues
 		vals.distributionTotalSamples[name] = fieldKeysToTotalSamples
+		vals.distributionResets[name] = fieldKeysToResets
 	}
 	return vals
 }
@@ -937,9 +2136,239 @@ type metricValues struct {
 	// no new samples are not retransmitted.
 	distributionTotalSamples map[string]map[string]uint64
 
+	// distributionResets is the number of times each distribution metric was
+	// reset, by metric name and field values, counting both Reset and
+	// ResetField. A change between snapshots means that the distribution was
+	// reset in between for these field values.
+	distributionResets map[string]map[string]uint64
+
+	// fullValue contains the names of metrics that are always emitted with
+	// their full value; see SetFullValue.
+	fullValue map[string]bool
+
+	// trimZeroBuckets contains the names of distribution metrics whose
+	// trailing zero buckets are omitted from updates; see
+	// SetTrimZeroBuckets.
+	trimZeroBuckets map[string]bool
+
+	// nonCumulativeDistributions contains the names of distribution metrics
+	// that are not cumulative, whose absolute values are emitted.
+	nonCumulativeDistributions map[string]bool
+
+	// scalarBatchThreshold and registrationIndex are copied from the
+	// metricSet; see there. registrationIndex is shared and must not be
+	// modified.
+	scalarBatchThreshold int
+	registrationIndex    map[string]uint32
+
 	// Information on when initialization stages were reached. Does not include
 	// the currently-ongoing stage, if any.
 	stages []stageTiming
+
+	// stageGeneration is the number of calls to ResetStages before stages
+	// were taken. stages of different generations are unrelated.
+	stageGeneration uint64
+
+	// currentStage is the currently-ongoing stage, if any.
+	currentStage stageTiming
+}
+
+// Snapshot is a point-in-time copy of the values of all registered metrics,
+// meant for exporters that translate metrics to other formats.
+type Snapshot struct {
+	// Metrics contains all registered metrics, sorted by name.
+	Metrics []MetricSnapshot
+
+	// CurrentStage is the initialization stage in progress, or empty if no
+	// stage is in progress.
+	CurrentStage InitStage
+
+	// CurrentStageStarted is the time at which CurrentStage started, or the
+	// zero time if no stage is in progress.
+	CurrentStageStarted time.Time
+}
+
+// MetricSnapshot is the value of a single metric within a Snapshot.
+type MetricSnapshot struct {
+	// Metadata is the registration metadata of the metric. It is shared with
+	// the metric itself and must not be modified.
+	Metadata *pb.MetricMetadata
+
+	// Points contains the value of the metric for each combination of field
+	// values. Metrics without fields have a single point.
+	Points []MetricPoint
+}
+
+// MetricPoint is the value of a metric for one combination of field values.
+type MetricPoint struct {
+	// FieldValues contains the value of each of the metric's fields, in the
+	// same order as Metadata.Fields.
+	FieldValues []string
+
+	// Uint64 is the value of TYPE_UINT64 metrics.
+	Uint64 uint64
+
+	// Samples is the number of samples in each bucket of TYPE_DISTRIBUTION
+	// metrics. It has the same layout as pb.Samples.NewSamples: the first
+	// element is the underflow bucket and the last is the overflow bucket.
+	// The lower bound of each bucket is given by
+	// MetricSnapshot.BucketLowerBounds.
+	Samples []uint64
+}
+
+// UnderflowLowerBound is the lower bound of the underflow bucket of
+// distributions, which holds all samples below the lower bound of the first
+// finite bucket. It stands for negative infinity: as samples are int64, the
+// underflow bucket [UnderflowLowerBound, first lower bound) contains exactly
+// the samples in (-Inf, first lower bound). Exporters should render it as
+// negative infinity.
+const UnderflowLowerBound = math.MinInt64
+
+// BucketLowerBounds returns the inclusive lower bound of every bucket of a
+// TYPE_DISTRIBUTION metric, including the underflow and overflow buckets, so
+// that the i-th bound is the lower bound of the bucket of MetricPoint.Samples[i].
+// The first bound is UnderflowLowerBound. It returns nil for other metric
+// types.
+func (m MetricSnapshot) BucketLowerBounds() []int64 {
+	if m.Metadata.GetType() != pb.MetricMetadata_TYPE_DISTRIBUTION {
+		return nil
+	}
+	return append([]int64{UnderflowLowerBound}, m.Metadata.GetDistributionBucketLowerBounds()...)
+}
+
+// BucketCounts returns the number of samples in each bucket of p, with the
+// same layout as Samples. If cumulative is false, these are the raw per-bucket
+// counts, i.e. a copy of Samples. If cumulative is true, the i-th count is the
+// number of samples in buckets 0 to i, i.e. of samples strictly below the
+// lower bound of bucket i+1, as expected by Prometheus-style "le" buckets; the
+// last count is the total number of samples. It returns nil for points of
+// metrics other than TYPE_DISTRIBUTION.
+func (p MetricPoint) BucketCounts(cumulative bool) []uint64 {
+	if p.Samples == nil {
+		return nil
+	}
+	counts := append([]uint64(nil), p.Samples...)
+	if cumulative {
+		for i := 1; i < len(counts); i++ {
+			counts[i] += counts[i-1]
+		}
+	}
+	return counts
+}
+
+// BucketCounts returns the bucket counts of the point of m with the given
+// field values, as returned by MetricPoint.BucketCounts. It returns false if
+// m has no such point.
+func (m MetricSnapshot) BucketCounts(cumulative bool, fieldValues ...string) ([]uint64, bool) {
+	for _, p := range m.Points {
+		if len(p.FieldValues) == len(fieldValues) && strings.Join(p.FieldValues, ",") == strings.Join(fieldValues, ",") {
+			return p.BucketCounts(cumulative), true
+		}
+	}
+	return nil, false
+}
+
+// GetSnapshot returns a snapshot of the values of all registered metrics.
+//
+// Preconditions:
+// * Initialize has been called.
+func GetSnapshot() Snapshot {
+	return allMetrics.Values().toSnapshot(&allMetrics)
+}
+
+// toSnapshot converts vals, which must have been taken from m, to a Snapshot.
+func (vals metricValues) toSnapshot(m *metricSet) Snapshot {
+	m.metadataMu.RLock()
+	defer m.metadataMu.RUnlock()
+
+	var s Snapshot
+	if vals.currentStage.inProgress() {
+		s.CurrentStage = vals.currentStage.stage
+		s.CurrentStageStarted = vals.currentStage.started
+	}
+	for name, v := range vals.uint64Metrics {
+		ms := MetricSnapshot{Metadata: m.uint64Metrics[name].metadata}
+		switch t := v.(type) {
+		case uint64:
+			ms.Points = []MetricPoint{{Uint64: t}}
+		case map[string]uint64:
+			for fieldValue, value := range t {
+				ms.Points = append(ms.Points, MetricPoint{
+					FieldValues: []string{fieldValue},
+					Uint64:      value,
+				})
+			}
+		}
+		s.Metrics = append(s.Metrics, ms)
+	}
+	for name, dist := range vals.distributionMetrics {
+		metadata := m.distributionMetrics[name].metadata
+		ms := MetricSnapshot{Metadata: metadata}
+		numBuckets := len(metadata.GetDistributionBucketLowerBounds()) + 1
+		for fieldKey, samples := range dist {
+			if samples == nil {
+				samples = make([]uint64, numBuckets)
+			}
+			ms.Points = append(ms.Points, MetricPoint{
+				FieldValues: keyToMultiField(fieldKey),
+				Samples:     samples,
+			})
+		}
+		s.Metrics = append(s.Metrics, ms)
+	}
+	sort.Slice(s.Metrics, func(i, j int) bool {
+		return s.Metrics[i].Metadata.GetName() < s.Metrics[j].Metadata.GetName()
+	})
+	for _, ms := range s.Metrics {
+		sort.Slice(ms.Points, func(i, j int) bool {
+			return strings.Join(ms.Points[i].FieldValues, ",") < strings.Join(ms.Points[j].FieldValues, ",")
+		})
+	}
+	return s
+}
+
+// DownsampleBuckets merges adjacent finite buckets of a distribution into at
+// most numFiniteBuckets finite buckets, e.g. to display a high-resolution
+// distribution on a summary dashboard.
+//
+// lowerBounds and samples have the same layout as
+// pb.MetricMetadata.DistributionBucketLowerBounds and pb.Samples.NewSamples,
+// and so do the returned slices. The lower bounds of the returned buckets are
+// a subset of lowerBounds; in particular, the lower bounds of the first finite
+// bucket and of the overflow bucket are retained. The underflow and overflow
+// buckets are left as-is, so the total number of samples is preserved.
+//
+// The given slices are never modified. If the distribution already has at
+// most numFiniteBuckets finite buckets, copies of them are returned.
+func DownsampleBuckets(lowerBounds []int64, samples []uint64, numFiniteBuckets int) ([]int64, []uint64, error) {
+	currentFiniteBuckets := len(lowerBounds) - 1
+	if currentFiniteBuckets < 1 || len(samples) != currentFiniteBuckets+2 {
+		return nil, nil, fmt.Errorf("%w: %d lower bounds, %d buckets", ErrInvalidDistribution, len(lowerBounds), len(samples))
+	}
+	if numFiniteBuckets < 1 {
+		return nil, nil, fmt.Errorf("%w: number of finite buckets must be at least 1, got %d", ErrInvalidDistribution, numFiniteBuckets)
+	}
+	if numFiniteBuckets >= currentFiniteBuckets {
+		return append([]int64(nil), lowerBounds...), append([]uint64(nil), samples...), nil
+	}
+	newLowerBounds := make([]int64, numFiniteBuckets+1)
+	newSamples := make([]uint64, numFiniteBuckets+2)
+	newSamples[0] = samples[0]
+	newSamples[numFiniteBuckets+1] = samples[currentFiniteBuckets+1]
+	for i := 0; i < numFiniteBuckets; i++ {
+		// Finite buckets [first, last) are merged into the new i-th finite
+		// bucket. Spreading the boundaries this way ensures that each new bucket
+		// merges either floor or ceil of currentFiniteBuckets/numFiniteBuckets
+		// buckets.
+		first := i * currentFiniteBuckets / numFiniteBuckets
+		last := (i + 1) * currentFiniteBuckets / numFiniteBuckets
+		newLowerBounds[i] = lowerBounds[first]
+		for b := first; b < last; b++ {
+			newSamples[i+1] += samples[b+1]
+		}
+	}
+	newLowerBounds[numFiniteBuckets] = lowerBounds[currentFiniteBuckets]
+	return newLowerBounds, newSamples, nil
 }
 
 var (
@@ -950,31 +2379,45 @@ var (
 
 	// metricsAtLastEmit contains the state of the metrics at the last emit event.
 	metricsAtLastEmit metricValues
-)
 
-// EmitMetricUpdate emits a MetricUpdate over the event channel.
-//
-// Only metrics that have changed since the last call are emitted.
-//
-// EmitMetricUpdate is thread-safe.
-//
-// Preconditions:
-// * Initialize has been called.
-func EmitMetricUpdate() {
-	emitMu.Lock()
-	defer emitMu.Unlock()
+	// shutDown is true once Shutdown has been called, after which metric
+	// updates are not emitted. It is protected by emitMu.
+	shutDown bool
 
-	snapshot := allMetrics.Values()
+	// shutdownDone is closed by Shutdown, with emitMu held.
+	shutdownDone = make(chan struct{})
 
+	// emitLatency measures how long it takes to emit a MetricUpdate over the
+	// event channel, e.g. because the consumer is applying backpressure.
+	emitLatency = MustRegisterTimerMetric("/metric/emit_latency", NewDurationBucketer(15, time.Microsecond, time.Second), "Time spent emitting metric updates over the event channel, in nanoseconds.")
+)
+
+// samplesEqual returns whether two distribution snapshots have the same
+// number of samples in every bucket.
+func samplesEqual(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// metricUpdate returns a MetricUpdate containing the changes of the metric
+// values in snapshot since last, which is empty if no update was built before.
+func metricUpdate(last, snapshot metricValues) *pb.MetricUpdate {
 	m := pb.MetricUpdate{}
-	// On the first call metricsAtLastEmit will be empty. Include all
-	// metrics then.
+	// last is empty on the first emit. Include all metrics then.
 	for k, v := range snapshot.uint64Metrics {
-		prev, ok := metricsAtLastEmit.uint64Metrics[k]
+		prev, ok := last.uint64Metrics[k]
+		full := snapshot.fullValue[k]
 		switch t := v.(type) {
 		case uint64:
 			// Metric exists and value did not change.
-			if ok && prev.(uint64) == t {
+			if !full && ok && prev.(uint64) == t {
 				continue
 			}
 
@@ -987,8 +2430,9 @@ func EmitMetricUpdate() {
 				// Emit data on the first call only if the field
 				// value has been incremented. For all other
 				// calls, emit data if the field value has been
-				// changed from the previous emit.
-				if (!ok && metricValue == 0) || (ok && prev.(map[string]uint64)[fieldValue] == metricValue) {
+				// changed from the previous emit. Metrics emitted with
+				// their full value are emitted for all field values.
+				if !full && ((!ok && metricValue == 0) || (ok && prev.(map[string]uint64)[fieldValue] == metricValue)) {
 					continue
 				}
 
@@ -1001,30 +2445,106 @@ func EmitMetricUpdate() {
 		}
 	}
 	for name, dist := range snapshot.distributionTotalSamples {
-		prev, ok := metricsAtLastEmit.distributionTotalSamples[name]
+		prev, ok := last.distributionTotalSamples[name]
 		for fieldKey, currentTotal := range dist {
+			// If the distribution was reset for these field values since the
+			// last emit, deltas are meaningless; send the absolute values
+			// instead.
+			wasReset := ok && snapshot.distributionResets[name][fieldKey] != last.distributionResets[name][fieldKey]
+			oldSamples := last.distributionMetrics[name][fieldKey]
+			currentSamples := snapshot.distributionMetrics[name][fieldKey]
+			if snapshot.fullValue[name] {
+				m.Metrics = append(m.Metrics, &pb.MetricValue{
+					Name:        name,
+					FieldValues: keyToMultiField(fieldKey),
+					Value: &pb.MetricValue_DistributionValue{
+						DistributionValue: &pb.Samples{
+							NewSamples: currentSamples,
+						},
+					},
+				})
+				continue
+			}
+			if snapshot.nonCumulativeDistributions[name] {
+				// Buckets of non-cumulative distributions may decrease, so
+				// deltas are meaningless. Send the absolute values whenever
+				// they changed instead.
+				if samplesEqual(oldSamples, currentSamples) {
+					continue
+				}
+				if currentSamples == nil {
+					currentSamples = make([]uint64, len(oldSamples))
+				}
+				m.Metrics = append(m.Metrics, &pb.MetricValue{
+					Name:        name,
+					FieldValues: keyToMultiField(fieldKey),
+					Value: &pb.MetricValue_DistributionValue{
+						DistributionValue: &pb.Samples{
+							NewSamples: currentSamples,
+							WasReset:   true,
+						},
+					},
+				})
+				continue
+			}
+			if wasReset {
+				if currentTotal == 0 && prev[fieldKey] == 0 {
+					continue
+				}
+				if currentSamples == nil {
+					currentSamples = make([]uint64, len(oldSamples))
+				}
+				m.Metrics = append(m.Metrics, &pb.MetricValue{
+					Name:        name,
+					FieldValues: keyToMultiField(fieldKey),
+					Value: &pb.MetricValue_DistributionValue{
+						DistributionValue: &pb.Samples{
+							NewSamples: currentSamples,
+							WasReset:   true,
+						},
+					},
+				})
+				continue
+			}
 			if currentTotal == 0 {
 				continue
 			}
 			if ok {
-				if prevTotal, ok2 := prev[fieldKey]; ok2 && prevTotal == currentTotal {
+				// The total number of samples is a cheap first check, but
+				// samples may have moved between buckets without changing it
+				// (e.g. if the distribution was modified other than by
+				// AddSample), so compare the buckets themselves if it matches.
+				if prevTotal, ok2 := prev[fieldKey]; ok2 && prevTotal == currentTotal && samplesEqual(oldSamples, currentSamples) {
 					continue
 				}
 			}
-			oldSamples := metricsAtLastEmit.distributionMetrics[name][fieldKey]
 			var newSamples []uint64
-			if oldSamples != nil {
-				currentSamples := snapshot.distributionMetrics[name][fieldKey]
+			reset := false
+			if oldSamples != nil && len(oldSamples) == len(currentSamples) {
 				numBuckets := len(currentSamples)
 				newSamples = make([]uint64, numBuckets)
 				for i := 0; i < numBuckets; i++ {
+					if currentSamples[i] < oldSamples[i] {
+						// A bucket went backwards, so there is no meaningful
+						// delta. Send the full current samples instead.
+						log.Warningf("Bucket %d of metric %s%v decreased from %d to %d, emitting full value", i, name, keyToMultiField(fieldKey), oldSamples[i], currentSamples[i])
+						newSamples = currentSamples
+						reset = true
+						break
+					}
 					newSamples[i] = currentSamples[i] - oldSamples[i]
 				}
 			} else {
 				// oldSamples == nil means that the previous snapshot has no samples.
 				// This means the delta is the current number of samples, no need for
 				// a copy.
-				newSamples = snapshot.distributionMetrics[name][fieldKey]
+				// If the number of buckets changed, there is no meaningful delta, so
+				// send the full current samples instead.
+				if oldSamples != nil {
+					log.Warningf("Number of buckets of metric %s%v changed from %d to %d, emitting full value", name, keyToMultiField(fieldKey), len(oldSamples), len(currentSamples))
+					reset = true
+				}
+				newSamples = currentSamples
 			}
 			m.Metrics = append(m.Metrics, &pb.MetricValue{
 				Name:        name,
@@ -1032,30 +2552,142 @@ func EmitMetricUpdate() {
 				Value: &pb.MetricValue_DistributionValue{
 					DistributionValue: &pb.Samples{
 						NewSamples: newSamples,
+						WasReset:   reset,
 					},
 				},
 			})
 		}
 	}
 
-	for s := len(metricsAtLastEmit.stages); s < len(snapshot.stages); s++ {
-		newStage := snapshot.stages[s]
-		m.StageTiming = append(m.StageTiming, &pb.StageTiming{
-			Stage: string(newStage.stage),
-			Started: &timestamppb.Timestamp{
-				Seconds: newStage.started.Unix(),
-				Nanos:   int32(newStage.started.Nanosecond()),
-			},
-			Ended: &timestamppb.Timestamp{
-				Seconds: newStage.ended.Unix(),
-				Nanos:   int32(newStage.ended.Nanosecond()),
-			},
-		})
+	// Stages are only appended to within a generation, so only the stages
+	// beyond those of the last update are new. If stages were reset since,
+	// all stages of the new generation are new.
+	firstNewStage := len(last.stages)
+	if last.stageGeneration != snapshot.stageGeneration {
+		firstNewStage = 0
+	}
+	for s := firstNewStage; s < len(snapshot.stages); s++ {
+		m.StageTiming = append(m.StageTiming, snapshot.stages[s].toProto())
+	}
+
+	for _, v := range m.Metrics {
+		if d := v.GetDistributionValue(); d != nil && snapshot.trimZeroBuckets[v.Name] {
+			d.NewSamples = trimZeroBuckets(d.NewSamples)
+		}
+	}
+	if snapshot.scalarBatchThreshold > 0 {
+		batchScalars(&m, snapshot.scalarBatchThreshold, snapshot.registrationIndex)
+	}
+	return &m
+}
+
+// trimZeroBuckets returns samples without its trailing zero buckets.
+func trimZeroBuckets(samples []uint64) []uint64 {
+	n := len(samples)
+	for n > 0 && samples[n-1] == 0 {
+		n--
+	}
+	return samples[:n]
+}
+
+// EmitMetricUpdate emits a MetricUpdate over the event channel.
+//
+// Only metrics that have changed since the last call are emitted. Values of
+// uint64 metrics are absolute, while values of cumulative distributions are
+// deltas since the last call; see pb.MetricValue.
+//
+// EmitMetricUpdate is thread-safe.
+//
+// Preconditions:
+// * Initialize has been called.
+func EmitMetricUpdate() {
+	if err := emitMetricUpdate(); err != nil {
+		log.Warningf("Unable to emit metrics: %s", err)
 	}
+}
 
+// FlushMetrics emits a MetricUpdate, as EmitMetricUpdate does, and waits until
+// all emitters that support it (see eventchannel.Flusher) have delivered it, or
+// until ctx is done. It is meant to be called before exiting, to avoid losing
+// the final values of metrics. Rate-limited emitters deliver the final update
+// on flush even if their limits dropped it, but delivery is not guaranteed for
+// emitters that don't implement eventchannel.Flusher.
+//
+// FlushMetrics is thread-safe.
+//
+// Preconditions:
+// * Initialize has been called.
+func FlushMetrics(ctx context.Context) error {
+	if err := emitMetricUpdate(); err != nil {
+		return fmt.Errorf("unable to emit metrics: %w", err)
+	}
+	if err := eventchannel.Flush(ctx); err != nil {
+		return fmt.Errorf("unable to flush metrics: %w", err)
+	}
+	return nil
+}
+
+// Shutdown stops metric emission, e.g. before exiting. It emits a final
+// MetricUpdate and waits for its delivery, as FlushMetrics does, and then
+// makes EmitMetricUpdate a no-op, disables emission on stage end and closes
+// the channel returned by ShutdownDone, so that other exporters (e.g. metric
+// streams) stop too.
+//
+// Shutdown is final: metrics stay registered and keep their values, and the
+// set of metrics stays frozen, so that readers and exporters may keep reading
+// it. Registration, Initialize and Disable still fail as after Initialize.
+// The event channel is shared with other users of package eventchannel, so it
+// is not closed.
+//
+// Shutdown is thread-safe. Calls after the first only flush emitters.
+//
+// Preconditions:
+// * Initialize or Disable has been called.
+func Shutdown(ctx context.Context) error {
+	if err := lockRegistration("shut down metrics"); err != nil {
+		return err
+	}
+	wasInitialized := initialized
+	registrationMu.Unlock()
+	if !wasInitialized {
+		return fmt.Errorf("%w: metric.Shutdown called before metric.Initialize", ErrNotInitialized)
+	}
+	err := FlushMetrics(ctx)
+	SetEmitOnStageEnd(false)
+
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	if !shutDown {
+		shutDown = true
+		close(shutdownDone)
+	}
+	return err
+}
+
+// ShutdownDone returns a channel that is closed once Shutdown has been called.
+//
+// ShutdownDone is thread-safe.
+func ShutdownDone() <-chan struct{} {
+	return shutdownDone
+}
+
+// emitMetricUpdate implements EmitMetricUpdate.
+func emitMetricUpdate() error {
+	emitMu.Lock()
+	defer emitMu.Unlock()
+
+	if shutDown {
+		return nil
+	}
+
+	snapshot := allMetrics.Values()
+	emitCycle++
+	skipDivisorMetrics(&snapshot, metricsAtLastEmit, emitCycle)
+
+	m := metricUpdate(metricsAtLastEmit, snapshot)
 	metricsAtLastEmit = snapshot
-	if len(m.Metrics) == 0 && len(m.StageTiming) == 0 {
-		return
+	if IsEmptyUpdate(m) {
+		return nil
 	}
 
 	if log.IsLogging(log.Debug) {
@@ -1072,9 +2704,24 @@ func EmitMetricUpdate() {
 		}
 	}
 
-	if err := eventchannel.Emit(&m); err != nil {
-		log.Warningf("Unable to emit metrics: %s", err)
-	}
+	// The emit latency is recorded after the update has been built, so it is
+	// reported in the next update rather than in this one.
+	op := emitLatency.Start()
+	err := eventchannel.Emit(m)
+	op.Finish()
+	return err
+}
+
+func init() {
+	emitstate.Reset = resetEmitState
+}
+
+// resetEmitState implements emitstate.Reset: the next MetricUpdate is relative
+// to the current values of metrics, but nothing is emitted.
+func resetEmitState() {
+	emitMu.Lock()
+	defer emitMu.Unlock()
+	metricsAtLastEmit = allMetrics.Values()
 }
 
 // StartStage should be called when an initialization stage is started.
@@ -1082,30 +2729,121 @@ func EmitMetricUpdate() {
 // Alternatively, future calls to StartStage will implicitly indicate that the
 // previous stage ended.
 // Stage information will be emitted in the next call to EmitMetricUpdate after
-// a stage has ended.
+// a stage has ended, which happens immediately if SetEmitOnStageEnd is enabled.
 //
 // This function may (and is expected to) be called prior to final
 // initialization of this metric library, as it has to capture early stages
 // of Sentry initialization.
 func StartStage(stage InitStage) func() {
-	now := time.Now()
+	now := stageNow()
 	allMetrics.mu.Lock()
-	defer allMetrics.mu.Unlock()
-	if allMetrics.currentStage.inProgress() {
+	ended := allMetrics.currentStage.inProgress()
+	if ended {
 		endStage(now)
 	}
 	allMetrics.currentStage.stage = stage
 	allMetrics.currentStage.started = now
+	allMetrics.mu.Unlock()
+	if ended {
+		emitOnStageEnd()
+	}
 	return func() {
-		now := time.Now()
+		now := stageNow()
 		allMetrics.mu.Lock()
-		defer allMetrics.mu.Unlock()
 		// The current stage may have been ended by another call to StartStage, so
 		// double-check prior to clearing the current stage.
-		if allMetrics.currentStage.inProgress() && allMetrics.currentStage.stage == stage {
+		ended := allMetrics.currentStage.inProgress() && allMetrics.currentStage.stage == stage
+		if ended {
 			endStage(now)
 		}
+		allMetrics.mu.Unlock()
+		if ended {
+			emitOnStageEnd()
+		}
+	}
+}
+
+var (
+	// emitOnStageEndEnabled is 1 if a metric update is emitted whenever a
+	// stage ends. It is accessed atomically.
+	emitOnStageEndEnabled int32
+
+	// emittingOnStageEnd is 1 while emitOnStageEnd is emitting an update. It
+	// is accessed atomically.
+	emittingOnStageEnd int32
+)
+
+// SetEmitOnStageEnd sets whether a metric update is emitted over the event
+// channel whenever an initialization stage ends, so that each stage boundary
+// produces an update with the values of metrics at that point. This gives a
+// timeline of metric values during startup without scheduling emits. It is
+// disabled by default.
+//
+// Stages that ended before SetEmitOnStageEnd(true) are reported in the next
+// update, as usual.
+//
+// Preconditions:
+// * Initialize has been called.
+func SetEmitOnStageEnd(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&emitOnStageEndEnabled, v)
+}
+
+// emitOnStageEnd emits a metric update if SetEmitOnStageEnd is enabled. It
+// must be called when a stage ends, without holding allMetrics.mu.
+//
+// A stage ending while the update is emitted, e.g. from an emitter, does not
+// emit another update (which would deadlock on emitMu); it is reported in the
+// next update instead.
+func emitOnStageEnd() {
+	if atomic.LoadInt32(&emitOnStageEndEnabled) == 0 {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&emittingOnStageEnd, 0, 1) {
+		return
 	}
+	defer atomic.StoreInt32(&emittingOnStageEnd, 0)
+	EmitMetricUpdate()
+}
+
+// CurrentStage returns the initialization stage in progress and the time at
+// which it started, e.g. to show which stage a slow startup is stuck in. It
+// returns false if no stage is in progress.
+//
+// CurrentStage is thread-safe, and may be called prior to Initialize.
+func CurrentStage() (InitStage, time.Time, bool) {
+	allMetrics.mu.RLock()
+	defer allMetrics.mu.RUnlock()
+	if !allMetrics.currentStage.inProgress() {
+		return "", time.Time{}, false
+	}
+	return allMetrics.currentStage.stage, allMetrics.currentStage.started, true
+}
+
+// ResetStages clears the list of finished initialization stages and returns
+// them, e.g. so that a process going through several initialization sequences
+// (such as repeated restores) reports the stages of each sequence separately.
+// The stage in progress, if any, is not affected.
+//
+// Stages returned by ResetStages that were not emitted yet are not emitted
+// anymore. Subsequent metric updates report the stages finished after the
+// reset, starting from the first one.
+//
+// ResetStages is thread-safe.
+func ResetStages() []*pb.StageTiming {
+	allMetrics.mu.Lock()
+	defer allMetrics.mu.Unlock()
+	stages := make([]*pb.StageTiming, len(allMetrics.finished))
+	for i, s := range allMetrics.finished {
+		stages[i] = s.toProto()
+	}
+	// Snapshots may still refer to the old slice, so replace it.
+	allMetrics.finished = make([]stageTiming, 0, len(allStages))
+	allMetrics.stageGeneration++
+	return stages
 }
 
 // endStage marks allMetrics.currentStage as ended, adding it to the list of
@@ -15,13 +15,19 @@
 package metric
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"gvisor.dev/gvisor/pkg/eventchannel"
+	"gvisor.dev/gvisor/pkg/metric/internal/fakeclock"
 	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
 	"gvisor.dev/gvisor/pkg/sync"
 )
@@ -61,6 +67,12 @@ func init() {
 func reset() {
 	initialized = false
 	allMetrics = makeMetricSet()
+	metricsAtLastEmit = metricValues{}
+	emitCycle = 0
+	shutDown = false
+	shutdownDone = make(chan struct{})
+	SetEmitOnStageEnd(false)
+	registrationHooks = nil
 	emitter.Reset()
 }
 
@@ -84,7 +96,8 @@ func TestInitialize(t *testing.T) {
 		t.Fatalf("NewUint64Metric got err %v want nil", err)
 	}
 
-	bucketer := NewExponentialBucketer(3, 2, 0, 1)
+	// Nanosecond units require a bucketer of durations.
+	bucketer := durationBucketer(NewExponentialBucketer(3, 2, 0, 1))
 	field1 := NewField("field1", []string{"foo", "bar"})
 	field2 := NewField("field2", []string{"baz", "quux"})
 	_, err = NewDistributionMetric("/distrib", true, bucketer, pb.MetricMetadata_UNITS_NANOSECONDS, distribDescription, field1, field2)
@@ -155,6 +168,7 @@ func TestInitialize(t *testing.T) {
 				Type:        pb.MetricMetadata_TYPE_DISTRIBUTION,
 				Units:       pb.MetricMetadata_UNITS_NANOSECONDS,
 				Description: distribDescription,
+				Cumulative:  true,
 				Sync:        true,
 				Fields: []*pb.MetricMetadata_Field{
 					{FieldName: "field1", AllowedValues: []string{"foo", "bar"}},
@@ -409,434 +423,2012 @@ func TestEmitMetricUpdate(t *testing.T) {
 	}
 }
 
-func TestEmitMetricUpdateWithFields(t *testing.T) {
-	defer reset()
+// panicEmitter is an eventchannel.Emitter that panics when enabled.
+type panicEmitter struct{}
 
-	field := Field{
-		name:          "weirdness_type",
-		allowedValues: []string{"weird1", "weird2"}}
+// Emit implements eventchannel.Emitter.Emit.
+func (panicEmitter) Emit(msg proto.Message) (bool, error) {
+	if emitterPanics {
+		panic("emitter panic")
+	}
+	return false, nil
+}
 
-	counter, err := NewUint64Metric("/weirdness", false, pb.MetricMetadata_UNITS_NONE, counterDescription, field)
+// Close implements eventchannel.Emitter.Close.
+func (panicEmitter) Close() error {
+	return nil
+}
+
+// emitterPanics enables panicEmitter.
+var emitterPanics bool
+
+func init() {
+	eventchannel.AddEmitter(panicEmitter{})
+}
+
+func TestEmitMetricUpdatePanics(t *testing.T) {
+	defer reset()
+
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
 	if err != nil {
-		t.Fatalf("NewUint64Metric got err %v want nil", err)
+		t.Fatalf("NewUint64Metric: %v", err)
 	}
-
+	MustRegisterCustomUint64Metric("/bad", true, false, barDescription, func(...string) uint64 {
+		panic("bad value function")
+	})
 	if err := Initialize(); err != nil {
 		t.Fatalf("Initialize(): %s", err)
 	}
-
-	// Don't care about the registration metrics.
 	emitter.Reset()
-	EmitMetricUpdate()
-
-	// For metrics with fields, we do not emit data unless the value is
-	// incremented.
-	if len(emitter) != 0 {
-		t.Fatalf("EmitMetricUpdate emitted %d events want 0", len(emitter))
-	}
 
-	counter.IncrementBy(4, "weird1")
-	counter.Increment("weird2")
-
-	emitter.Reset()
+	foo.Increment()
 	EmitMetricUpdate()
-
 	if len(emitter) != 1 {
 		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
 	}
-
-	update, ok := emitter[0].(*pb.MetricUpdate)
-	if !ok {
-		t.Fatalf("emitter %v got %T want pb.MetricUpdate", emitter[0], emitter[0])
+	metrics := emitter[0].(*pb.MetricUpdate).GetMetrics()
+	if len(metrics) != 1 || metrics[0].GetName() != "/foo" {
+		t.Errorf("update got metrics %v want only /foo", metrics)
 	}
 
-	if len(update.Metrics) != 2 {
-		t.Errorf("MetricUpdate got %d metrics want 2", len(update.Metrics))
+	// A panicking emitter doesn't keep the update from the other emitters,
+	// whichever order they are called in.
+	emitterPanics = true
+	defer func() { emitterPanics = false }()
+	foo.Increment()
+	emitter.Reset()
+	EmitMetricUpdate()
+	foo.Increment()
+	EmitMetricUpdate()
+	if len(emitter) != 2 {
+		t.Fatalf("EmitMetricUpdate with a panicking emitter emitted %d events want 2", len(emitter))
 	}
-
-	foundWeird1 := false
-	foundWeird2 := false
-	for i := 0; i < len(update.Metrics); i++ {
-		m := update.Metrics[i]
-
-		if m.Name != "/weirdness" {
-			t.Errorf("Metric %+v name got %q want '/weirdness'", m, m.Name)
-		}
-		if len(m.FieldValues) != 1 {
-			t.Errorf("MetricUpdate got %d fields want 1", len(m.FieldValues))
-		}
-
-		switch m.FieldValues[0] {
-		case "weird1":
-			uv, ok := m.Value.(*pb.MetricValue_Uint64Value)
-			if !ok {
-				t.Errorf("%+v: value %v got %T want pb.MetricValue_Uint64Value", m, m.Value, m.Value)
-			}
-			if uv.Uint64Value != 4 {
-				t.Errorf("%v: Value got %v want 4", m, uv.Uint64Value)
-			}
-			foundWeird1 = true
-		case "weird2":
-			uv, ok := m.Value.(*pb.MetricValue_Uint64Value)
-			if !ok {
-				t.Errorf("%+v: value %v got %T want pb.MetricValue_Uint64Value", m, m.Value, m.Value)
-			}
-			if uv.Uint64Value != 1 {
-				t.Errorf("%v: Value got %v want 1", m, uv.Uint64Value)
-			}
-			foundWeird2 = true
+	for i, ev := range emitter {
+		if metrics := ev.(*pb.MetricUpdate).GetMetrics(); len(metrics) != 1 || metrics[0].GetName() != "/foo" {
+			t.Errorf("update %d got metrics %v want only /foo", i, metrics)
 		}
 	}
-
-	if !foundWeird1 {
-		t.Errorf("Field value weird1 not found: %+v", emitter)
-	}
-	if !foundWeird2 {
-		t.Errorf("Field value weird2 not found: %+v", emitter)
-	}
 }
 
-func TestMetricUpdateStageTiming(t *testing.T) {
+func TestEmitLatency(t *testing.T) {
 	defer reset()
 
-	expectedTimings := map[InitStage]struct{ min, max time.Duration }{}
-	measureStage := func(stage InitStage, body func()) {
-		stageStarted := time.Now()
-		endStage := StartStage(stage)
-		bodyStarted := time.Now()
-		body()
-		bodyEnded := time.Now()
-		endStage()
-		stageEnded := time.Now()
+	// emitLatency is registered at init time, so it must be registered again
+	// after reset.
+	allMetrics.distributionMetrics[emitLatency.metadata.GetName()] = emitLatency.DistributionMetric
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	emitter.Reset()
+	EmitMetricUpdate()
 
-		expectedTimings[stage] = struct{ min, max time.Duration }{
-			min: bodyEnded.Sub(bodyStarted),
-			max: stageEnded.Sub(stageStarted),
-		}
+	// The latency of the first emit is reported in the second one.
+	foo.Increment()
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
 	}
-	checkStage := func(got *pb.StageTiming, want InitStage) {
-		if InitStage(got.GetStage()) != want {
-			t.Errorf("%v: got stage %q expected %q", got, got.GetStage(), want)
+	var samples uint64
+	for _, m := range emitter[0].(*pb.MetricUpdate).Metrics {
+		if m.GetName() != "/metric/emit_latency" {
+			continue
 		}
-		timingBounds, found := expectedTimings[want]
-		if !found {
-			t.Fatalf("invalid init stage name %q", want)
-		}
-		started := got.Started.AsTime()
-		ended := got.Ended.AsTime()
-		duration := ended.Sub(started)
-		if duration < timingBounds.min {
-			t.Errorf("stage %v: lasted %v, expected at least %v", want, duration, timingBounds.min)
-		} else if duration > timingBounds.max {
-			t.Errorf("stage %v: lasted %v, expected no more than %v", want, duration, timingBounds.max)
+		for _, s := range m.GetDistributionValue().GetNewSamples() {
+			samples += s
 		}
 	}
+	if samples != 1 {
+		t.Errorf("got %d emit latency samples want 1", samples)
+	}
+}
 
-	// Test that it's legit to go through stages before metric registration.
-	measureStage("before_first_update_1", func() {
-		time.Sleep(100 * time.Millisecond)
-	})
-	measureStage("before_first_update_2", func() {
-		time.Sleep(100 * time.Millisecond)
-	})
+func TestEmitMetricUpdateBucketCountChange(t *testing.T) {
+	defer reset()
 
-	fooMetric, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
 	if err != nil {
-		t.Fatalf("Cannot register /foo: %v", err)
+		t.Fatalf("NewDistributionMetric: %v", err)
 	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	distrib.AddSample(1)
 	emitter.Reset()
-	Initialize()
 	EmitMetricUpdate()
 
-	// We should have gotten the metric registration and the first MetricUpdate.
-	if len(emitter) != 2 {
-		t.Fatalf("emitter has %d messages (%v), expected %d", len(emitter), emitter, 2)
-	}
-
-	if registration, ok := emitter[0].(*pb.MetricRegistration); !ok {
-		t.Errorf("first message is not MetricRegistration: %T / %v", emitter[0], emitter[0])
-	} else if len(registration.Stages) != len(allStages) {
-		t.Errorf("MetricRegistration has %d stages (%v), expected %d (%v)", len(registration.Stages), registration.Stages, len(allStages), allStages)
-	} else {
-		for i := 0; i < len(allStages); i++ {
-			if InitStage(registration.Stages[i]) != allStages[i] {
-				t.Errorf("MetricRegistration.Stages[%d]: got %q want %q", i, registration.Stages[i], allStages[i])
-			}
-		}
+	// Grow the number of buckets, as a bucketer rescaling at runtime would.
+	distrib.samples[""] = []uint64{0, 3, 2, 1, 0, 1}
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
 	}
-
-	if firstUpdate, ok := emitter[1].(*pb.MetricUpdate); !ok {
-		t.Errorf("second message is not MetricUpdate: %T / %v", emitter[1], emitter[1])
-	} else if len(firstUpdate.StageTiming) != 2 {
-		t.Errorf("MetricUpdate has %d stage timings (%v), expected %d", len(firstUpdate.StageTiming), firstUpdate.StageTiming, 2)
-	} else {
-		checkStage(firstUpdate.StageTiming[0], "before_first_update_1")
-		checkStage(firstUpdate.StageTiming[1], "before_first_update_2")
+	want := []uint64{0, 3, 2, 1, 0, 1}
+	if got := emitter[0].(*pb.MetricUpdate).Metrics[0].GetDistributionValue().GetNewSamples(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v want full value %v", got, want)
 	}
 
-	// Ensure re-emitting doesn't cause another event to be sent.
+	// Shrink it again.
+	distrib.samples[""] = []uint64{1, 1, 1, 1}
 	emitter.Reset()
 	EmitMetricUpdate()
-	if len(emitter) != 0 {
-		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 0)
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
 	}
+	want = []uint64{1, 1, 1, 1}
+	if got := emitter[0].(*pb.MetricUpdate).Metrics[0].GetDistributionValue().GetNewSamples(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v want full value %v", got, want)
+	}
+}
 
-	// Generate monitoring data, we should get an event with no stages.
-	fooMetric.Increment()
+func TestEmitMetricUpdateSameTotalSamples(t *testing.T) {
+	defer reset()
+
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	distrib.AddSample(1)
+	distrib.AddSample(1)
 	emitter.Reset()
 	EmitMetricUpdate()
-	if len(emitter) != 1 {
-		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 1)
-	} else if update, ok := emitter[0].(*pb.MetricUpdate); !ok {
-		t.Errorf("message is not MetricUpdate: %T / %v", emitter[1], emitter[1])
-	} else if len(update.StageTiming) != 0 {
-		t.Errorf("unexpected stage timing information: %v", update.StageTiming)
-	}
 
-	// Now generate new stages.
-	measureStage("foo_stage_1", func() {
-		time.Sleep(100 * time.Millisecond)
-	})
-	measureStage("foo_stage_2", func() {
-		time.Sleep(100 * time.Millisecond)
-	})
+	// Move samples between buckets without changing the total number of
+	// samples.
+	distrib.samples[""] = []uint64{0, 1, 1, 0}
 	emitter.Reset()
 	EmitMetricUpdate()
 	if len(emitter) != 1 {
-		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 1)
-	} else if update, ok := emitter[0].(*pb.MetricUpdate); !ok {
-		t.Errorf("message is not MetricUpdate: %T / %v", emitter[1], emitter[1])
-	} else if len(update.Metrics) != 0 {
-		t.Errorf("MetricUpdate has %d metric value changes (%v), expected %d", len(update.Metrics), update.Metrics, 0)
-	} else if len(update.StageTiming) != 2 {
-		t.Errorf("MetricUpdate has %d stages (%v), expected %d", len(update.StageTiming), update.StageTiming, 2)
-	} else {
-		checkStage(update.StageTiming[0], "foo_stage_1")
-		checkStage(update.StageTiming[1], "foo_stage_2")
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	want := []uint64{0, 1, 1, 0}
+	if got := emitter[0].(*pb.MetricUpdate).Metrics[0].GetDistributionValue().GetNewSamples(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v want full value %v", got, want)
 	}
 
-	// Now try generating data for both metrics and stages.
-	fooMetric.Increment()
-	measureStage("last_stage_1", func() {
-		time.Sleep(100 * time.Millisecond)
-	})
-	measureStage("last_stage_2", func() {
-		time.Sleep(100 * time.Millisecond)
-	})
-	fooMetric.Increment()
+	// Nothing changed since.
 	emitter.Reset()
 	EmitMetricUpdate()
-	if len(emitter) != 1 {
-		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 1)
-	} else if update, ok := emitter[0].(*pb.MetricUpdate); !ok {
-		t.Errorf("message is not MetricUpdate: %T / %v", emitter[1], emitter[1])
-	} else if len(update.Metrics) != 1 {
-		t.Errorf("MetricUpdate has %d metric value changes (%v), expected %d", len(update.Metrics), update.Metrics, 1)
-	} else if len(update.StageTiming) != 2 {
-		t.Errorf("MetricUpdate has %d stages (%v), expected %d", len(update.StageTiming), update.StageTiming, 2)
-	} else {
-		checkStage(update.StageTiming[0], "last_stage_1")
-		checkStage(update.StageTiming[1], "last_stage_2")
+	if len(emitter) != 0 {
+		t.Errorf("EmitMetricUpdate emitted %d events want 0: %v", len(emitter), emitter)
 	}
 }
 
-func TestTimerMetric(t *testing.T) {
+func TestDistributionReset(t *testing.T) {
 	defer reset()
-	// This bucketer just has 2 finite buckets: [0, 500ms) and [500ms, 1s).
-	bucketer := NewExponentialBucketer(2, uint64((500 * time.Millisecond).Nanoseconds()), 0, 1)
-	field1 := NewField("field1", []string{"foo", "bar"})
-	field2 := NewField("field2", []string{"baz", "quux"})
-	timer, err := NewTimerMetric("/timer", bucketer, "a timer metric", field1, field2)
+
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
 	if err != nil {
-		t.Fatalf("NewTimerMetric: %v", err)
+		t.Fatalf("NewDistributionMetric: %v", err)
 	}
 	if err := Initialize(); err != nil {
 		t.Fatalf("Initialize(): %s", err)
 	}
-	// Don't care about the registration metrics.
+	for i := 0; i < 5; i++ {
+		distrib.AddSample(1)
+	}
 	emitter.Reset()
+	EmitMetricUpdate()
 
-	// Create timer data.
-	var wg sync.WaitGroup
-	for i := 0; i < 5; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			op := timer.Start("foo")
-			defer op.Finish("quux")
-			time.Sleep(250 * time.Millisecond)
-		}()
+	distrib.Reset()
+	distrib.AddSample(3)
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	got := emitter[0].(*pb.MetricUpdate).Metrics[0].GetDistributionValue()
+	if want := []uint64{0, 0, 1, 0}; !reflect.DeepEqual(got.GetNewSamples(), want) || !got.GetWasReset() {
+		t.Errorf("got %v want samples %v with was_reset", got, want)
+	}
+
+	// Subsequent updates are deltas again.
+	distrib.AddSample(3)
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	got = emitter[0].(*pb.MetricUpdate).Metrics[0].GetDistributionValue()
+	if want := []uint64{0, 0, 1, 0}; !reflect.DeepEqual(got.GetNewSamples(), want) || got.GetWasReset() {
+		t.Errorf("got %v want samples %v without was_reset", got, want)
 	}
+
+	// Resetting with more samples in every bucket than before the reset must
+	// still be visible.
+	distrib.Reset()
 	for i := 0; i < 3; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			op := timer.Start()
-			defer op.Finish("foo", "quux")
-			time.Sleep(750 * time.Millisecond)
-		}()
+		distrib.AddSample(3)
 	}
-	wg.Wait()
+	emitter.Reset()
 	EmitMetricUpdate()
 	if len(emitter) != 1 {
-		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 1)
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
 	}
-	m := emitter[0].(*pb.MetricUpdate).Metrics[0]
-	wantFields := []string{"foo", "quux"}
-	if !reflect.DeepEqual(m.GetFieldValues(), wantFields) {
-		t.Errorf("%+v: got fields %v want %v", m, m.GetFieldValues(), wantFields)
+	got = emitter[0].(*pb.MetricUpdate).Metrics[0].GetDistributionValue()
+	if want := []uint64{0, 0, 3, 0}; !reflect.DeepEqual(got.GetNewSamples(), want) || !got.GetWasReset() {
+		t.Errorf("got %v want samples %v with was_reset", got, want)
 	}
-	dv, ok := m.Value.(*pb.MetricValue_DistributionValue)
-	if !ok {
-		t.Fatalf("%+v: want pb.MetricValue_DistributionValue", m)
+
+	// Resetting to no samples at all is visible too.
+	distrib.Reset()
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
 	}
-	samples := dv.DistributionValue.GetNewSamples()
-	if len(samples) != 4 {
-		t.Fatalf("%+v: got %d buckets, want %d", dv.DistributionValue, len(samples), 4)
+	got = emitter[0].(*pb.MetricUpdate).Metrics[0].GetDistributionValue()
+	if want := []uint64{0, 0, 0, 0}; !reflect.DeepEqual(got.GetNewSamples(), want) || !got.GetWasReset() {
+		t.Errorf("got %v want samples %v with was_reset", got, want)
 	}
-	wantSamples := []uint64{0, 5, 3, 0}
-	for i, s := range samples {
-		if s != wantSamples[i] {
-			t.Errorf("%+v: sample %d: got %d want %d", dv.DistributionValue, i, s, wantSamples[i])
+}
+
+func TestDistributionResetField(t *testing.T) {
+	defer reset()
+
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	distrib.AddSample(1, "a")
+	distrib.AddSample(1, "a")
+	distrib.AddSample(1, "b")
+	emitter.Reset()
+	EmitMetricUpdate()
+
+	// Only field value "a" is reset, while "b" keeps accumulating.
+	distrib.ResetField("a")
+	distrib.AddSample(3, "a")
+	distrib.AddSample(3, "b")
+	if got, want := snapshotDistribution(distrib.samples["b"]), []uint64{0, 1, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("samples of b got %v want %v", got, want)
+	}
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	got := make(map[string]*pb.Samples)
+	for _, v := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+		got[v.GetFieldValues()[0]] = v.GetDistributionValue()
+	}
+	want := map[string]*pb.Samples{
+		"a": {NewSamples: []uint64{0, 0, 1, 0}, WasReset: true},
+		"b": {NewSamples: []uint64{0, 0, 1, 0}},
+	}
+	for fieldValue, w := range want {
+		if !proto.Equal(got[fieldValue], w) {
+			t.Errorf("field value %s got %v want %v", fieldValue, got[fieldValue], w)
 		}
 	}
+
+	// Subsequent updates are deltas again.
+	distrib.AddSample(3, "a")
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	metrics := emitter[0].(*pb.MetricUpdate).GetMetrics()
+	if len(metrics) != 1 || !proto.Equal(metrics[0].GetDistributionValue(), &pb.Samples{NewSamples: []uint64{0, 0, 1, 0}}) {
+		t.Errorf("got %v want delta of a only", metrics)
+	}
 }
 
-func TestBucketer(t *testing.T) {
-	for _, test := range []struct {
-		name                    string
-		bucketer                Bucketer
-		minSample               int64
-		maxSample               int64
-		step                    int64
-		firstFewLowerBounds     []int64
-		successiveBucketSamples []int64
-	}{
-		{
-			name:                "static-sized buckets",
-			bucketer:            NewExponentialBucketer(10, 10, 0, 1),
-			minSample:           -5,
-			maxSample:           105,
-			firstFewLowerBounds: []int64{0, 10, 20, 30, 40, 50},
-		},
-		{
-			name:      "exponential buckets",
-			bucketer:  NewExponentialBucketer(10, 10, 2, 1.5),
-			minSample: -5,
-			maxSample: int64(20 * math.Pow(1.5, 12)),
-			firstFewLowerBounds: []int64{
-				0,
-				10 + 2,
-				20 + int64(2*1.5),
-				30 + int64(math.Floor(2*1.5*1.5)),
-				40 + int64(math.Floor(2*1.5*1.5*1.5)),
-				50 + int64(math.Floor(2*1.5*1.5*1.5*1.5)),
-			},
-		},
-		{
-			name:      "timer buckets",
-			bucketer:  NewDurationBucketer(8, time.Second, time.Minute),
-			minSample: 0,
-			maxSample: (5 * time.Minute).Nanoseconds(),
-			step:      (500 * time.Millisecond).Nanoseconds(),
-			successiveBucketSamples: []int64{
-				// Roughly exponential successive durations:
-				(500 * time.Millisecond).Nanoseconds(),
-				(1200 * time.Millisecond).Nanoseconds(),
-				(2500 * time.Millisecond).Nanoseconds(),
-				(5 * time.Second).Nanoseconds(),
-				(15 * time.Second).Nanoseconds(),
-				(35 * time.Second).Nanoseconds(),
-				(75 * time.Second).Nanoseconds(),
-				(3 * time.Minute).Nanoseconds(),
-				(7 * time.Minute).Nanoseconds(),
-			},
-		},
-	} {
-		t.Run(test.name, func(t *testing.T) {
-			numFiniteBuckets := test.bucketer.NumFiniteBuckets()
-			t.Logf("Underflow bucket has bounds (-inf, %d)", test.bucketer.LowerBound(0))
-			for b := 0; b < numFiniteBuckets; b++ {
-				t.Logf("Bucket %d has bounds [%d, %d)", b, test.bucketer.LowerBound(b), test.bucketer.LowerBound(b+1))
-			}
-			t.Logf("Overflow bucket has bounds [%d, +inf)", test.bucketer.LowerBound(numFiniteBuckets))
-			testAround := func(bound int64, bucketIndex int) {
-				for sample := bound - 2; sample <= bound+2; sample++ {
-					gotIndex := test.bucketer.BucketIndex(sample)
-					if sample < bound && gotIndex != bucketIndex-1 || sample >= bound && gotIndex != bucketIndex {
-						t.Errorf("LowerBound(%d) = %d, yet BucketIndex(%d) = %d", bucketIndex, bound, sample, gotIndex)
-					}
-				}
-			}
-			step := test.step
-			if step == 0 {
-				step = 1
-			}
-			for sample := test.minSample; sample <= test.maxSample; sample += step {
-				bucket := test.bucketer.BucketIndex(sample)
-				if bucket == -1 {
-					lowestBound := test.bucketer.LowerBound(0)
-					if sample >= lowestBound {
-						t.Errorf("sample %d: got bucket %d but lowest bound %d", sample, bucket, lowestBound)
-					}
-					testAround(lowestBound, 0)
-				} else if bucket > numFiniteBuckets {
-					t.Errorf("sample %d: got bucket with 0-based index %d but bucketer supposedly only has %d buckets", sample, bucket, numFiniteBuckets)
-				} else if bucket == numFiniteBuckets {
-					lastBucketBound := test.bucketer.LowerBound(bucket)
-					if sample < lastBucketBound {
-						t.Errorf("sample %d: got bucket %d but it has lower bound %d", sample, bucket, lastBucketBound)
-					}
-					testAround(lastBucketBound, bucket)
-				} else {
-					lowerBound := test.bucketer.LowerBound(bucket)
-					upperBound := test.bucketer.LowerBound(bucket + 1)
-					if upperBound <= lowerBound {
-						t.Errorf("sample %d: got bucket %d, upperbound %d <= lowerbound %d", sample, bucket, upperBound, lowerBound)
-					}
-					if sample < lowerBound || sample >= upperBound {
-						t.Errorf("sample %d: got bucket %d which has range [%d, %d)", sample, bucket, lowerBound, upperBound)
-					}
-					testAround(lowerBound, bucket)
-					testAround(upperBound, bucket+1)
-				}
-			}
-			for bi, want := range test.firstFewLowerBounds {
-				if got := test.bucketer.LowerBound(bi); got != want {
-					t.Errorf("bucket %d has lower bound %d, want %d", bi, got, want)
-				}
-			}
-			previousBucket := -1
-			for i, sample := range test.successiveBucketSamples {
-				gotBucket := test.bucketer.BucketIndex(sample)
-				if gotBucket != previousBucket+1 {
-					t.Errorf("successive-bucket sample #%d (%d) fell in bucket %d whereas previous sample fell in bucket %d", i, sample, gotBucket, previousBucket)
-				}
-				previousBucket = gotBucket
-			}
-		})
+func TestNonCumulativeDistribution(t *testing.T) {
+	defer reset()
+
+	distrib, err := NewNonCumulativeDistributionMetric("/windowed", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewNonCumulativeDistributionMetric: %v", err)
+	}
+	if _, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription); err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	for _, m := range emitter[0].(*pb.MetricRegistration).GetMetrics() {
+		if want := m.GetName() == "/distrib"; m.GetCumulative() != want {
+			t.Errorf("%s: got cumulative %t want %t", m.GetName(), m.GetCumulative(), want)
+		}
+	}
+
+	// emit emits a metric update and returns the emitted samples of the
+	// non-cumulative distribution, which must have was_reset set.
+	emit := func() []uint64 {
+		t.Helper()
+		emitter.Reset()
+		EmitMetricUpdate()
+		if len(emitter) == 0 {
+			return nil
+		}
+		metrics := emitter[0].(*pb.MetricUpdate).GetMetrics()
+		if len(metrics) != 1 {
+			t.Fatalf("EmitMetricUpdate emitted %v want one metric", metrics)
+		}
+		got := metrics[0].GetDistributionValue()
+		if !got.GetWasReset() {
+			t.Errorf("got %v want was_reset", got)
+		}
+		return got.GetNewSamples()
+	}
+
+	distrib.AddSample(1)
+	distrib.AddSample(3)
+	distrib.AddSample(3)
+	if got, want := emit(), []uint64{0, 1, 2, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v want %v", got, want)
+	}
+	if got := emit(); got != nil {
+		t.Errorf("got samples %v for unchanged distribution want none", got)
+	}
+
+	// Samples leaving the window decrease their bucket. Absolute values are
+	// emitted, rather than an underflowed delta.
+	atomic.StoreUint64(&distrib.samples[""][2], 1)
+	distrib.AddSample(5)
+	if got, want := emit(), []uint64{0, 1, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v want %v", got, want)
+	}
+
+	// Samples decreasing to zero are emitted too.
+	for i := range distrib.samples[""] {
+		atomic.StoreUint64(&distrib.samples[""][i], 0)
+	}
+	if got, want := emit(), []uint64{0, 0, 0, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v want %v", got, want)
 	}
 }
 
-func TestBucketerPanics(t *testing.T) {
-	for name, fn := range map[string]func(){
-		"NewExponentialBucketer @ 0": func() {
-			NewExponentialBucketer(0, 2, 0, 1)
-		},
-		"NewExponentialBucketer @ 120": func() {
-			NewExponentialBucketer(120, 2, 0, 1)
-		},
-		"NewDurationBucketer @ 2": func() {
-			NewDurationBucketer(2, time.Second, time.Minute)
-		},
+func TestEmitMetricUpdateFullValue(t *testing.T) {
+	defer reset()
+
+	full, err := NewDistributionMetric("/full", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	delta, err := NewDistributionMetric("/delta", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	counter, err := NewUint64Metric("/counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if err := SetFullValue("/full", "/counter"); err != nil {
+		t.Fatalf("SetFullValue: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	for _, m := range emitter[0].(*pb.MetricRegistration).GetMetrics() {
+		if got, want := m.GetFullValue(), m.GetName() != "/delta"; got != want {
+			t.Errorf("%s: got full_value %v want %v", m.GetName(), got, want)
+		}
+	}
+
+	full.AddSample(1, "a")
+	delta.AddSample(1)
+	counter.Increment()
+	emitter.Reset()
+	EmitMetricUpdate()
+	full.AddSample(3, "a")
+	delta.AddSample(3)
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	got := make(map[string]*pb.MetricValue)
+	for _, m := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+		got[m.GetName()+fmt.Sprint(m.GetFieldValues())] = m
+	}
+	for key, want := range map[string][]uint64{
+		"/full[a]": {0, 1, 1, 0},
+		"/full[b]": {0, 0, 0, 0},
+		"/delta[]": {0, 0, 1, 0},
 	} {
-		t.Run(name, func(t *testing.T) {
-			var recovered interface{}
-			func() {
-				defer func() {
-					recovered = recover()
-				}()
-				fn()
+		if m := got[key]; m == nil {
+			t.Errorf("%s not found in %v", key, emitter[0])
+		} else if samples := m.GetDistributionValue().GetNewSamples(); !reflect.DeepEqual(samples, want) {
+			t.Errorf("%s: got samples %v want %v", key, samples, want)
+		}
+	}
+	if m := got["/counter[]"]; m == nil || m.GetUint64Value() != 1 {
+		t.Errorf("/counter: got %v want unchanged value 1", m)
+	}
+}
+
+func TestTrimZeroBuckets(t *testing.T) {
+	defer reset()
+
+	bucketer := NewDurationBucketer(30, time.Microsecond, time.Hour)
+	trimmed, err := NewDistributionMetric("/trimmed", false, bucketer, pb.MetricMetadata_UNITS_NANOSECONDS, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	full, err := NewDistributionMetric("/full", false, bucketer, pb.MetricMetadata_UNITS_NANOSECONDS, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if err := SetTrimZeroBuckets("/trimmed"); err != nil {
+		t.Fatalf("SetTrimZeroBuckets: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+
+	// A typical latency distribution under normal load: many samples between
+	// 10us and 1ms, and none in the highest buckets.
+	for i := 0; i < 1000; i++ {
+		d := int64(10*time.Microsecond) + int64(i)*int64(time.Microsecond)
+		trimmed.AddSample(d)
+		full.AddSample(d)
+	}
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	samples := make(map[string]*pb.MetricValue)
+	for _, m := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+		samples[m.GetName()] = m
+	}
+	fullSamples := samples["/full"].GetDistributionValue().GetNewSamples()
+	trimmedSamples := samples["/trimmed"].GetDistributionValue().GetNewSamples()
+	if len(fullSamples) != full.NumBuckets() {
+		t.Errorf("/full got %d buckets want %d", len(fullSamples), full.NumBuckets())
+	}
+	if len(trimmedSamples) == 0 || trimmedSamples[len(trimmedSamples)-1] == 0 {
+		t.Errorf("/trimmed got samples %v want no trailing zero bucket", trimmedSamples)
+	}
+	// Zero-filling the trimmed samples gives back the full samples.
+	zeroFilled := append(append([]uint64(nil), trimmedSamples...), make([]uint64, len(fullSamples)-len(trimmedSamples))...)
+	if !reflect.DeepEqual(zeroFilled, fullSamples) {
+		t.Errorf("zero-filled /trimmed samples got %v want %v", zeroFilled, fullSamples)
+	}
+	fullSize, trimmedSize := proto.Size(samples["/full"]), proto.Size(samples["/trimmed"])
+	t.Logf("Distribution value size: %d bytes full, %d bytes trimmed", fullSize, trimmedSize)
+	if trimmedSize >= fullSize {
+		t.Errorf("trimmed distribution value is %d bytes, want less than %d", trimmedSize, fullSize)
+	}
+}
+
+func TestEmitMetricUpdateWithFields(t *testing.T) {
+	defer reset()
+
+	field := Field{
+		name:          "weirdness_type",
+		allowedValues: []string{"weird1", "weird2"}}
+
+	counter, err := NewUint64Metric("/weirdness", false, pb.MetricMetadata_UNITS_NONE, counterDescription, field)
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+
+	// Don't care about the registration metrics.
+	emitter.Reset()
+	EmitMetricUpdate()
+
+	// For metrics with fields, we do not emit data unless the value is
+	// incremented.
+	if len(emitter) != 0 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 0", len(emitter))
+	}
+
+	counter.IncrementBy(4, "weird1")
+	counter.Increment("weird2")
+
+	emitter.Reset()
+	EmitMetricUpdate()
+
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+
+	update, ok := emitter[0].(*pb.MetricUpdate)
+	if !ok {
+		t.Fatalf("emitter %v got %T want pb.MetricUpdate", emitter[0], emitter[0])
+	}
+
+	if len(update.Metrics) != 2 {
+		t.Errorf("MetricUpdate got %d metrics want 2", len(update.Metrics))
+	}
+
+	foundWeird1 := false
+	foundWeird2 := false
+	for i := 0; i < len(update.Metrics); i++ {
+		m := update.Metrics[i]
+
+		if m.Name != "/weirdness" {
+			t.Errorf("Metric %+v name got %q want '/weirdness'", m, m.Name)
+		}
+		if len(m.FieldValues) != 1 {
+			t.Errorf("MetricUpdate got %d fields want 1", len(m.FieldValues))
+		}
+
+		switch m.FieldValues[0] {
+		case "weird1":
+			uv, ok := m.Value.(*pb.MetricValue_Uint64Value)
+			if !ok {
+				t.Errorf("%+v: value %v got %T want pb.MetricValue_Uint64Value", m, m.Value, m.Value)
+			}
+			if uv.Uint64Value != 4 {
+				t.Errorf("%v: Value got %v want 4", m, uv.Uint64Value)
+			}
+			foundWeird1 = true
+		case "weird2":
+			uv, ok := m.Value.(*pb.MetricValue_Uint64Value)
+			if !ok {
+				t.Errorf("%+v: value %v got %T want pb.MetricValue_Uint64Value", m, m.Value, m.Value)
+			}
+			if uv.Uint64Value != 1 {
+				t.Errorf("%v: Value got %v want 1", m, uv.Uint64Value)
+			}
+			foundWeird2 = true
+		}
+	}
+
+	if !foundWeird1 {
+		t.Errorf("Field value weird1 not found: %+v", emitter)
+	}
+	if !foundWeird2 {
+		t.Errorf("Field value weird2 not found: %+v", emitter)
+	}
+}
+
+func TestIncrementMulti(t *testing.T) {
+	defer reset()
+
+	m, err := NewUint64Metric("/packets", false, pb.MetricMetadata_UNITS_NONE, fooDescription, NewField("category", []string{"tcp", "ipv4", "ipv6"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	m.IncrementMulti(2, []string{"tcp"}, []string{"ipv4"})
+	m.IncrementMulti(1, []string{"tcp"}, []string{"ipv6"}, []string{"tcp"})
+	for field, want := range map[string]uint64{"tcp": 4, "ipv4": 2, "ipv6": 1} {
+		if got := m.Value(field); got != want {
+			t.Errorf("Value(%s) got %d want %d", field, got, want)
+		}
+	}
+
+	// Invalid field values panic before any increment.
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("IncrementMulti with invalid field value did not panic")
+			}
+		}()
+		m.IncrementMulti(1, []string{"tcp"}, []string{"udp"})
+	}()
+	if got := m.Value("tcp"); got != 4 {
+		t.Errorf("Value(tcp) after failed IncrementMulti got %d want 4", got)
+	}
+
+	noFields, err := NewUint64Metric("/events", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	noFields.IncrementMulti(3, nil, nil)
+	if got := noFields.Value(); got != 6 {
+		t.Errorf("Value() got %d want 6", got)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	defer reset()
+
+	var gauge, fieldGauge uint64
+	MustRegisterGaugeFunc("/gauge", fooDescription, func(...string) uint64 { return gauge })
+	MustRegisterGaugeFunc("/field_gauge", barDescription, func(fieldValues ...string) uint64 {
+		if fieldValues[0] == "weird1" {
+			return fieldGauge
+		}
+		return 0
+	}, NewField("weirdness_type", []string{"weird1", "weird2"}))
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	for _, m := range emitter[0].(*pb.MetricRegistration).Metrics {
+		if m.GetCumulative() {
+			t.Errorf("%s: got cumulative metric want non-cumulative", m.GetName())
+		}
+	}
+
+	for i, test := range []struct {
+		gauge      uint64
+		fieldGauge uint64
+		want       map[string]uint64
+	}{
+		{gauge: 5, fieldGauge: 3, want: map[string]uint64{"/gauge": 5, "/field_gauge": 3}},
+		{gauge: 2, fieldGauge: 3, want: map[string]uint64{"/gauge": 2}},
+		{gauge: 2, fieldGauge: 0, want: map[string]uint64{"/field_gauge": 0}},
+		{gauge: 0, fieldGauge: 0, want: map[string]uint64{"/gauge": 0}},
+	} {
+		gauge, fieldGauge = test.gauge, test.fieldGauge
+		emitter.Reset()
+		EmitMetricUpdate()
+		if len(emitter) != 1 {
+			t.Fatalf("update %d: EmitMetricUpdate emitted %d events want 1", i, len(emitter))
+		}
+		got := make(map[string]uint64)
+		for _, m := range emitter[0].(*pb.MetricUpdate).Metrics {
+			got[m.GetName()] = m.GetUint64Value()
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("update %d: got values %v want %v", i, got, test.want)
+		}
+	}
+}
+
+func TestMetricUpdateStageTiming(t *testing.T) {
+	defer reset()
+
+	expectedTimings := map[InitStage]struct{ min, max time.Duration }{}
+	measureStage := func(stage InitStage, body func()) {
+		stageStarted := time.Now()
+		endStage := StartStage(stage)
+		bodyStarted := time.Now()
+		body()
+		bodyEnded := time.Now()
+		endStage()
+		stageEnded := time.Now()
+
+		expectedTimings[stage] = struct{ min, max time.Duration }{
+			min: bodyEnded.Sub(bodyStarted),
+			max: stageEnded.Sub(stageStarted),
+		}
+	}
+	checkStage := func(got *pb.StageTiming, want InitStage) {
+		if InitStage(got.GetStage()) != want {
+			t.Errorf("%v: got stage %q expected %q", got, got.GetStage(), want)
+		}
+		timingBounds, found := expectedTimings[want]
+		if !found {
+			t.Fatalf("invalid init stage name %q", want)
+		}
+		started := got.Started.AsTime()
+		ended := got.Ended.AsTime()
+		duration := ended.Sub(started)
+		if duration < timingBounds.min {
+			t.Errorf("stage %v: lasted %v, expected at least %v", want, duration, timingBounds.min)
+		} else if duration > timingBounds.max {
+			t.Errorf("stage %v: lasted %v, expected no more than %v", want, duration, timingBounds.max)
+		}
+	}
+
+	// Test that it's legit to go through stages before metric registration.
+	measureStage("before_first_update_1", func() {
+		time.Sleep(100 * time.Millisecond)
+	})
+	measureStage("before_first_update_2", func() {
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	fooMetric, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("Cannot register /foo: %v", err)
+	}
+	emitter.Reset()
+	Initialize()
+	EmitMetricUpdate()
+
+	// We should have gotten the metric registration and the first MetricUpdate.
+	if len(emitter) != 2 {
+		t.Fatalf("emitter has %d messages (%v), expected %d", len(emitter), emitter, 2)
+	}
+
+	if registration, ok := emitter[0].(*pb.MetricRegistration); !ok {
+		t.Errorf("first message is not MetricRegistration: %T / %v", emitter[0], emitter[0])
+	} else if len(registration.Stages) != len(allStages) {
+		t.Errorf("MetricRegistration has %d stages (%v), expected %d (%v)", len(registration.Stages), registration.Stages, len(allStages), allStages)
+	} else {
+		for i := 0; i < len(allStages); i++ {
+			if InitStage(registration.Stages[i]) != allStages[i] {
+				t.Errorf("MetricRegistration.Stages[%d]: got %q want %q", i, registration.Stages[i], allStages[i])
+			}
+		}
+	}
+
+	if firstUpdate, ok := emitter[1].(*pb.MetricUpdate); !ok {
+		t.Errorf("second message is not MetricUpdate: %T / %v", emitter[1], emitter[1])
+	} else if len(firstUpdate.StageTiming) != 2 {
+		t.Errorf("MetricUpdate has %d stage timings (%v), expected %d", len(firstUpdate.StageTiming), firstUpdate.StageTiming, 2)
+	} else {
+		checkStage(firstUpdate.StageTiming[0], "before_first_update_1")
+		checkStage(firstUpdate.StageTiming[1], "before_first_update_2")
+	}
+
+	// Ensure re-emitting doesn't cause another event to be sent.
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 0 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 0)
+	}
+
+	// Generate monitoring data, we should get an event with no stages.
+	fooMetric.Increment()
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 1)
+	} else if update, ok := emitter[0].(*pb.MetricUpdate); !ok {
+		t.Errorf("message is not MetricUpdate: %T / %v", emitter[1], emitter[1])
+	} else if len(update.StageTiming) != 0 {
+		t.Errorf("unexpected stage timing information: %v", update.StageTiming)
+	}
+
+	// Now generate new stages.
+	measureStage("foo_stage_1", func() {
+		time.Sleep(100 * time.Millisecond)
+	})
+	measureStage("foo_stage_2", func() {
+		time.Sleep(100 * time.Millisecond)
+	})
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 1)
+	} else if update, ok := emitter[0].(*pb.MetricUpdate); !ok {
+		t.Errorf("message is not MetricUpdate: %T / %v", emitter[1], emitter[1])
+	} else if len(update.Metrics) != 0 {
+		t.Errorf("MetricUpdate has %d metric value changes (%v), expected %d", len(update.Metrics), update.Metrics, 0)
+	} else if len(update.StageTiming) != 2 {
+		t.Errorf("MetricUpdate has %d stages (%v), expected %d", len(update.StageTiming), update.StageTiming, 2)
+	} else {
+		checkStage(update.StageTiming[0], "foo_stage_1")
+		checkStage(update.StageTiming[1], "foo_stage_2")
+	}
+
+	// Now try generating data for both metrics and stages.
+	fooMetric.Increment()
+	measureStage("last_stage_1", func() {
+		time.Sleep(100 * time.Millisecond)
+	})
+	measureStage("last_stage_2", func() {
+		time.Sleep(100 * time.Millisecond)
+	})
+	fooMetric.Increment()
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 1)
+	} else if update, ok := emitter[0].(*pb.MetricUpdate); !ok {
+		t.Errorf("message is not MetricUpdate: %T / %v", emitter[1], emitter[1])
+	} else if len(update.Metrics) != 1 {
+		t.Errorf("MetricUpdate has %d metric value changes (%v), expected %d", len(update.Metrics), update.Metrics, 1)
+	} else if len(update.StageTiming) != 2 {
+		t.Errorf("MetricUpdate has %d stages (%v), expected %d", len(update.StageTiming), update.StageTiming, 2)
+	} else {
+		checkStage(update.StageTiming[0], "last_stage_1")
+		checkStage(update.StageTiming[1], "last_stage_2")
+	}
+}
+
+func TestMetricUpdateStageTimingFakeClock(t *testing.T) {
+	defer reset()
+
+	if !fakeclock.Enabled {
+		t.Skip("requires the metric_fakeclock tag")
+	}
+	fakeNow := time.Unix(1000, 0)
+	fakeclock.Set(fakeNow)
+	defer fakeclock.Clear()
+	advance := func(d time.Duration) {
+		fakeNow = fakeNow.Add(d)
+		fakeclock.Set(fakeNow)
+	}
+
+	endStage := StartStage("stage_1")
+	advance(3 * time.Second)
+	endStage()
+	advance(time.Second)
+	StartStage("stage_2")
+	advance(5 * time.Millisecond)
+	// Starting a new stage implicitly ends the previous one.
+	endStage = StartStage("stage_3")
+	advance(7 * time.Nanosecond)
+	endStage()
+
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	update := emitter[0].(*pb.MetricUpdate)
+	want := []struct {
+		stage   InitStage
+		started time.Time
+		ended   time.Time
+	}{
+		{"stage_1", time.Unix(1000, 0), time.Unix(1003, 0)},
+		{"stage_2", time.Unix(1004, 0), time.Unix(1004, int64(5*time.Millisecond))},
+		{"stage_3", time.Unix(1004, int64(5*time.Millisecond)), time.Unix(1004, int64(5*time.Millisecond+7))},
+	}
+	if len(update.StageTiming) != len(want) {
+		t.Fatalf("got %d stage timings (%v) want %d", len(update.StageTiming), update.StageTiming, len(want))
+	}
+	for i, w := range want {
+		got := update.StageTiming[i]
+		if InitStage(got.GetStage()) != w.stage {
+			t.Errorf("stage %d: got %q want %q", i, got.GetStage(), w.stage)
+		}
+		if !got.GetStarted().AsTime().Equal(w.started) {
+			t.Errorf("stage %s: got start time %v want %v", w.stage, got.GetStarted().AsTime(), w.started)
+		}
+		if !got.GetEnded().AsTime().Equal(w.ended) {
+			t.Errorf("stage %s: got end time %v want %v", w.stage, got.GetEnded().AsTime(), w.ended)
+		}
+	}
+}
+
+// stageEmitter is an eventchannel.Emitter that starts a stage whenever it
+// emits a message, to check that stage-end emits don't recurse.
+type stageEmitter struct{}
+
+// Emit implements eventchannel.Emitter.Emit.
+func (stageEmitter) Emit(msg proto.Message) (bool, error) {
+	if recursiveStages {
+		StartStage("recursive")()
+	}
+	return false, nil
+}
+
+// Close implements eventchannel.Emitter.Close.
+func (stageEmitter) Close() error {
+	return nil
+}
+
+// recursiveStages enables stageEmitter.
+var recursiveStages bool
+
+func init() {
+	eventchannel.AddEmitter(stageEmitter{})
+}
+
+func TestEmitOnStageEnd(t *testing.T) {
+	defer reset()
+
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	EmitMetricUpdate()
+	emitter.Reset()
+
+	// Stage ends are not emitted by default.
+	StartStage("stage_1")()
+	if len(emitter) != 0 {
+		t.Fatalf("ending a stage emitted %d events want 0", len(emitter))
+	}
+
+	SetEmitOnStageEnd(true)
+	end := StartStage("stage_2")
+	if len(emitter) != 0 {
+		t.Fatalf("starting a stage emitted %d events want 0", len(emitter))
+	}
+	foo.Increment()
+	end()
+	foo.Increment()
+	// Starting a stage implicitly ends the previous one.
+	StartStage("stage_3")
+	end = StartStage("stage_4")
+	if len(emitter) != 2 {
+		t.Fatalf("ending stages emitted %d events want 2", len(emitter))
+	}
+	wantStages := [][]string{{"stage_1", "stage_2"}, {"stage_3"}}
+	for i, msg := range emitter {
+		update := msg.(*pb.MetricUpdate)
+		if len(update.GetMetrics()) != 1 || update.GetMetrics()[0].GetUint64Value() != uint64(i+1) {
+			t.Errorf("update %d: got metrics %v want /foo=%d", i, update.GetMetrics(), i+1)
+		}
+		var stages []string
+		for _, st := range update.GetStageTiming() {
+			stages = append(stages, st.GetStage())
+		}
+		if !reflect.DeepEqual(stages, wantStages[i]) {
+			t.Errorf("update %d: got stages %v want %v", i, stages, wantStages[i])
+		}
+	}
+
+	// Stages ending while emitting don't emit recursively.
+	emitter.Reset()
+	recursiveStages = true
+	defer func() { recursiveStages = false }()
+	end()
+	if len(emitter) != 1 {
+		t.Fatalf("ending a stage with a recursive emitter emitted %d events want 1", len(emitter))
+	}
+}
+
+func TestCurrentStage(t *testing.T) {
+	defer reset()
+
+	if stage, _, ok := CurrentStage(); ok {
+		t.Errorf("CurrentStage() got %q before any stage started, want none", stage)
+	}
+	before := time.Now()
+	endStage := StartStage("stage_1")
+	after := time.Now()
+	stage, started, ok := CurrentStage()
+	if !ok || stage != "stage_1" || started.Before(before) || started.After(after) {
+		t.Errorf("CurrentStage() got (%q, %v, %t) want (%q, between %v and %v, true)", stage, started, ok, "stage_1", before, after)
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	s := GetSnapshot()
+	if s.CurrentStage != "stage_1" || !s.CurrentStageStarted.Equal(started) {
+		t.Errorf("snapshot current stage got (%q, %v) want (%q, %v)", s.CurrentStage, s.CurrentStageStarted, "stage_1", started)
+	}
+
+	endStage()
+	if stage, _, ok := CurrentStage(); ok {
+		t.Errorf("CurrentStage() got %q after the stage ended, want none", stage)
+	}
+	if s := GetSnapshot(); s.CurrentStage != "" || !s.CurrentStageStarted.IsZero() {
+		t.Errorf("snapshot current stage got (%q, %v) after the stage ended, want none", s.CurrentStage, s.CurrentStageStarted)
+	}
+}
+
+func TestResetStages(t *testing.T) {
+	defer reset()
+
+	stageNames := func(stages []*pb.StageTiming) []string {
+		var names []string
+		for _, s := range stages {
+			names = append(names, s.GetStage())
+		}
+		return names
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	StartStage("first_1")()
+	StartStage("first_2")()
+	emitter.Reset()
+	EmitMetricUpdate()
+	if got, want := stageNames(emitter[0].(*pb.MetricUpdate).GetStageTiming()), []string{"first_1", "first_2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first update got stages %v want %v", got, want)
+	}
+
+	StartStage("first_3")()
+	if got, want := stageNames(ResetStages()), []string{"first_1", "first_2", "first_3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ResetStages() got %v want %v", got, want)
+	}
+	// A single new stage must be emitted, even though fewer stages are
+	// finished than at the last emit.
+	StartStage("second_1")()
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	if got, want := stageNames(emitter[0].(*pb.MetricUpdate).GetStageTiming()), []string{"second_1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("update after reset got stages %v want %v", got, want)
+	}
+
+	StartStage("second_2")()
+	emitter.Reset()
+	EmitMetricUpdate()
+	if got, want := stageNames(emitter[0].(*pb.MetricUpdate).GetStageTiming()), []string{"second_2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second update after reset got stages %v want %v", got, want)
+	}
+}
+
+func TestTimerMetric(t *testing.T) {
+	defer reset()
+	// This bucketer just has 2 finite buckets: [0, 500ms) and [500ms, 1s).
+	bucketer := NewExponentialBucketer(2, uint64((500 * time.Millisecond).Nanoseconds()), 0, 1)
+	field1 := NewField("field1", []string{"foo", "bar"})
+	field2 := NewField("field2", []string{"baz", "quux"})
+	timer, err := NewTimerMetric("/timer", bucketer, "a timer metric", field1, field2)
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	// Don't care about the registration metrics.
+	emitter.Reset()
+
+	// Create timer data.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			op := timer.Start("foo")
+			defer op.Finish("quux")
+			time.Sleep(250 * time.Millisecond)
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			op := timer.Start()
+			defer op.Finish("foo", "quux")
+			time.Sleep(750 * time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want %d", len(emitter), 1)
+	}
+	m := emitter[0].(*pb.MetricUpdate).Metrics[0]
+	wantFields := []string{"foo", "quux"}
+	if !reflect.DeepEqual(m.GetFieldValues(), wantFields) {
+		t.Errorf("%+v: got fields %v want %v", m, m.GetFieldValues(), wantFields)
+	}
+	dv, ok := m.Value.(*pb.MetricValue_DistributionValue)
+	if !ok {
+		t.Fatalf("%+v: want pb.MetricValue_DistributionValue", m)
+	}
+	samples := dv.DistributionValue.GetNewSamples()
+	if len(samples) != 4 {
+		t.Fatalf("%+v: got %d buckets, want %d", dv.DistributionValue, len(samples), 4)
+	}
+	wantSamples := []uint64{0, 5, 3, 0}
+	for i, s := range samples {
+		if s != wantSamples[i] {
+			t.Errorf("%+v: sample %d: got %d want %d", dv.DistributionValue, i, s, wantSamples[i])
+		}
+	}
+}
+
+func TestTimedOperationDoubleFinish(t *testing.T) {
+	defer reset()
+	timer, err := NewTimerMetric("/timer", NewDurationBucketer(5, time.Microsecond, time.Second), "a timer metric")
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	op := timer.Start()
+	op.Finish()
+	op.Finish()
+	var total uint64
+	for _, s := range timer.samples[""] {
+		total += s
+	}
+	if total != 1 {
+		t.Errorf("got %d samples after finishing twice, want 1", total)
+	}
+}
+
+func TestMultiTimer(t *testing.T) {
+	defer reset()
+	bucketer := NewDurationBucketer(5, time.Microsecond, time.Second)
+	aggregate, err := NewTimerMetric("/aggregate", bucketer, "an aggregate timer metric")
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	perOp, err := NewTimerMetric("/per_op", bucketer, "a per-operation timer metric", NewField("op", []string{"read", "write"}))
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	timer := NewMultiTimer(aggregate, perOp)
+
+	op := timer.Start()
+	time.Sleep(time.Millisecond)
+	op.Finish(nil, []string{"write"})
+	op.Finish(nil, []string{"write"})
+
+	if !reflect.DeepEqual(aggregate.samples[""], perOp.samples["write"]) {
+		t.Errorf("got different samples %v and %v, want identical ones", aggregate.samples[""], perOp.samples["write"])
+	}
+	var total uint64
+	for _, s := range aggregate.samples[""] {
+		total += s
+	}
+	if total != 1 {
+		t.Errorf("got %d samples after finishing twice, want 1", total)
+	}
+	for _, s := range perOp.samples["read"] {
+		if s != 0 {
+			t.Errorf("got samples %v for unused field value, want none", perOp.samples["read"])
+			break
+		}
+	}
+}
+
+func TestTimerMetricBucketForDuration(t *testing.T) {
+	defer reset()
+	// Buckets: [0, 1ms), [1ms, 2ms), [2ms, 4ms), [4ms, 8ms).
+	bucketer := NewExponentialBucketer(4, 0, float64(time.Millisecond.Nanoseconds()), 2)
+	timer, err := NewTimerMetric("/timer", bucketer, "a timer metric")
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	for _, test := range []struct {
+		d    time.Duration
+		want int
+	}{
+		{-time.Millisecond, -1},
+		{0, 0},
+		{time.Millisecond, 1},
+		{3 * time.Millisecond, 2},
+		{7 * time.Millisecond, 3},
+		{time.Second, 4},
+	} {
+		if got := timer.BucketForDuration(test.d); got != test.want {
+			t.Errorf("BucketForDuration(%v) = %d, want %d", test.d, got, test.want)
+		}
+	}
+}
+
+func TestTimerMetricObserve(t *testing.T) {
+	defer reset()
+	// Buckets: [0, 1ms), [1ms, 2ms), [2ms, 4ms), [4ms, 8ms).
+	bucketer := NewExponentialBucketer(4, 0, float64(time.Millisecond.Nanoseconds()), 2)
+	timer, err := NewTimerMetric("/timer", bucketer, "a timer metric", NewField("op", []string{"read", "write"}))
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	timer.Observe(3*time.Millisecond, "read")
+	timer.Observe(3*time.Millisecond, "read")
+	timer.Observe(time.Second, "write")
+	timer.Observe(-time.Millisecond, "write")
+	for _, test := range []struct {
+		field string
+		want  []uint64
+	}{
+		{"read", []uint64{0, 0, 0, 2, 0, 0}},
+		{"write", []uint64{1, 0, 0, 0, 0, 1}},
+	} {
+		if got := timer.samples[timer.fieldsToKey.lookup(test.field)]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("samples of %q got %v want %v", test.field, got, test.want)
+		}
+	}
+}
+
+func TestTimerMetricDistribution(t *testing.T) {
+	defer reset()
+	timer, err := NewTimerMetric("/timer", NewExponentialBucketer(4, 0, float64(time.Millisecond.Nanoseconds()), 2), "a timer metric", NewField("op", []string{"read", "write"}))
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	d := timer.Distribution()
+	if registered := allMetrics.distributionMetrics["/timer"]; d != registered {
+		t.Errorf("Distribution() got %p want registered metric %p", d, registered)
+	}
+	if got, want := d.NumBuckets(), timer.NumBuckets(); got != want {
+		t.Errorf("Distribution().NumBuckets() got %d want %d", got, want)
+	}
+	if got, want := d.Unit(), pb.MetricMetadata_UNITS_NANOSECONDS; got != want {
+		t.Errorf("Distribution().Unit() got %v want %v", got, want)
+	}
+	d.AddSample(int64(3*time.Millisecond), "read")
+	op := timer.Start("read")
+	op.Finish()
+	var total uint64
+	for _, n := range d.samples[d.fieldsToKey.lookup("read")] {
+		total += n
+	}
+	if total != 2 {
+		t.Errorf("Distribution() got %d samples want 2", total)
+	}
+}
+
+func TestReemitRegistration(t *testing.T) {
+	defer reset()
+
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	foo.Increment()
+	distrib.AddSample(1)
+	EmitMetricUpdate()
+
+	if err := ChangeDescription("/foo", barDescription); err != nil {
+		t.Fatalf("ChangeDescription: %v", err)
+	}
+	if err := ChangeDescription("/distrib", counterDescription); err != nil {
+		t.Fatalf("ChangeDescription: %v", err)
+	}
+	if err := ChangeDescription("/nonexistent", fooDescription); err == nil {
+		t.Error("ChangeDescription of nonexistent metric succeeded")
+	}
+	emitter.Reset()
+	if err := ReemitRegistration(); err != nil {
+		t.Fatalf("ReemitRegistration: %v", err)
+	}
+	if len(emitter) != 1 {
+		t.Fatalf("ReemitRegistration emitted %d events want 1", len(emitter))
+	}
+	mr, ok := emitter[0].(*pb.MetricRegistration)
+	if !ok {
+		t.Fatalf("emitter %v got %T want pb.MetricRegistration", emitter[0], emitter[0])
+	}
+	wantDescriptions := map[string]string{
+		"/foo":     barDescription,
+		"/distrib": counterDescription,
+	}
+	for _, m := range mr.Metrics {
+		if want, ok := wantDescriptions[m.GetName()]; ok && m.GetDescription() != want {
+			t.Errorf("%s: got description %q want %q", m.GetName(), m.GetDescription(), want)
+		}
+	}
+
+	// The next update contains all values, as after Initialize.
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	update := emitter[0].(*pb.MetricUpdate)
+	if len(update.Metrics) != 2 {
+		t.Errorf("MetricUpdate got %d metrics want 2: %v", len(update.Metrics), update.Metrics)
+	}
+}
+
+func TestChangeDescriptionConcurrent(t *testing.T) {
+	defer reset()
+
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	var descriptions sync.Map
+	if err := RegisterOnRegistration(func(name string, md *pb.MetricMetadata) {
+		descriptions.Store(name, md.GetDescription())
+	}); err != nil {
+		t.Fatalf("RegisterOnRegistration: %v", err)
+	}
+
+	// Descriptions can be changed while other metrics are registered.
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := ChangeDescription("/foo", fmt.Sprintf("description %d", i)); err != nil {
+				t.Errorf("ChangeDescription: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := NewUint64Metric(fmt.Sprintf("/concurrent/%d", i), false, pb.MetricMetadata_UNITS_NONE, counterDescription); err != nil {
+				t.Errorf("NewUint64Metric: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Hooks see the new description.
+	if err := ChangeDescription("/foo", barDescription); err != nil {
+		t.Fatalf("ChangeDescription: %v", err)
+	}
+	if got, _ := descriptions.Load("/foo"); got != barDescription {
+		t.Errorf("hook got description %q want %q", got, barDescription)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if got := len(emitter[0].(*pb.MetricRegistration).GetMetrics()); got != n+1 {
+		t.Errorf("got %d registered metrics want %d", got, n+1)
+	}
+}
+
+func TestSetSubsystem(t *testing.T) {
+	defer reset()
+
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	if _, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription); err != nil {
+		t.Fatalf("NewDistributionMetric got err %v want nil", err)
+	}
+	if _, err := NewUint64Metric("/bar", false, pb.MetricMetadata_UNITS_NONE, barDescription); err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	if err := SetSubsystem("test", "/foo", "/distrib"); err != nil {
+		t.Fatalf("SetSubsystem got err %v want nil", err)
+	}
+	if err := SetSubsystem("test", "/nonexistent"); err == nil {
+		t.Errorf("SetSubsystem of nonexistent metric got nil error")
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if err := SetSubsystem("test", "/bar"); err != ErrInitializationDone {
+		t.Errorf("SetSubsystem after Initialize got err %v want %v", err, ErrInitializationDone)
+	}
+
+	mr, ok := emitter[0].(*pb.MetricRegistration)
+	if !ok {
+		t.Fatalf("emitter %v got %T want pb.MetricRegistration", emitter[0], emitter[0])
+	}
+	want := map[string]string{"/foo": "test", "/distrib": "test", "/bar": ""}
+	if len(mr.GetMetrics()) != len(want) {
+		t.Fatalf("MetricRegistration got %d metrics want %d: %v", len(mr.GetMetrics()), len(want), mr)
+	}
+	for _, m := range mr.GetMetrics() {
+		if got := m.GetSubsystem(); got != want[m.GetName()] {
+			t.Errorf("%s: got subsystem %q want %q", m.GetName(), got, want[m.GetName()])
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"/fs/opens", "fs_opens"},
+		{"/gofer/read_wait_9p", "gofer_read_wait_9p"},
+		{"/foo/bar-baz", "foo_bar_baz"},
+		{"/9p/reads", "_9p_reads"},
+	} {
+		if got := SanitizeName(test.name); got != test.want {
+			t.Errorf("SanitizeName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSanitizedNameCollision(t *testing.T) {
+	defer reset()
+
+	if _, err := NewUint64Metric("/foo/bar-baz", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	for _, name := range []string{"/foo/bar_baz", "/Foo/Bar_Baz", "foo.bar.baz"} {
+		if _, err := NewUint64Metric(name, false, pb.MetricMetadata_UNITS_NONE, fooDescription); !errors.Is(err, ErrNameInUse) {
+			t.Errorf("NewUint64Metric(%q) got err %v want %v", name, err, ErrNameInUse)
+		}
+		if _, err := NewDistributionMetric(name, false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription); !errors.Is(err, ErrNameInUse) {
+			t.Errorf("NewDistributionMetric(%q) got err %v want %v", name, err, ErrNameInUse)
+		}
+	}
+	if _, err := NewUint64Metric("/foo/bar_baz2", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Errorf("NewUint64Metric got err %v want nil", err)
+	}
+}
+
+func TestFieldValueDescriptions(t *testing.T) {
+	defer reset()
+
+	field := NewFieldWithDescriptions("field", []string{"a", "b"}, map[string]string{"a": "The a value."})
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription, field); err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	mr := emitter[0].(*pb.MetricRegistration)
+	want := map[string]string{"a": "The a value."}
+	if got := mr.GetMetrics()[0].GetFields()[0].GetValueDescriptions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got value descriptions %v want %v", got, want)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("NewFieldWithDescriptions with description of disallowed value did not panic")
+		}
+	}()
+	NewFieldWithDescriptions("field", []string{"a"}, map[string]string{"b": "Not allowed."})
+}
+
+func TestGetSnapshot(t *testing.T) {
+	defer reset()
+
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	foo.IncrementBy(2, "b")
+	distrib.AddSample(3)
+
+	snapshot := GetSnapshot()
+	if len(snapshot.Metrics) != 2 {
+		t.Fatalf("got %d metrics in snapshot, want 2: %+v", len(snapshot.Metrics), snapshot)
+	}
+	if got := snapshot.Metrics[0].Metadata.GetName(); got != "/distrib" {
+		t.Errorf("first metric: got %q want %q", got, "/distrib")
+	}
+	wantDistrib := []MetricPoint{{Samples: []uint64{0, 0, 1, 0}}}
+	if got := snapshot.Metrics[0].Points; !reflect.DeepEqual(got, wantDistrib) {
+		t.Errorf("/distrib points: got %+v want %+v", got, wantDistrib)
+	}
+	wantFoo := []MetricPoint{
+		{FieldValues: []string{"a"}, Uint64: 0},
+		{FieldValues: []string{"b"}, Uint64: 2},
+	}
+	if got := snapshot.Metrics[1].Points; !reflect.DeepEqual(got, wantFoo) {
+		t.Errorf("/foo points: got %+v want %+v", got, wantFoo)
+	}
+}
+
+func TestDownsampleBuckets(t *testing.T) {
+	// 5 finite buckets: [0, 10), [10, 20), [20, 30), [30, 40), [40, 50).
+	lowerBounds := []int64{0, 10, 20, 30, 40, 50}
+	samples := []uint64{1, 2, 3, 4, 5, 6, 7}
+	for _, test := range []struct {
+		name            string
+		numBuckets      int
+		wantLowerBounds []int64
+		wantSamples     []uint64
+	}{
+		{
+			name:            "no-op",
+			numBuckets:      5,
+			wantLowerBounds: []int64{0, 10, 20, 30, 40, 50},
+			wantSamples:     []uint64{1, 2, 3, 4, 5, 6, 7},
+		},
+		{
+			name:            "more buckets than available",
+			numBuckets:      10,
+			wantLowerBounds: []int64{0, 10, 20, 30, 40, 50},
+			wantSamples:     []uint64{1, 2, 3, 4, 5, 6, 7},
+		},
+		{
+			name:            "two buckets",
+			numBuckets:      2,
+			wantLowerBounds: []int64{0, 20, 50},
+			wantSamples:     []uint64{1, 2 + 3, 4 + 5 + 6, 7},
+		},
+		{
+			name:            "single bucket",
+			numBuckets:      1,
+			wantLowerBounds: []int64{0, 50},
+			wantSamples:     []uint64{1, 2 + 3 + 4 + 5 + 6, 7},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			gotLowerBounds, gotSamples, err := DownsampleBuckets(lowerBounds, samples, test.numBuckets)
+			if err != nil {
+				t.Fatalf("DownsampleBuckets: %v", err)
+			}
+			if !reflect.DeepEqual(gotLowerBounds, test.wantLowerBounds) {
+				t.Errorf("got lower bounds %v want %v", gotLowerBounds, test.wantLowerBounds)
+			}
+			if !reflect.DeepEqual(gotSamples, test.wantSamples) {
+				t.Errorf("got samples %v want %v", gotSamples, test.wantSamples)
+			}
+		})
+	}
+	if _, _, err := DownsampleBuckets(lowerBounds, samples, 0); err == nil {
+		t.Error("DownsampleBuckets with 0 buckets succeeded")
+	}
+	if _, _, err := DownsampleBuckets(lowerBounds, samples[1:], 2); err == nil {
+		t.Error("DownsampleBuckets with inconsistent buckets succeeded")
+	}
+}
+
+func TestInvalidUnits(t *testing.T) {
+	defer reset()
+
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_Units(1337), fooDescription); !errors.Is(err, ErrInvalidUnits) {
+		t.Errorf("NewUint64Metric with unknown units: got err %v want %v", err, ErrInvalidUnits)
+	}
+	if _, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_Units(-1), distribDescription); !errors.Is(err, ErrInvalidUnits) {
+		t.Errorf("NewDistributionMetric with unknown units: got err %v want %v", err, ErrInvalidUnits)
+	}
+	durationBucketer := NewDurationBucketer(5, time.Millisecond, time.Second)
+	if _, err := NewDistributionMetric("/distrib", false, durationBucketer, pb.MetricMetadata_UNITS_NONE, distribDescription); !errors.Is(err, ErrInvalidUnits) {
+		t.Errorf("NewDistributionMetric with duration bucketer and no units: got err %v want %v", err, ErrInvalidUnits)
+	}
+	if _, err := NewDistributionMetric("/distrib", false, durationBucketer, pb.MetricMetadata_UNITS_NANOSECONDS, distribDescription); err != nil {
+		t.Errorf("NewDistributionMetric with duration bucketer and nanoseconds: got err %v want nil", err)
+	}
+	if _, err := NewTimerMetric("/timer", durationBucketer, "a timer metric"); err != nil {
+		t.Errorf("NewTimerMetric: got err %v want nil", err)
+	}
+
+	// Only distributions of durations may have nanosecond units.
+	if _, err := NewDistributionMetric("/sizes", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NANOSECONDS, distribDescription); !errors.Is(err, ErrInvalidUnits) {
+		t.Errorf("NewDistributionMetric with exponential bucketer and nanoseconds: got err %v want %v", err, ErrInvalidUnits)
+	}
+	explicitBucketer, err := NewExplicitBucketer([]int64{10, 100})
+	if err != nil {
+		t.Fatalf("NewExplicitBucketer: %v", err)
+	}
+	if _, err := NewDistributionMetric("/sizes", false, explicitBucketer, pb.MetricMetadata_UNITS_NANOSECONDS, distribDescription); !errors.Is(err, ErrInvalidUnits) {
+		t.Errorf("NewDistributionMetric with explicit bucketer and nanoseconds: got err %v want %v", err, ErrInvalidUnits)
+	}
+	if _, err := NewAutoDistributionMetric("/sizes", 10, 1000, 5, pb.MetricMetadata_UNITS_NANOSECONDS, distribDescription); err != nil {
+		t.Errorf("NewAutoDistributionMetric with nanoseconds: got err %v want nil", err)
+	}
+	// A timer measures durations whatever its bucketer.
+	if _, err := NewTimerMetric("/explicit_timer", explicitBucketer, "a timer metric"); err != nil {
+		t.Errorf("NewTimerMetric with explicit bucketer: got err %v want nil", err)
+	}
+}
+
+func TestNoFieldValues(t *testing.T) {
+	defer reset()
+
+	// allowedValues is typically computed, and may unexpectedly be empty.
+	var allowedValues []string
+	empty := NewField("field", allowedValues)
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription, empty); !errors.Is(err, ErrNoFieldValues) {
+		t.Errorf("NewUint64Metric got err %v want %v", err, ErrNoFieldValues)
+	}
+	if _, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, NewField("other", []string{"a"}), empty); !errors.Is(err, ErrNoFieldValues) {
+		t.Errorf("NewDistributionMetric got err %v want %v", err, ErrNoFieldValues)
+	}
+	if _, err := NewSparseUint64Metric("/sparse", false, pb.MetricMetadata_UNITS_NONE, counterDescription, empty); !errors.Is(err, ErrNoFieldValues) {
+		t.Errorf("NewSparseUint64Metric got err %v want %v", err, ErrNoFieldValues)
+	}
+	// Dynamic fields have no allowed values.
+	if _, err := NewDynamicUint64Metric("/dynamic", false, pb.MetricMetadata_UNITS_NONE, counterDescription, 1, NewFieldMatching("field", "a+")); err != nil {
+		t.Errorf("NewDynamicUint64Metric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if got := len(emitter[0].(*pb.MetricRegistration).GetMetrics()); got != 1 {
+		t.Errorf("got %d registered metrics want 1", got)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	defer reset()
+
+	field1 := NewField("field1", []string{"foo", "bar"})
+	field2 := NewField("field2", []string{"baz"})
+	for _, test := range []struct {
+		name string
+		f    func() error
+		want error
+	}{
+		{
+			name: "too many fields",
+			f: func() error {
+				_, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription, field1, field2)
+				return err
+			},
+			want: ErrTooManyFields,
+		},
+		{
+			name: "duplicate field",
+			f: func() error {
+				_, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, field1, field1)
+				return err
+			},
+			want: ErrDuplicateField,
+		},
+		{
+			name: "empty explicit bucketer",
+			f: func() error {
+				_, err := NewExplicitBucketer(nil)
+				return err
+			},
+			want: ErrInvalidBucketer,
+		},
+		{
+			name: "unsorted explicit bucketer",
+			f: func() error {
+				_, err := NewExplicitBucketer([]int64{10, 5})
+				return err
+			},
+			want: ErrNonMonotonicBounds,
+		},
+		{
+			name: "inconsistent distribution",
+			f: func() error {
+				_, _, err := DownsampleBuckets([]int64{0, 2}, []uint64{1}, 1)
+				return err
+			},
+			want: ErrInvalidDistribution,
+		},
+		{
+			name: "unknown metric",
+			f: func() error {
+				return ChangeDescription("/unknown", "description")
+			},
+			want: ErrMetricNotFound,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.f(); !errors.Is(err, test.want) {
+				t.Errorf("got err %v want %v", err, test.want)
+			}
+		})
+	}
+
+	// The metric with too many fields must not have been registered.
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Errorf("NewUint64Metric after failed registration: got err %v want nil", err)
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if err := Initialize(); !errors.Is(err, ErrAlreadyInitialized) {
+		t.Errorf("second Initialize(): got err %v want %v", err, ErrAlreadyInitialized)
+	}
+	if err := Disable(); !errors.Is(err, ErrAlreadyInitialized) {
+		t.Errorf("Disable() after Initialize(): got err %v want %v", err, ErrAlreadyInitialized)
+	}
+}
+
+func TestBucketer(t *testing.T) {
+	for _, test := range []struct {
+		name                    string
+		bucketer                Bucketer
+		minSample               int64
+		maxSample               int64
+		step                    int64
+		firstFewLowerBounds     []int64
+		successiveBucketSamples []int64
+	}{
+		{
+			name:                "static-sized buckets",
+			bucketer:            NewExponentialBucketer(10, 10, 0, 1),
+			minSample:           -5,
+			maxSample:           105,
+			firstFewLowerBounds: []int64{0, 10, 20, 30, 40, 50},
+		},
+		{
+			name:      "exponential buckets",
+			bucketer:  NewExponentialBucketer(10, 10, 2, 1.5),
+			minSample: -5,
+			maxSample: int64(20 * math.Pow(1.5, 12)),
+			firstFewLowerBounds: []int64{
+				0,
+				10 + 2,
+				20 + int64(2*1.5),
+				30 + int64(math.Floor(2*1.5*1.5)),
+				40 + int64(math.Floor(2*1.5*1.5*1.5)),
+				50 + int64(math.Floor(2*1.5*1.5*1.5*1.5)),
+			},
+		},
+		{
+			name:      "timer buckets",
+			bucketer:  NewDurationBucketer(8, time.Second, time.Minute),
+			minSample: 0,
+			maxSample: (5 * time.Minute).Nanoseconds(),
+			step:      (500 * time.Millisecond).Nanoseconds(),
+			successiveBucketSamples: []int64{
+				// Roughly exponential successive durations:
+				(500 * time.Millisecond).Nanoseconds(),
+				(1200 * time.Millisecond).Nanoseconds(),
+				(2500 * time.Millisecond).Nanoseconds(),
+				(5 * time.Second).Nanoseconds(),
+				(15 * time.Second).Nanoseconds(),
+				(35 * time.Second).Nanoseconds(),
+				(75 * time.Second).Nanoseconds(),
+				(3 * time.Minute).Nanoseconds(),
+				(7 * time.Minute).Nanoseconds(),
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			numFiniteBuckets := test.bucketer.NumFiniteBuckets()
+			t.Logf("Underflow bucket has bounds (-inf, %d)", test.bucketer.LowerBound(0))
+			for b := 0; b < numFiniteBuckets; b++ {
+				t.Logf("Bucket %d has bounds [%d, %d)", b, test.bucketer.LowerBound(b), test.bucketer.LowerBound(b+1))
+			}
+			t.Logf("Overflow bucket has bounds [%d, +inf)", test.bucketer.LowerBound(numFiniteBuckets))
+			testAround := func(bound int64, bucketIndex int) {
+				for sample := bound - 2; sample <= bound+2; sample++ {
+					gotIndex := test.bucketer.BucketIndex(sample)
+					if sample < bound && gotIndex != bucketIndex-1 || sample >= bound && gotIndex != bucketIndex {
+						t.Errorf("LowerBound(%d) = %d, yet BucketIndex(%d) = %d", bucketIndex, bound, sample, gotIndex)
+					}
+				}
+			}
+			step := test.step
+			if step == 0 {
+				step = 1
+			}
+			for sample := test.minSample; sample <= test.maxSample; sample += step {
+				bucket := test.bucketer.BucketIndex(sample)
+				if bucket == -1 {
+					lowestBound := test.bucketer.LowerBound(0)
+					if sample >= lowestBound {
+						t.Errorf("sample %d: got bucket %d but lowest bound %d", sample, bucket, lowestBound)
+					}
+					testAround(lowestBound, 0)
+				} else if bucket > numFiniteBuckets {
+					t.Errorf("sample %d: got bucket with 0-based index %d but bucketer supposedly only has %d buckets", sample, bucket, numFiniteBuckets)
+				} else if bucket == numFiniteBuckets {
+					lastBucketBound := test.bucketer.LowerBound(bucket)
+					if sample < lastBucketBound {
+						t.Errorf("sample %d: got bucket %d but it has lower bound %d", sample, bucket, lastBucketBound)
+					}
+					testAround(lastBucketBound, bucket)
+				} else {
+					lowerBound := test.bucketer.LowerBound(bucket)
+					upperBound := test.bucketer.LowerBound(bucket + 1)
+					if upperBound <= lowerBound {
+						t.Errorf("sample %d: got bucket %d, upperbound %d <= lowerbound %d", sample, bucket, upperBound, lowerBound)
+					}
+					if sample < lowerBound || sample >= upperBound {
+						t.Errorf("sample %d: got bucket %d which has range [%d, %d)", sample, bucket, lowerBound, upperBound)
+					}
+					testAround(lowerBound, bucket)
+					testAround(upperBound, bucket+1)
+				}
+			}
+			for bi, want := range test.firstFewLowerBounds {
+				if got := test.bucketer.LowerBound(bi); got != want {
+					t.Errorf("bucket %d has lower bound %d, want %d", bi, got, want)
+				}
+			}
+			previousBucket := -1
+			for i, sample := range test.successiveBucketSamples {
+				gotBucket := test.bucketer.BucketIndex(sample)
+				if gotBucket != previousBucket+1 {
+					t.Errorf("successive-bucket sample #%d (%d) fell in bucket %d whereas previous sample fell in bucket %d", i, sample, gotBucket, previousBucket)
+				}
+				previousBucket = gotBucket
+			}
+		})
+	}
+}
+
+func TestExplicitBucketer(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		bounds []int64
+		// samples maps samples to their expected bucket index.
+		samples map[int64]int
+	}{
+		{
+			name:   "single bound",
+			bounds: []int64{10},
+			samples: map[int64]int{
+				math.MinInt64: -1,
+				-1:            -1,
+				0:             0,
+				9:             0,
+				10:            1,
+				math.MaxInt64: 1,
+			},
+		},
+		{
+			name:   "several bounds",
+			bounds: []int64{1, 10, 100, 1000},
+			samples: map[int64]int{
+				-1:   -1,
+				0:    0,
+				1:    1,
+				9:    1,
+				10:   2,
+				99:   2,
+				100:  3,
+				999:  3,
+				1000: 4,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := NewExplicitBucketer(test.bounds)
+			if err != nil {
+				t.Fatalf("NewExplicitBucketer(%v): %v", test.bounds, err)
+			}
+			if got, want := b.NumFiniteBuckets(), len(test.bounds); got != want {
+				t.Errorf("NumFiniteBuckets() = %d, want %d", got, want)
+			}
+			for i, bound := range test.bounds {
+				if got := b.LowerBound(i + 1); got != bound {
+					t.Errorf("LowerBound(%d) = %d, want %d", i+1, got, bound)
+				}
+			}
+			for sample, want := range test.samples {
+				if got := b.BucketIndex(sample); got != want {
+					t.Errorf("BucketIndex(%d) = %d, want %d", sample, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExplicitBucketerInvalid(t *testing.T) {
+	for name, bounds := range map[string][]int64{
+		"empty":          nil,
+		"zero bound":     {0, 10},
+		"negative bound": {-10, 10},
+		"duplicate":      {1, 10, 10, 100},
+		"descending":     {1, 100, 10},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewExplicitBucketer(bounds); err == nil {
+				t.Errorf("NewExplicitBucketer(%v) got nil error", bounds)
+			}
+		})
+	}
+}
+
+func TestDistributionMetricExplicitBucketer(t *testing.T) {
+	defer reset()
+
+	b, err := NewExplicitBucketer([]int64{10, 100})
+	if err != nil {
+		t.Fatalf("NewExplicitBucketer: %v", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, b, pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	for _, sample := range []int64{-5, 5, 50, 55, 500} {
+		distrib.AddSample(sample)
+	}
+	if want := []uint64{1, 1, 2, 1}; !reflect.DeepEqual(distrib.samples[""], want) {
+		t.Errorf("got samples %v want %v", distrib.samples[""], want)
+	}
+	if want := []int64{0, 10, 100}; !reflect.DeepEqual(distrib.metadata.GetDistributionBucketLowerBounds(), want) {
+		t.Errorf("got lower bounds %v want %v", distrib.metadata.GetDistributionBucketLowerBounds(), want)
+	}
+}
+
+func TestDistributionNumBucketsAndUnit(t *testing.T) {
+	defer reset()
+
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(3, 10, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if got, want := distrib.NumBuckets(), 5; got != want {
+		t.Errorf("NumBuckets() = %d, want %d", got, want)
+	}
+	if got, want := distrib.Unit(), pb.MetricMetadata_UNITS_NONE; got != want {
+		t.Errorf("Unit() = %v, want %v", got, want)
+	}
+
+	timer, err := NewTimerMetric("/timer", NewDurationBucketer(5, time.Microsecond, time.Second), "a timer metric")
+	if err != nil {
+		t.Fatalf("NewTimerMetric: %v", err)
+	}
+	if got, want := timer.NumBuckets(), 7; got != want {
+		t.Errorf("NumBuckets() = %d, want %d", got, want)
+	}
+	if got, want := timer.Unit(), pb.MetricMetadata_UNITS_NANOSECONDS; got != want {
+		t.Errorf("Unit() = %v, want %v", got, want)
+	}
+}
+
+func TestEstimatedMean(t *testing.T) {
+	defer reset()
+
+	// Buckets: [0, 10), [10, 20), [20, +inf).
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 10, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if got := distrib.EstimatedMean("a"); !math.IsNaN(got) {
+		t.Errorf("EstimatedMean of empty distribution = %v, want NaN", got)
+	}
+
+	distrib.AddSample(1, "a")
+	distrib.AddSample(12, "a")
+	distrib.AddSample(18, "a")
+	// (5 + 15 + 15) / 3
+	if got, want := distrib.EstimatedMean("a"), 35.0/3; math.Abs(got-want) > 1e-9 {
+		t.Errorf("EstimatedMean(a) = %v, want %v", got, want)
+	}
+
+	// Underflow and overflow samples are estimated at the closest bound.
+	distrib.AddSample(-100, "b")
+	distrib.AddSample(1000, "b")
+	if got, want := distrib.EstimatedMean("b"), 10.0; got != want {
+		t.Errorf("EstimatedMean(b) = %v, want %v", got, want)
+	}
+}
+
+func TestBucketerExtremeSamples(t *testing.T) {
+	for name, bucketer := range map[string]Bucketer{
+		"static-sized buckets": NewExponentialBucketer(10, 10, 0, 1),
+		"exponential buckets":  NewExponentialBucketer(10, 10, 2, 1.5),
+		"max buckets":          NewExponentialBucketer(exponentialMaxBuckets, 1, 1, 1.2),
+		// The last lower bounds of this bucketer exceed the range of int64.
+		"duration buckets": NewDurationBucketer(30, time.Microsecond, time.Hour),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := bucketer.BucketIndex(math.MinInt64); got != -1 {
+				t.Errorf("BucketIndex(MinInt64) = %d, want underflow bucket -1", got)
+			}
+			if got, want := bucketer.BucketIndex(math.MaxInt64), bucketer.NumFiniteBuckets(); got != want {
+				t.Errorf("BucketIndex(MaxInt64) = %d, want overflow bucket %d", got, want)
+			}
+		})
+	}
+}
+
+func TestAddSampleExtremeSamples(t *testing.T) {
+	defer reset()
+
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	distrib.AddSample(math.MinInt64)
+	distrib.AddSample(math.MaxInt64)
+	if want := []uint64{1, 0, 0, 1}; !reflect.DeepEqual(distrib.samples[""], want) {
+		t.Errorf("got samples %v want %v", distrib.samples[""], want)
+	}
+}
+
+func TestExponentialBucketerLinear(t *testing.T) {
+	// With a growth of 1, the exponential portion is constant, so buckets
+	// after the first have the same width.
+	b := NewExponentialBucketer(4, 10, 5, 1)
+	if want := []int64{0, 15, 25, 35, 45}; !reflect.DeepEqual(b.lowerBounds, want) {
+		t.Errorf("lower bounds got %v want %v", b.lowerBounds, want)
+	}
+	for sample, want := range map[int64]int{
+		14: 0,
+		15: 1,
+		34: 2,
+		44: 3,
+		45: 4,
+	} {
+		if got := b.BucketIndex(sample); got != want {
+			t.Errorf("BucketIndex(%d) got %d want %d", sample, got, want)
+		}
+	}
+}
+
+func TestBucketerPanics(t *testing.T) {
+	for name, fn := range map[string]func(){
+		"NewExponentialBucketer @ 0": func() {
+			NewExponentialBucketer(0, 2, 0, 1)
+		},
+		"NewExponentialBucketer @ 120": func() {
+			NewExponentialBucketer(120, 2, 0, 1)
+		},
+		"NewExponentialBucketer with growth 0.5": func() {
+			NewExponentialBucketer(10, 2, 1, 0.5)
+		},
+		"NewExponentialBucketer with growth 0": func() {
+			NewExponentialBucketer(10, 2, 1, 0)
+		},
+		"NewExponentialBucketer with growth NaN": func() {
+			NewExponentialBucketer(10, 2, 1, math.NaN())
+		},
+		"NewDurationBucketer @ 2": func() {
+			NewDurationBucketer(2, time.Second, time.Minute)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var recovered interface{}
+			func() {
+				defer func() {
+					recovered = recover()
+				}()
+				fn()
 			}()
 			if recovered == nil {
 				t.Error("did not panic")
@@ -844,3 +2436,693 @@ func TestBucketerPanics(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterAlias(t *testing.T) {
+	defer reset()
+
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric got err %v want nil", err)
+	}
+	if err := RegisterAlias("/foo", "/old_foo"); err != nil {
+		t.Fatalf("RegisterAlias(/foo) got err %v want nil", err)
+	}
+	if err := RegisterAlias("/distrib", "/old_distrib"); err != nil {
+		t.Fatalf("RegisterAlias(/distrib) got err %v want nil", err)
+	}
+	if err := RegisterAlias("/foo", "/distrib"); !errors.Is(err, ErrNameInUse) {
+		t.Errorf("RegisterAlias to existing name got err %v want %v", err, ErrNameInUse)
+	}
+	if err := RegisterAlias("/unknown", "/new"); !errors.Is(err, ErrMetricNotFound) {
+		t.Errorf("RegisterAlias of unknown metric got err %v want %v", err, ErrMetricNotFound)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if err := RegisterAlias("/foo", "/new_foo"); err != ErrInitializationDone {
+		t.Errorf("RegisterAlias after Initialize got err %v want %v", err, ErrInitializationDone)
+	}
+
+	registered := make(map[string]bool)
+	for _, m := range emitter[0].(*pb.MetricRegistration).GetMetrics() {
+		registered[m.GetName()] = true
+	}
+	for _, name := range []string{"/foo", "/old_foo", "/distrib", "/old_distrib"} {
+		if !registered[name] {
+			t.Errorf("metric %s not registered", name)
+		}
+	}
+
+	foo.IncrementBy(3, "b")
+	distrib.AddSample(3)
+	emitter.Reset()
+	EmitMetricUpdate()
+	got := make(map[string]string)
+	for _, m := range emitter[0].(*pb.MetricUpdate).GetMetrics() {
+		if d := m.GetDistributionValue(); d != nil {
+			got[m.GetName()] = fmt.Sprint(d.GetNewSamples())
+			continue
+		}
+		got[m.GetName()] = fmt.Sprint(m.GetFieldValues(), m.GetUint64Value())
+	}
+	want := map[string]string{
+		"/foo":         "[b] 3",
+		"/old_foo":     "[b] 3",
+		"/distrib":     "[0 0 1 0]",
+		"/old_distrib": "[0 0 1 0]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EmitMetricUpdate got %v want %v", got, want)
+	}
+}
+
+func TestSharedLowerBounds(t *testing.T) {
+	defer reset()
+
+	bucketer := NewExponentialBucketer(3, 10, 0, 1)
+	d1, err := NewDistributionMetric("/distrib1", false, bucketer, pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	d2, err := NewDistributionMetric("/distrib2", false, bucketer, pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	b1, b2 := d1.metadata.GetDistributionBucketLowerBounds(), d2.metadata.GetDistributionBucketLowerBounds()
+	if &b1[0] != &b2[0] {
+		t.Errorf("metrics sharing a bucketer got distinct lower bounds %v and %v", b1, b2)
+	}
+	want := []int64{0, 10, 20, 30}
+	// Appending to the shared bounds must not modify them for other users.
+	_ = append(b1, 42)
+	if err := ChangeDescription("/distrib1", "new description"); err != nil {
+		t.Fatalf("ChangeDescription: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	d1.AddSample(15)
+	for _, m := range GetSnapshot().Metrics {
+		if got := m.Metadata.GetDistributionBucketLowerBounds(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s lower bounds got %v want %v", m.Metadata.GetName(), got, want)
+		}
+	}
+	for i, lb := range want {
+		if got := bucketer.LowerBound(i); got != lb {
+			t.Errorf("LowerBound(%d) got %d want %d", i, got, lb)
+		}
+	}
+}
+
+func TestSafeLowerBound(t *testing.T) {
+	explicit, err := NewExplicitBucketer([]int64{10, 100, 1000})
+	if err != nil {
+		t.Fatalf("NewExplicitBucketer: %v", err)
+	}
+	for _, b := range []interface {
+		Bucketer
+		SafeLowerBound(int) (int64, bool)
+	}{
+		NewExponentialBucketer(3, 10, 0, 1),
+		explicit,
+	} {
+		n := b.NumFiniteBuckets()
+		for _, test := range []struct {
+			i      int
+			wantOK bool
+		}{
+			{-1, false},
+			{0, true},
+			{n, true},
+			{n + 1, false},
+		} {
+			got, ok := b.SafeLowerBound(test.i)
+			if ok != test.wantOK {
+				t.Errorf("%T.SafeLowerBound(%d) got ok %t want %t", b, test.i, ok, test.wantOK)
+				continue
+			}
+			if ok && got != b.LowerBound(test.i) {
+				t.Errorf("%T.SafeLowerBound(%d) got %d want %d", b, test.i, got, b.LowerBound(test.i))
+			}
+		}
+	}
+}
+
+func TestBucketLowerBounds(t *testing.T) {
+	defer reset()
+
+	b, err := NewExplicitBucketer([]int64{10, 100})
+	if err != nil {
+		t.Fatalf("NewExplicitBucketer: %v", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, b, pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if _, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription); err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	distrib.AddSample(math.MinInt64)
+	distrib.AddSample(-1)
+	distrib.AddSample(50)
+
+	for _, m := range GetSnapshot().Metrics {
+		switch m.Metadata.GetName() {
+		case "/distrib":
+			want := []int64{UnderflowLowerBound, 0, 10, 100}
+			if got := m.BucketLowerBounds(); !reflect.DeepEqual(got, want) {
+				t.Errorf("BucketLowerBounds() got %v want %v", got, want)
+			}
+			if got, want := m.Points[0].Samples, []uint64{2, 0, 1, 0}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Samples got %v want %v", got, want)
+			}
+		case "/foo":
+			if got := m.BucketLowerBounds(); got != nil {
+				t.Errorf("BucketLowerBounds() of uint64 metric got %v want nil", got)
+			}
+		}
+	}
+}
+
+func TestBucketCounts(t *testing.T) {
+	defer reset()
+
+	b, err := NewExplicitBucketer([]int64{10, 100})
+	if err != nil {
+		t.Fatalf("NewExplicitBucketer: %v", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, b, pb.MetricMetadata_UNITS_NONE, distribDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	for _, sample := range []int64{-1, 5, 50, 50, 1000} {
+		distrib.AddSample(sample, "a")
+	}
+
+	m := GetSnapshot().Metrics[0]
+	for _, test := range []struct {
+		cumulative bool
+		field      string
+		want       []uint64
+	}{
+		{false, "a", []uint64{1, 1, 2, 1}},
+		{true, "a", []uint64{1, 2, 4, 5}},
+		{false, "b", []uint64{0, 0, 0, 0}},
+		{true, "b", []uint64{0, 0, 0, 0}},
+	} {
+		got, ok := m.BucketCounts(test.cumulative, test.field)
+		if !ok {
+			t.Fatalf("BucketCounts(%t, %q) found no point", test.cumulative, test.field)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("BucketCounts(%t, %q) got %v want %v", test.cumulative, test.field, got, test.want)
+		}
+	}
+	if _, ok := m.BucketCounts(false, "c"); ok {
+		t.Errorf("BucketCounts(false, \"c\") found a point, want none")
+	}
+	// The raw counts are copies.
+	raw, _ := m.BucketCounts(false, "a")
+	raw[0] = 42
+	if got, _ := m.BucketCounts(false, "a"); got[0] != 1 {
+		t.Errorf("BucketCounts(false, \"a\") got %v after modifying a previous result", got)
+	}
+}
+
+func TestAutoDistributionMetric(t *testing.T) {
+	defer reset()
+
+	d, err := NewAutoDistributionMetric("/latency", 1000, 1000000, 10, pb.MetricMetadata_UNITS_NANOSECONDS, distribDescription)
+	if err != nil {
+		t.Fatalf("NewAutoDistributionMetric: %v", err)
+	}
+	b := d.exponentialBucketer
+	if got := b.NumFiniteBuckets(); got != 10 {
+		t.Errorf("NumFiniteBuckets got %d want 10", got)
+	}
+	if got := b.LowerBound(1); got != 1000 {
+		t.Errorf("LowerBound(1) got %d want 1000", got)
+	}
+	if got := b.LowerBound(10); got != 1000000 {
+		t.Errorf("LowerBound(10) got %d want 1000000", got)
+	}
+	for i := 1; i <= 10; i++ {
+		if b.LowerBound(i) <= b.LowerBound(i-1) {
+			t.Errorf("LowerBound(%d) = %d is not greater than LowerBound(%d) = %d", i, b.LowerBound(i), i-1, b.LowerBound(i-1))
+		}
+	}
+	for _, test := range []struct {
+		sample int64
+		want   int
+	}{
+		{sample: -1, want: -1},
+		{sample: 0, want: 0},
+		{sample: 999, want: 0},
+		{sample: 1000, want: 1},
+		{sample: 1999, want: 1},
+		// Growth is 10^(1/3) per bucket, i.e. 10 every 3 buckets.
+		{sample: 10000, want: 4},
+		{sample: 100000, want: 7},
+		{sample: 999999, want: 9},
+		{sample: 1000000, want: 10},
+		{sample: math.MaxInt64, want: 10},
+	} {
+		if got := b.BucketIndex(test.sample); got != test.want {
+			t.Errorf("BucketIndex(%d) got %d want %d", test.sample, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		name          string
+		min, max      int64
+		targetBuckets int
+	}{
+		{name: "too few buckets", min: 1, max: 100, targetBuckets: 1},
+		{name: "too many buckets", min: 1, max: 100, targetBuckets: exponentialMaxBuckets + 1},
+		{name: "zero min", min: 0, max: 100, targetBuckets: 10},
+		{name: "negative min", min: -10, max: 100, targetBuckets: 10},
+		{name: "empty range", min: 100, max: 100, targetBuckets: 10},
+		{name: "inverted range", min: 100, max: 10, targetBuckets: 10},
+		{name: "narrow range", min: 10, max: 15, targetBuckets: 10},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewAutoDistributionMetric("/bad", test.min, test.max, test.targetBuckets, pb.MetricMetadata_UNITS_NONE, distribDescription); !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("NewAutoDistributionMetric got err %v want %v", err, ErrInvalidArgument)
+			}
+		})
+	}
+}
+
+// updateStrings returns all strings in m, recursively. It fails the test if m
+// contains a MetricMetadata message.
+func updateStrings(t *testing.T, m protoreflect.Message) []string {
+	t.Helper()
+	if m.Descriptor().FullName() == (&pb.MetricMetadata{}).ProtoReflect().Descriptor().FullName() {
+		t.Errorf("update contains MetricMetadata %v", m.Interface())
+		return nil
+	}
+	var strs []string
+	add := func(fd protoreflect.FieldDescriptor, v protoreflect.Value) {
+		switch fd.Kind() {
+		case protoreflect.StringKind:
+			strs = append(strs, v.String())
+		case protoreflect.MessageKind, protoreflect.GroupKind:
+			strs = append(strs, updateStrings(t, v.Message())...)
+		}
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				add(fd, v.List().Get(i))
+			}
+		case fd.IsMap():
+			t.Errorf("update contains map field %s", fd.FullName())
+		default:
+			add(fd, v)
+		}
+		return true
+	})
+	return strs
+}
+
+// TestMetricUpdateHasNoMetadata checks that metric updates only contain metric
+// names, field values and stage names, and no metadata such as descriptions,
+// which is only sent once in the MetricRegistration.
+func TestMetricUpdateHasNoMetadata(t *testing.T) {
+	defer reset()
+
+	counter, err := NewUint64Metric("/counter", true, pb.MetricMetadata_UNITS_NONE, counterDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	gauge, err := NewUint64Metric("/gauge", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	StartStage(InitRestoreConfig)
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	emitter.Reset()
+
+	allowed := map[string]bool{
+		"/counter":                true,
+		"/gauge":                  true,
+		"/distrib":                true,
+		"a":                       true,
+		"b":                       true,
+		string(InitRestoreConfig): true,
+	}
+	counter.Increment("a")
+	gauge.IncrementBy(2)
+	distrib.AddSample(1, "b")
+	EmitMetricUpdate()
+	StartStage(InitExecConfig)
+	allowed[string(InitExecConfig)] = true
+	counter.Increment("b")
+	EmitMetricUpdate()
+	if len(emitter) != 2 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 2", len(emitter))
+	}
+	for _, msg := range emitter {
+		update, ok := msg.(*pb.MetricUpdate)
+		if !ok {
+			t.Fatalf("emitter got %T want pb.MetricUpdate", msg)
+		}
+		for _, s := range updateStrings(t, update.ProtoReflect()) {
+			if !allowed[s] {
+				t.Errorf("update %v contains unexpected string %q", update, s)
+			}
+		}
+	}
+}
+
+func TestIsCumulative(t *testing.T) {
+	defer reset()
+
+	if _, err := NewUint64Metric("/counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription); err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if err := RegisterCustomUint64Metric("/gauge", false /* cumulative */, false /* sync */, pb.MetricMetadata_UNITS_NONE, fooDescription, func(...string) uint64 { return 0 }); err != nil {
+		t.Fatalf("RegisterCustomUint64Metric: %v", err)
+	}
+	if _, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription); err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	if _, err := NewNonCumulativeDistributionMetric("/windowed", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription); err != nil {
+		t.Fatalf("NewNonCumulativeDistributionMetric: %v", err)
+	}
+	if err := RegisterAlias("/counter", "/counter_alias"); err != nil {
+		t.Fatalf("RegisterAlias: %v", err)
+	}
+	for name, want := range map[string]bool{
+		"/counter":       true,
+		"/counter_alias": true,
+		"/gauge":         false,
+		"/distrib":       true,
+		"/windowed":      false,
+	} {
+		if got, err := IsCumulative(name); err != nil || got != want {
+			t.Errorf("IsCumulative(%q) got (%v, %v) want (%v, nil)", name, got, err, want)
+		}
+	}
+	if _, err := IsCumulative("/unknown"); !errors.Is(err, ErrMetricNotFound) {
+		t.Errorf("IsCumulative of unknown metric got err %v want %v", err, ErrMetricNotFound)
+	}
+
+	// IsCumulative may be called while metrics are registered.
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if got, err := IsCumulative("/counter"); err != nil || !got {
+				t.Errorf("IsCumulative(/counter) got (%v, %v) want (true, nil)", got, err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := NewDistributionMetric(fmt.Sprintf("/concurrent/%d", i), false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription); err != nil {
+				t.Errorf("NewDistributionMetric: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestUpdateValueSemantics pins which metric values in updates are absolute
+// and which are deltas, as documented in pb.MetricValue.
+func TestUpdateValueSemantics(t *testing.T) {
+	defer reset()
+
+	counter, err := NewUint64Metric("/counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	fieldCounter, err := NewUint64Metric("/field_counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription, NewField("field", []string{"a"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	gauge := uint64(10)
+	if err := RegisterCustomUint64Metric("/gauge", false /* cumulative */, false /* sync */, pb.MetricMetadata_UNITS_NONE, fooDescription, func(...string) uint64 { return gauge }); err != nil {
+		t.Fatalf("RegisterCustomUint64Metric: %v", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	resetDistrib, err := NewDistributionMetric("/reset_distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric: %v", err)
+	}
+	windowed, err := NewNonCumulativeDistributionMetric("/windowed", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewNonCumulativeDistributionMetric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+
+	counter.IncrementBy(5)
+	fieldCounter.IncrementBy(5, "a")
+	distrib.AddSample(1)
+	resetDistrib.AddSample(1)
+	resetDistrib.AddSample(1)
+	windowed.AddSample(1)
+	windowed.AddSample(1)
+	last := allMetrics.Values()
+
+	counter.IncrementBy(2)
+	fieldCounter.IncrementBy(2, "a")
+	gauge = 3
+	distrib.AddSample(1)
+	distrib.AddSample(3)
+	resetDistrib.Reset()
+	resetDistrib.AddSample(3)
+	windowed.Reset()
+	windowed.AddSample(3)
+	update := metricUpdate(last, allMetrics.Values())
+
+	values := make(map[string]*pb.MetricValue)
+	for _, v := range update.GetMetrics() {
+		values[v.GetName()] = v
+	}
+	// uint64 metrics are absolute, even if they decreased.
+	for name, want := range map[string]uint64{
+		"/counter":       7,
+		"/field_counter": 7,
+		"/gauge":         3,
+	} {
+		if got := values[name].GetUint64Value(); got != want {
+			t.Errorf("%s got %d want %d", name, got, want)
+		}
+	}
+	// Cumulative distributions are deltas, unless they were reset.
+	for name, want := range map[string]*pb.Samples{
+		"/distrib":       {NewSamples: []uint64{0, 1, 1, 0}},
+		"/reset_distrib": {NewSamples: []uint64{0, 0, 1, 0}, WasReset: true},
+		"/windowed":      {NewSamples: []uint64{0, 0, 1, 0}, WasReset: true},
+	} {
+		if got := values[name].GetDistributionValue(); !proto.Equal(got, want) {
+			t.Errorf("%s got %v want %v", name, got, want)
+		}
+	}
+}
+
+// flushEmitter is an eventchannel.Emitter and eventchannel.Flusher that counts
+// calls to Flush.
+type flushEmitter struct{}
+
+// Emit implements eventchannel.Emitter.Emit.
+func (flushEmitter) Emit(msg proto.Message) (bool, error) {
+	return false, nil
+}
+
+// Close implements eventchannel.Emitter.Close.
+func (flushEmitter) Close() error {
+	return nil
+}
+
+// Flush implements eventchannel.Flusher.Flush.
+func (flushEmitter) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	flushes++
+	return nil
+}
+
+// flushes is the number of calls to flushEmitter.Flush.
+var flushes int
+
+func init() {
+	eventchannel.AddEmitter(flushEmitter{})
+}
+
+func TestFlushMetrics(t *testing.T) {
+	defer reset()
+
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	emitter.Reset()
+	flushes = 0
+
+	foo.Increment()
+	if err := FlushMetrics(context.Background()); err != nil {
+		t.Fatalf("FlushMetrics: %v", err)
+	}
+	if len(emitter) != 1 {
+		t.Fatalf("FlushMetrics emitted %d events want 1", len(emitter))
+	}
+	if metrics := emitter[0].(*pb.MetricUpdate).GetMetrics(); len(metrics) != 1 || metrics[0].GetUint64Value() != 1 {
+		t.Errorf("update got metrics %v want /foo = 1", metrics)
+	}
+	if flushes != 1 {
+		t.Errorf("FlushMetrics flushed %d times want 1", flushes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := FlushMetrics(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("FlushMetrics with canceled context got err %v want %v", err, context.Canceled)
+	}
+}
+
+func TestRegisterCustomUint64MapMetric(t *testing.T) {
+	defer reset()
+
+	calls := 0
+	values := map[string]uint64{"a": 1, "b": 2}
+	if err := RegisterCustomUint64MapMetric("/map", true, false, pb.MetricMetadata_UNITS_NONE, counterDescription, func() map[string]uint64 {
+		calls++
+		return values
+	}, NewField("field", []string{"a", "b", "c"})); err != nil {
+		t.Fatalf("RegisterCustomUint64MapMetric: %v", err)
+	}
+	if err := RegisterCustomUint64MapMetric("/empty", true, false, pb.MetricMetadata_UNITS_NONE, counterDescription, func() map[string]uint64 {
+		return nil
+	}, NewField("field", nil)); !errors.Is(err, ErrNoFieldValues) {
+		t.Errorf("RegisterCustomUint64MapMetric without field values got err %v want %v", err, ErrNoFieldValues)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+
+	// The callback is called once per snapshot, and missing field values
+	// are 0.
+	calls = 0
+	snapshot := allMetrics.Values()
+	if calls != 1 {
+		t.Errorf("callback called %d times per snapshot want 1", calls)
+	}
+	if got, want := snapshot.uint64Metrics["/map"], map[string]uint64{"a": 1, "b": 2, "c": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot got %v want %v", got, want)
+	}
+
+	// Values for field values that aren't allowed are dropped.
+	values = map[string]uint64{"a": 3, "d": 4}
+	dropped := droppedSamples.Value(dropInvalidFieldValue)
+	if got, want := allMetrics.Values().uint64Metrics["/map"], map[string]uint64{"a": 3, "b": 0, "c": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot got %v want %v", got, want)
+	}
+	if got := droppedSamples.Value(dropInvalidFieldValue) - dropped; got != 1 {
+		t.Errorf("dropped %d values want 1", got)
+	}
+
+	// Each invalid field value is only counted once.
+	values = map[string]uint64{"a": 3, "d": 5, "e": 6}
+	allMetrics.Values()
+	allMetrics.Values()
+	if got := droppedSamples.Value(dropInvalidFieldValue) - dropped; got != 2 {
+		t.Errorf("dropped %d distinct values want 2", got)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer reset()
+
+	if err := Shutdown(context.Background()); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("Shutdown before Initialize got err %v want %v", err, ErrNotInitialized)
+	}
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	SetEmitOnStageEnd(true)
+	emitter.Reset()
+	flushes = 0
+
+	// Shutdown emits and flushes the final values.
+	foo.Increment()
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if len(emitter) != 1 {
+		t.Fatalf("Shutdown emitted %d events want 1", len(emitter))
+	}
+	if metrics := emitter[0].(*pb.MetricUpdate).GetMetrics(); len(metrics) != 1 || metrics[0].GetUint64Value() != 1 {
+		t.Errorf("update got metrics %v want /foo = 1", metrics)
+	}
+	if flushes != 1 {
+		t.Errorf("Shutdown flushed %d times want 1", flushes)
+	}
+
+	// Nothing is emitted after Shutdown.
+	emitter.Reset()
+	foo.Increment()
+	EmitMetricUpdate()
+	StartStage(InitExecConfig)
+	if len(emitter) != 0 {
+		t.Errorf("got %d events after Shutdown want 0: %v", len(emitter), emitter)
+	}
+
+	select {
+	case <-ShutdownDone():
+	default:
+		t.Errorf("ShutdownDone not closed after Shutdown")
+	}
+
+	// The set of metrics stays frozen, and metrics keep their values.
+	if _, err := NewUint64Metric("/bar", false, pb.MetricMetadata_UNITS_NONE, barDescription); err != ErrInitializationDone {
+		t.Errorf("NewUint64Metric after Shutdown got err %v want %v", err, ErrInitializationDone)
+	}
+	if err := Initialize(); !errors.Is(err, ErrAlreadyInitialized) {
+		t.Errorf("Initialize after Shutdown got err %v want %v", err, ErrAlreadyInitialized)
+	}
+	if got := foo.Value(); got != 2 {
+		t.Errorf("foo after Shutdown got %d want 2", got)
+	}
+
+	// Shutting down again only flushes.
+	if err := Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+	if len(emitter) != 0 {
+		t.Errorf("got %d events after second Shutdown want 0: %v", len(emitter), emitter)
+	}
+}
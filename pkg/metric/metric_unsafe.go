@@ -15,6 +15,8 @@
 package metric
 
 import (
+	"math"
+	"sync/atomic"
 	"unsafe"
 
 	"gvisor.dev/gvisor/pkg/gohacks"
@@ -46,6 +48,58 @@ func snapshotDistribution(samples []uint64) []uint64 {
 	return snapshot
 }
 
+// outlierSlot is one slot of an outlierBuffer. All fields are accessed
+// atomically.
+type outlierSlot struct {
+	// seq is the 1-based sequence number of the outlier in the slot, 0 if the
+	// slot is empty, or outlierWriting if it is being written to. Writers
+	// claim the slot by setting it to outlierWriting, and store the sequence
+	// number last, so that readers can detect concurrent writes.
+	seq uint64
+
+	// value is the value of the outlier.
+	value int64
+
+	// label is the *string label of the outlier, possibly nil.
+	label unsafe.Pointer
+}
+
+// outlierWriting is the value of outlierSlot.seq while the slot is being
+// written to.
+const outlierWriting = math.MaxUint64
+
+// store writes an outlier to the slot. The outlier is dropped if another
+// writer holds the slot, or if the slot already holds a more recent outlier,
+// which can happen when writers wrap around the buffer concurrently. This
+// keeps concurrent writers from mixing their values in the slot.
+//go:nosplit
+func (s *outlierSlot) store(seq uint64, value int64, label *string) {
+	old := atomic.LoadUint64(&s.seq)
+	if old == outlierWriting || old > seq || !atomic.CompareAndSwapUint64(&s.seq, old, outlierWriting) {
+		return
+	}
+	atomic.StoreInt64(&s.value, value)
+	atomic.StorePointer(&s.label, unsafe.Pointer(label))
+	atomic.StoreUint64(&s.seq, seq)
+}
+
+// load reads the outlier in the slot. ok is false if the slot is empty or was
+// written to concurrently.
+func (s *outlierSlot) load() (seq uint64, outlier Outlier, ok bool) {
+	seq = atomic.LoadUint64(&s.seq)
+	if seq == 0 || seq == outlierWriting {
+		return 0, Outlier{}, false
+	}
+	outlier.Value = atomic.LoadInt64(&s.value)
+	if label := (*string)(atomic.LoadPointer(&s.label)); label != nil {
+		outlier.Label = *label
+	}
+	if atomic.LoadUint64(&s.seq) != seq {
+		return 0, Outlier{}, false
+	}
+	return seq, outlier, true
+}
+
 // CheapNowNano returns the current unix timestamp in nanoseconds.
 //go:nosplit
 func CheapNowNano() int64 {
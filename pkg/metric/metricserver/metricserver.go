@@ -0,0 +1,109 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metricserver implements the Metrics gRPC service, which allows
+// reading the metrics of the metric package remotely rather than over the
+// event channel.
+//
+// The host registers the service on its own gRPC server:
+//
+//	metricserver.Register(grpcServer)
+package metricserver
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gvisor.dev/gvisor/pkg/metric"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// MinStreamPeriod is the minimum period of StreamMetrics, so that clients can't
+// make the server build updates in a busy loop.
+const MinStreamPeriod = 10 * time.Millisecond
+
+// Server implements pb.MetricsServer.
+//
+// Metrics must be initialized (see metric.Initialize) before requests are
+// served.
+type Server struct {
+	pb.UnimplementedMetricsServer
+
+	// reader builds the updates returned by GetMetrics. Deltas returned by
+	// GetMetrics are relative to the previous call on the same Server, so a
+	// Server is meant to be polled by a single consumer.
+	reader *metric.UpdateReader
+
+	// shutdown is closed once metrics are shut down, ending all streams.
+	shutdown <-chan struct{}
+}
+
+// NewServer returns a new Server.
+func NewServer() *Server {
+	return &Server{
+		reader:   metric.NewUpdateReader(),
+		shutdown: metric.ShutdownDone(),
+	}
+}
+
+// Register registers a new Server on s.
+func Register(s *grpc.Server) {
+	pb.RegisterMetricsServer(s, NewServer())
+}
+
+// GetRegistration implements pb.MetricsServer.GetRegistration.
+func (s *Server) GetRegistration(context.Context, *pb.GetRegistrationRequest) (*pb.MetricRegistration, error) {
+	return metric.GetRegistration(), nil
+}
+
+// GetMetrics implements pb.MetricsServer.GetMetrics.
+func (s *Server) GetMetrics(_ context.Context, req *pb.GetMetricsRequest) (*pb.MetricUpdate, error) {
+	return s.reader.Update(req.GetFull()), nil
+}
+
+// StreamMetrics implements pb.MetricsServer.StreamMetrics.
+//
+// Each stream tracks the values it sent independently of GetMetrics and other
+// streams. Streams end with codes.Unavailable once metrics are shut down (see
+// metric.Shutdown).
+func (s *Server) StreamMetrics(req *pb.StreamMetricsRequest, stream pb.Metrics_StreamMetricsServer) error {
+	if period := time.Duration(req.GetPeriodNs()); period < MinStreamPeriod {
+		return status.Errorf(codes.InvalidArgument, "period must be at least %v, got %v", MinStreamPeriod, period)
+	}
+	reader := metric.NewUpdateReader()
+	if err := stream.Send(reader.Update(true /* full */)); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(time.Duration(req.GetPeriodNs()))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.shutdown:
+			return status.Error(codes.Unavailable, "metrics shut down")
+		case <-ticker.C:
+			m := reader.Update(false /* full */)
+			if metric.IsEmptyUpdate(m) {
+				continue
+			}
+			if err := stream.Send(m); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metricserver
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gvisor.dev/gvisor/pkg/metric"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+var (
+	counter = metric.MustCreateNewUint64Metric("/test/counter", false, "A counter.")
+	other   = metric.MustCreateNewUint64Metric("/test/other", false, "Another counter.")
+	group   = metric.MustCreateNewUpdateGroup()
+)
+
+func init() {
+	// Updates where at least 2 fieldless counters changed carry them in a
+	// ScalarBatch.
+	if err := metric.SetScalarBatchThreshold(2); err != nil {
+		panic(err)
+	}
+	if err := metric.Initialize(); err != nil {
+		panic(err)
+	}
+}
+
+// newClient serves the Metrics service in-process and returns a client for
+// it. The server is stopped when the test ends.
+func newClient(t *testing.T) pb.MetricsClient {
+	t.Helper()
+	return serve(t, NewServer())
+}
+
+// serve serves srv in-process and returns a client for it. The server is
+// stopped when the test ends.
+func serve(t *testing.T, srv *Server) pb.MetricsClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	pb.RegisterMetricsServer(s, srv)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return lis.Dial()
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewMetricsClient(conn)
+}
+
+// values returns the uint64 values in m, including batched ones, by metric
+// name.
+func values(m *pb.MetricUpdate) map[string]uint64 {
+	values := make(map[string]uint64)
+	for _, v := range m.GetMetrics() {
+		values[v.GetName()] = v.GetUint64Value()
+	}
+	registered := metric.GetRegistration().GetMetrics()
+	batch := m.GetScalarBatch()
+	for i, index := range batch.GetMetricIndex() {
+		values[registered[index].GetName()] = batch.GetValue()[i]
+	}
+	return values
+}
+
+func TestGetRegistration(t *testing.T) {
+	client := newClient(t)
+	reg, err := client.GetRegistration(context.Background(), &pb.GetRegistrationRequest{})
+	if err != nil {
+		t.Fatalf("GetRegistration: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, m := range reg.GetMetrics() {
+		names[m.GetName()] = true
+	}
+	for _, name := range []string{"/test/counter", "/test/other"} {
+		if !names[name] {
+			t.Errorf("GetRegistration got %v, want %s", names, name)
+		}
+	}
+}
+
+func TestGetMetrics(t *testing.T) {
+	client := newClient(t)
+	ctx := context.Background()
+
+	// The first call returns all metrics.
+	m, err := client.GetMetrics(ctx, &pb.GetMetricsRequest{})
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	got := values(m)
+	for _, name := range []string{"/test/counter", "/test/other"} {
+		if _, ok := got[name]; !ok {
+			t.Errorf("first GetMetrics got %v, want %s", got, name)
+		}
+	}
+
+	// Later calls only return changed metrics.
+	counter.Increment()
+	m, err = client.GetMetrics(ctx, &pb.GetMetricsRequest{})
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	got = values(m)
+	if _, ok := got["/test/counter"]; !ok || len(got) != 1 {
+		t.Errorf("GetMetrics after increment got %v, want only /test/counter", got)
+	}
+
+	// Unless a full update is requested.
+	m, err = client.GetMetrics(ctx, &pb.GetMetricsRequest{Full: true})
+	if err != nil {
+		t.Fatalf("GetMetrics: %v", err)
+	}
+	got = values(m)
+	if got["/test/counter"] != counter.Value() {
+		t.Errorf("full GetMetrics got /test/counter=%d want %d", got["/test/counter"], counter.Value())
+	}
+	if _, ok := got["/test/other"]; !ok {
+		t.Errorf("full GetMetrics got %v, want /test/other", got)
+	}
+}
+
+func TestStreamMetricsPeriod(t *testing.T) {
+	client := newClient(t)
+	for _, period := range []time.Duration{0, -1, time.Nanosecond, MinStreamPeriod - 1} {
+		stream, err := client.StreamMetrics(context.Background(), &pb.StreamMetricsRequest{PeriodNs: int64(period)})
+		if err != nil {
+			t.Fatalf("StreamMetrics: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("StreamMetrics with period %v got err %v want %v", period, err, codes.InvalidArgument)
+		}
+	}
+}
+
+func TestStreamMetrics(t *testing.T) {
+	client := newClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.StreamMetrics(ctx, &pb.StreamMetricsRequest{PeriodNs: int64(MinStreamPeriod)})
+	if err != nil {
+		t.Fatalf("StreamMetrics: %v", err)
+	}
+
+	// The first update contains all metrics.
+	m, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if got := values(m); got["/test/other"] != other.Value() {
+		t.Errorf("first update got %v, want /test/other=%d", got, other.Value())
+	}
+
+	// Later updates only contain changed metrics, and updates without changes
+	// are skipped.
+	other.IncrementBy(2)
+	m, err = stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if got := values(m); len(got) != 1 || got["/test/other"] != other.Value() {
+		t.Errorf("update got %v, want only /test/other=%d", got, other.Value())
+	}
+
+	// Canceling the stream ends it.
+	cancel()
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Errorf("Recv after cancel got err %v want %v", err, codes.Canceled)
+	}
+}
+
+func TestStreamMetricsScalarBatch(t *testing.T) {
+	client := newClient(t)
+	// The update is only received if it isn't mistaken for an empty one.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.StreamMetrics(ctx, &pb.StreamMetricsRequest{PeriodNs: int64(MinStreamPeriod)})
+	if err != nil {
+		t.Fatalf("StreamMetrics: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	// An update whose only values are batched is still sent. Both counters
+	// are updated in a group so that they change in the same update.
+	group.Update(func() {
+		counter.Increment()
+		other.Increment()
+	})
+	m, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if len(m.GetMetrics()) != 0 || m.GetScalarBatch() == nil {
+		t.Errorf("update got %v, want only a ScalarBatch", m)
+	}
+	want := map[string]uint64{"/test/counter": counter.Value(), "/test/other": other.Value()}
+	if got := values(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("update got %v want %v", got, want)
+	}
+}
+
+func TestStreamMetricsShutdown(t *testing.T) {
+	// Metrics can only be shut down once, so the shutdown is simulated to
+	// keep the other tests working.
+	srv := NewServer()
+	shutdown := make(chan struct{})
+	srv.shutdown = shutdown
+	client := serve(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.StreamMetrics(ctx, &pb.StreamMetricsRequest{PeriodNs: int64(MinStreamPeriod)})
+	if err != nil {
+		t.Fatalf("StreamMetrics: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+
+	// Shutting down metrics ends the stream.
+	close(shutdown)
+	for {
+		_, err := stream.Recv()
+		if err == nil {
+			// An update sent before the shutdown was noticed.
+			continue
+		}
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Recv after shutdown got err %v want %v", err, codes.Unavailable)
+		}
+		break
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrictest provides utilities to test code that records metrics
+// with package metric.
+//
+// Metrics are process-wide, so tests using this package must not run in
+// parallel with each other. A typical test looks like:
+//
+//	func TestFoo(t *testing.T) {
+//		metrictest.Reset()
+//		doFoo()
+//		metrictest.AssertCounter(t, "/foo/count", 1)
+//	}
+package metrictest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"gvisor.dev/gvisor/pkg/eventchannel"
+	"gvisor.dev/gvisor/pkg/metric"
+	"gvisor.dev/gvisor/pkg/metric/internal/emitstate"
+	"gvisor.dev/gvisor/pkg/metric/internal/fakeclock"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// Emitter is an eventchannel.Emitter that captures all emitted messages.
+type Emitter struct {
+	// mu protects msgs.
+	mu sync.Mutex
+
+	// msgs contains the emitted messages, in order.
+	msgs []proto.Message
+}
+
+// Emit implements eventchannel.Emitter.Emit.
+func (e *Emitter) Emit(msg proto.Message) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.msgs = append(e.msgs, msg)
+	return false, nil
+}
+
+// Close implements eventchannel.Emitter.Close.
+func (e *Emitter) Close() error {
+	return nil
+}
+
+// Messages returns all messages captured since the last call to Reset.
+func (e *Emitter) Messages() []proto.Message {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]proto.Message(nil), e.msgs...)
+}
+
+// Registrations returns the metric registrations captured since the last call
+// to Reset.
+func (e *Emitter) Registrations() []*pb.MetricRegistration {
+	var registrations []*pb.MetricRegistration
+	for _, msg := range e.Messages() {
+		if r, ok := msg.(*pb.MetricRegistration); ok {
+			registrations = append(registrations, r)
+		}
+	}
+	return registrations
+}
+
+// Updates returns the metric updates captured since the last call to Reset.
+func (e *Emitter) Updates() []*pb.MetricUpdate {
+	var updates []*pb.MetricUpdate
+	for _, msg := range e.Messages() {
+		if u, ok := msg.(*pb.MetricUpdate); ok {
+			updates = append(updates, u)
+		}
+	}
+	return updates
+}
+
+// Reset discards all captured messages.
+func (e *Emitter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.msgs = nil
+}
+
+var (
+	// emitterOnce installs emitter.
+	emitterOnce sync.Once
+
+	// emitter is returned by CaptureEmits.
+	emitter Emitter
+)
+
+// CaptureEmits returns an Emitter capturing all messages sent over the event
+// channel from now on. Package eventchannel doesn't allow removing emitters,
+// so the same Emitter is returned to all callers.
+func CaptureEmits() *Emitter {
+	emitterOnce.Do(func() {
+		eventchannel.AddEmitter(&emitter)
+	})
+	return &emitter
+}
+
+var (
+	// baselineMu protects baseline.
+	baselineMu sync.Mutex
+
+	// baseline maps the keys of metric points, as returned by pointKey, to
+	// their value at the last call to Reset.
+	baseline map[string]metric.MetricPoint
+)
+
+// pointKey returns the key of a metric point in baseline.
+func pointKey(name string, fieldValues []string) string {
+	return fmt.Sprint(name, fieldValues)
+}
+
+// Reset isolates the calling test from metrics recorded before it:
+//   - Value, Buckets and AssertCounter report the values of cumulative metrics
+//     relative to their values at the time of Reset.
+//   - The next metric.EmitMetricUpdate only contains changes made after Reset.
+//   - The messages captured by CaptureEmits are discarded.
+//
+// Reset doesn't emit anything, so emitters other than the one returned by
+// CaptureEmits don't observe it. Metric registrations are not affected, and
+// metrics must have been initialized (see metric.Initialize).
+func Reset() {
+	emitstate.Reset()
+	CaptureEmits().Reset()
+
+	baselineMu.Lock()
+	defer baselineMu.Unlock()
+	baseline = make(map[string]metric.MetricPoint)
+	for _, m := range metric.GetSnapshot().Metrics {
+		if !m.Metadata.GetCumulative() {
+			continue
+		}
+		for _, p := range m.Points {
+			baseline[pointKey(m.Metadata.GetName(), p.FieldValues)] = p
+		}
+	}
+}
+
+// point returns the current value of the given metric and field values, and
+// its value at the last call to Reset if the metric is cumulative.
+func point(t testing.TB, name string, fieldValues []string) (*pb.MetricMetadata, metric.MetricPoint, metric.MetricPoint) {
+	t.Helper()
+	baselineMu.Lock()
+	base := baseline[pointKey(name, fieldValues)]
+	baselineMu.Unlock()
+	for _, m := range metric.GetSnapshot().Metrics {
+		if m.Metadata.GetName() != name {
+			continue
+		}
+		for _, p := range m.Points {
+			if fmt.Sprint(p.FieldValues) == fmt.Sprint(fieldValues) {
+				return m.Metadata, p, base
+			}
+		}
+		t.Fatalf("metric %s has no value for fields %v", name, fieldValues)
+	}
+	t.Fatalf("metric %s not found", name)
+	panic("unreachable")
+}
+
+// Value returns the value of the uint64 metric with the given name and field
+// values. The values of cumulative metrics are relative to the last call to
+// Reset.
+func Value(t testing.TB, name string, fieldValues ...string) uint64 {
+	t.Helper()
+	md, p, base := point(t, name, fieldValues)
+	if md.GetType() != pb.MetricMetadata_TYPE_UINT64 {
+		t.Fatalf("metric %s has type %v, want %v", name, md.GetType(), pb.MetricMetadata_TYPE_UINT64)
+	}
+	return p.Uint64 - base.Uint64
+}
+
+// Buckets returns the number of samples in each bucket of the distribution
+// metric with the given name and field values, with the same layout as
+// metric.MetricPoint.Samples. The samples of cumulative distributions are
+// relative to the last call to Reset, or to the last reset of the
+// distribution (see metric.DistributionMetric.Reset) if it was reset since
+// then and has fewer samples than at Reset in some bucket.
+func Buckets(t testing.TB, name string, fieldValues ...string) []uint64 {
+	t.Helper()
+	md, p, base := point(t, name, fieldValues)
+	if md.GetType() != pb.MetricMetadata_TYPE_DISTRIBUTION {
+		t.Fatalf("metric %s has type %v, want %v", name, md.GetType(), pb.MetricMetadata_TYPE_DISTRIBUTION)
+	}
+	buckets := append([]uint64(nil), p.Samples...)
+	if len(base.Samples) != len(buckets) {
+		return buckets
+	}
+	for i := range buckets {
+		if buckets[i] < base.Samples[i] {
+			// The distribution was reset since the baseline was taken,
+			// so its samples are all more recent than the baseline.
+			return buckets
+		}
+	}
+	for i := range buckets {
+		buckets[i] -= base.Samples[i]
+	}
+	return buckets
+}
+
+// AssertCounter checks that the uint64 metric with the given name and field
+// values has value want, as returned by Value.
+func AssertCounter(t testing.TB, name string, want uint64, fieldValues ...string) {
+	t.Helper()
+	if got := Value(t, name, fieldValues...); got != want {
+		t.Errorf("metric %s%v: got %d want %d", name, fieldValues, got, want)
+	}
+}
+
+// Clock is a fake clock observed by timer metrics and initialization stages.
+// It only moves forward when Advance is called, which makes the durations
+// they record deterministic.
+type Clock struct {
+	// mu protects now.
+	mu sync.Mutex
+
+	// now is the current time of the clock.
+	now time.Time
+}
+
+// NewClock installs and returns a fake clock starting at start, which must be
+// after the Unix epoch. The real clock is restored when the test completes.
+//
+// The fake clock requires building with the metric_fakeclock tag, so that
+// production builds read the real clock directly; without it, the test is
+// skipped.
+func NewClock(t testing.TB, start time.Time) *Clock {
+	t.Helper()
+	if !fakeclock.Enabled {
+		t.Skip("the fake metric clock requires building with the metric_fakeclock tag")
+	}
+	fakeclock.Set(start)
+	t.Cleanup(fakeclock.Clear)
+	return &Clock{now: start}
+}
+
+// Now returns the current time of c.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves c forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	fakeclock.Set(c.now)
+}
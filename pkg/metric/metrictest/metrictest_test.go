@@ -0,0 +1,111 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrictest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/eventchannel"
+	"gvisor.dev/gvisor/pkg/metric"
+)
+
+var (
+	counter = metric.MustCreateNewUint64Metric("/metrictest/counter", false, "A counter", metric.NewField("field", []string{"a", "b"}))
+	timer   = metric.MustRegisterTimerMetric("/metrictest/timer", metric.NewDurationBucketer(5, time.Millisecond, time.Second), "A timer")
+
+	// otherEmitter stands for an emitter that isn't used for testing, which
+	// Reset must not publish to.
+	otherEmitter Emitter
+)
+
+func init() {
+	CaptureEmits()
+	eventchannel.AddEmitter(&otherEmitter)
+	if err := metric.Initialize(); err != nil {
+		panic(err)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	otherEmitter.Reset()
+	counter.IncrementBy(5, "a")
+	Reset()
+	if got := CaptureEmits().Messages(); len(got) != 0 {
+		t.Errorf("Messages() after Reset got %v want none", got)
+	}
+	if got := otherEmitter.Updates(); len(got) != 0 {
+		t.Errorf("Reset emitted %v", got)
+	}
+	AssertCounter(t, "/metrictest/counter", 0, "a")
+
+	counter.IncrementBy(2, "a")
+	counter.Increment("b")
+	AssertCounter(t, "/metrictest/counter", 2, "a")
+	AssertCounter(t, "/metrictest/counter", 1, "b")
+
+	metric.EmitMetricUpdate()
+	updates := CaptureEmits().Updates()
+	if len(updates) != 1 {
+		t.Fatalf("Updates() got %v want one update", updates)
+	}
+	got := make(map[string]uint64)
+	for _, m := range updates[0].GetMetrics() {
+		if m.GetName() == "/metrictest/counter" {
+			got[m.GetFieldValues()[0]] = m.GetUint64Value()
+		}
+	}
+	// Updates carry absolute values of counters.
+	if want := map[string]uint64{"a": counter.Value("a"), "b": counter.Value("b")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("update got %v want %v", got, want)
+	}
+}
+
+func TestTimer(t *testing.T) {
+	Reset()
+	clock := NewClock(t, time.Unix(1000, 0))
+	op := timer.Start()
+	clock.Advance(2 * time.Millisecond)
+	op.Finish()
+
+	want := make([]uint64, timer.NumBuckets())
+	want[timer.BucketForDuration(2*time.Millisecond)+1] = 1
+	if got := Buckets(t, "/metrictest/timer"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Buckets() got %v want %v", got, want)
+	}
+}
+
+func TestBucketsAfterDistributionReset(t *testing.T) {
+	clock := NewClock(t, time.Unix(1000, 0))
+	for i := 0; i < 2; i++ {
+		op := timer.Start()
+		clock.Advance(2 * time.Millisecond)
+		op.Finish()
+	}
+	Reset()
+	timer.Reset()
+	op := timer.Start()
+	clock.Advance(2 * time.Millisecond)
+	op.Finish()
+
+	// The sample recorded since the reset is reported, rather than an
+	// underflowed difference with the baseline.
+	want := make([]uint64, timer.NumBuckets())
+	want[timer.BucketForDuration(2*time.Millisecond)+1] = 1
+	if got := Buckets(t, "/metrictest/timer"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Buckets() got %v want %v", got, want)
+	}
+}
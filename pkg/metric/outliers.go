@@ -0,0 +1,123 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Outlier is a sample of a distribution that exceeded its outlier threshold.
+// See DistributionMetric.RecordOutliers.
+type Outlier struct {
+	// Value is the exact value of the sample.
+	Value int64
+
+	// Label is the label passed to AddSampleWithLabel, if any.
+	Label string
+}
+
+// outlierBuffer is a bounded ring buffer of the most recent outliers of a
+// distribution. It is written to without locks so that it can be used from
+// AddSample.
+type outlierBuffer struct {
+	// threshold is the value above which samples are recorded. It is
+	// immutable.
+	threshold int64
+
+	// next is the number of outliers ever recorded; the next outlier is
+	// written to slots[next % len(slots)]. It is accessed atomically.
+	next uint64
+
+	// slots holds the most recent outliers. Its length is immutable.
+	slots []outlierSlot
+}
+
+// RecordOutliers makes the distribution record the exact value of samples
+// greater than threshold, in addition to counting them in their bucket. The
+// last capacity such samples are kept, and can be retrieved with Outliers.
+//
+// This is meant to debug tail latencies, where the bucket of slow samples is
+// too coarse. When outliers are not recorded, they cost AddSample a single
+// branch.
+//
+// RecordOutliers must be called when the metric is defined (i.e., at init),
+// and capacity must be positive.
+func (d *DistributionMetric) RecordOutliers(threshold int64, capacity int) error {
+	if err := lockRegistration(fmt.Sprintf("record outliers of %q", d.metadata.GetName())); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return ErrInitializationDone
+	}
+	if capacity <= 0 {
+		return fmt.Errorf("%w: outlier capacity must be positive, got %d", ErrInvalidArgument, capacity)
+	}
+	d.outliers = &outlierBuffer{
+		threshold: threshold,
+		slots:     make([]outlierSlot, capacity),
+	}
+	return nil
+}
+
+// AddSampleWithLabel is like AddSample, but attaches label to the sample if it
+// is recorded as an outlier. See RecordOutliers.
+//
+// Unlike AddSample, it may allocate, so it must not be used where AddSample's
+// nosplit guarantees are needed.
+func (d *DistributionMetric) AddSampleWithLabel(sample int64, label string, fields ...string) {
+	d.addLabeledSampleByKey(sample, d.fieldsToKey.lookup(fields...), &label)
+}
+
+// Outliers returns the most recent samples recorded as outliers, from oldest
+// to newest. It returns nil if the distribution does not record outliers.
+//
+// Outliers is a debugging aid: outliers recorded concurrently with the call
+// may be omitted, and so may an outlier recorded concurrently with another one
+// once the buffer has wrapped around onto the same slot.
+func (d *DistributionMetric) Outliers() []Outlier {
+	o := d.outliers
+	if o == nil {
+		return nil
+	}
+	type seqOutlier struct {
+		seq     uint64
+		outlier Outlier
+	}
+	recorded := make([]seqOutlier, 0, len(o.slots))
+	for i := range o.slots {
+		if seq, outlier, ok := o.slots[i].load(); ok {
+			recorded = append(recorded, seqOutlier{seq, outlier})
+		}
+	}
+	sort.Slice(recorded, func(i, j int) bool {
+		return recorded[i].seq < recorded[j].seq
+	})
+	outliers := make([]Outlier, len(recorded))
+	for i, r := range recorded {
+		outliers[i] = r.outlier
+	}
+	return outliers
+}
+
+// record records an outlier sample, with an optional label.
+// +checkescape:all
+//go:nosplit
+func (o *outlierBuffer) record(sample int64, label *string) {
+	seq := atomic.AddUint64(&o.next, 1)
+	o.slots[(seq-1)%uint64(len(o.slots))].store(seq, sample, label)
+}
@@ -0,0 +1,107 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestOutliers(t *testing.T) {
+	defer reset()
+
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(4, 10, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription, NewField("field", []string{"a", "b"}))
+	if err != nil {
+		t.Fatalf("NewDistributionMetric got err %v want nil", err)
+	}
+	if got := distrib.Outliers(); got != nil {
+		t.Errorf("Outliers() without RecordOutliers got %v want nil", got)
+	}
+	if err := distrib.RecordOutliers(100, 0); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("RecordOutliers with capacity 0 got err %v want %v", err, ErrInvalidArgument)
+	}
+	if err := distrib.RecordOutliers(100, 3); err != nil {
+		t.Fatalf("RecordOutliers got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if err := distrib.RecordOutliers(100, 3); err != ErrInitializationDone {
+		t.Errorf("RecordOutliers after Initialize got err %v want %v", err, ErrInitializationDone)
+	}
+
+	distrib.AddSample(5, "a")
+	distrib.AddSample(100, "a")
+	if got := distrib.Outliers(); len(got) != 0 {
+		t.Errorf("Outliers() got %v want none", got)
+	}
+	distrib.AddSample(101, "a")
+	distrib.AddSampleWithLabel(200, "slow", "b")
+	distrib.AddSampleWithLabel(50, "fast", "b")
+	want := []Outlier{{Value: 101}, {Value: 200, Label: "slow"}}
+	if got := distrib.Outliers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Outliers() got %v want %v", got, want)
+	}
+
+	// Only the last 3 outliers are kept.
+	distrib.AddSample(300, "a")
+	distrib.AddSample(400, "b")
+	want = []Outlier{{Value: 200, Label: "slow"}, {Value: 300}, {Value: 400}}
+	if got := distrib.Outliers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Outliers() got %v want %v", got, want)
+	}
+
+	// Outliers are also counted in their bucket.
+	s := GetSnapshot()
+	var total uint64
+	for _, m := range s.Metrics {
+		for _, p := range m.Points {
+			for _, n := range p.Samples {
+				total += n
+			}
+		}
+	}
+	if total != 7 {
+		t.Errorf("snapshot got %d samples want 7", total)
+	}
+}
+
+func TestOutlierSlotStore(t *testing.T) {
+	var s outlierSlot
+	if _, _, ok := s.load(); ok {
+		t.Errorf("load() of empty slot got ok")
+	}
+	s.store(5, 500, nil)
+	// A writer that was overtaken by a more recent one while wrapping around
+	// the buffer doesn't overwrite its outlier.
+	label := "late"
+	s.store(2, 200, &label)
+	if seq, outlier, ok := s.load(); !ok || seq != 5 || outlier != (Outlier{Value: 500}) {
+		t.Errorf("load() got (%d, %v, %t) want (5, %v, true)", seq, outlier, ok, Outlier{Value: 500})
+	}
+
+	// Neither does a writer racing with another one on the slot.
+	s.seq = outlierWriting
+	s.store(8, 800, &label)
+	if _, _, ok := s.load(); ok {
+		t.Errorf("load() of slot being written got ok")
+	}
+	if s.value != 500 {
+		t.Errorf("slot being written got value %d from concurrent writer, want 500", s.value)
+	}
+}
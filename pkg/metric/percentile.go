@@ -0,0 +1,135 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"math"
+)
+
+// Percentile estimates the p-th percentile (0 <= p <= 100) of a distribution
+// by linear interpolation within the bucket containing it, i.e. assuming that
+// samples are uniformly distributed within each bucket.
+//
+// lowerBounds and samples have the same layout as
+// pb.MetricMetadata.DistributionBucketLowerBounds and pb.Samples.NewSamples.
+// Percentiles falling in the underflow or overflow bucket are estimated as
+// the lower bound of the first finite bucket or of the overflow bucket,
+// respectively, as these buckets are unbounded.
+func Percentile(lowerBounds []int64, samples []uint64, p float64) (float64, error) {
+	return percentile(lowerBounds, samples, p, 0)
+}
+
+// PercentileWithSum is like Percentile, but uses the exact sum of all samples
+// (e.g. tracked with a CountSumMetric) to refine the estimate.
+//
+// Uniform interpolation implies that the mean of each bucket is its midpoint.
+// When the known sum differs from the sum of bucket midpoints, the samples
+// are skewed towards the low or high end of their buckets. PercentileWithSum
+// then replaces the uniform density within each finite bucket by a linear
+// density, tilted by the same relative amount in every bucket so that the
+// mean of the distribution matches the known sum. A linear density can shift
+// the mean of a bucket by at most a sixth of its width, so larger
+// discrepancies (e.g. due to an inconsistent sum) are only partially
+// corrected.
+//
+// The refinement assumes that the skew is similar across buckets, which holds
+// for smooth distributions with buckets that are narrow relative to their
+// variations, e.g. latencies with exponential buckets. It is only applied
+// when there are no samples in the underflow or overflow buckets, whose
+// contribution to the sum is unknown; otherwise, the result is the same as
+// Percentile.
+func PercentileWithSum(lowerBounds []int64, samples []uint64, sum float64, p float64) (float64, error) {
+	if err := checkPercentileArgs(lowerBounds, samples, p); err != nil {
+		return 0, err
+	}
+	if samples[0] != 0 || samples[len(samples)-1] != 0 {
+		return percentile(lowerBounds, samples, p, 0)
+	}
+	// Find the tilt t in [-1, 1] such that the mean of each finite bucket is
+	// its midpoint plus t/6 of its width, and the sum of all samples matches.
+	var midpointSum, maxShift float64
+	for i := 1; i < len(samples)-1; i++ {
+		n := float64(samples[i])
+		low, high := float64(lowerBounds[i-1]), float64(lowerBounds[i])
+		midpointSum += n * (low + high) / 2
+		maxShift += n * (high - low) / 6
+	}
+	var tilt float64
+	if maxShift > 0 {
+		tilt = math.Max(-1, math.Min(1, (sum-midpointSum)/maxShift))
+	}
+	return percentile(lowerBounds, samples, p, tilt)
+}
+
+// checkPercentileArgs returns an error if the arguments of Percentile are
+// invalid.
+func checkPercentileArgs(lowerBounds []int64, samples []uint64, p float64) error {
+	if len(lowerBounds) < 1 || len(samples) != len(lowerBounds)+1 {
+		return fmt.Errorf("%w: %d lower bounds, %d buckets", ErrInvalidDistribution, len(lowerBounds), len(samples))
+	}
+	if !(p >= 0 && p <= 100) {
+		return fmt.Errorf("%w: percentile must be within [0, 100], got %v", ErrInvalidArgument, p)
+	}
+	return nil
+}
+
+// percentile estimates the p-th percentile of a distribution, assuming that
+// samples within each finite bucket follow a linear density whose mean is
+// shifted from the midpoint of the bucket by tilt/6 of its width. A tilt of 0
+// is the uniform density.
+func percentile(lowerBounds []int64, samples []uint64, p float64, tilt float64) (float64, error) {
+	if err := checkPercentileArgs(lowerBounds, samples, p); err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, n := range samples {
+		total += n
+	}
+	if total == 0 {
+		return 0, fmt.Errorf("%w: distribution has no samples", ErrInvalidArgument)
+	}
+	rank := p / 100 * float64(total)
+	var before float64
+	for i, n := range samples {
+		count := float64(n)
+		if n == 0 || before+count < rank {
+			before += count
+			continue
+		}
+		switch i {
+		case 0:
+			return float64(lowerBounds[0]), nil
+		case len(samples) - 1:
+			return float64(lowerBounds[len(lowerBounds)-1]), nil
+		}
+		low, high := float64(lowerBounds[i-1]), float64(lowerBounds[i])
+		return low + (high-low)*linearQuantile((rank-before)/count, 2*tilt), nil
+	}
+	// Only reached if rounding errors accumulate; the percentile is the
+	// maximum.
+	return float64(lowerBounds[len(lowerBounds)-1]), nil
+}
+
+// linearQuantile returns the q-th quantile of the density 1 + c*(u - 1/2) on
+// [0, 1], with c in [-2, 2], whose mean is 1/2 + c/12.
+func linearQuantile(q, c float64) float64 {
+	// The CDF is u + c*(u^2 - u)/2; solve for CDF(u) = q.
+	if math.Abs(c) < 1e-9 {
+		return q
+	}
+	b := 1 - c/2
+	return (-b + math.Sqrt(b*b+2*c*q)) / c
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// bucketize returns the samples of a distribution with the given lower bounds
+// containing values, and their sum.
+func bucketize(lowerBounds []int64, values []float64) ([]uint64, float64) {
+	samples := make([]uint64, len(lowerBounds)+1)
+	var sum float64
+	for _, v := range values {
+		i := 0
+		for i < len(lowerBounds) && v >= float64(lowerBounds[i]) {
+			i++
+		}
+		samples[i]++
+		sum += v
+	}
+	return samples, sum
+}
+
+func TestPercentileUniform(t *testing.T) {
+	lowerBounds := []int64{0, 100, 200, 400}
+	// 100 samples uniformly spread over [0, 400).
+	var values []float64
+	for i := 0; i < 100; i++ {
+		values = append(values, float64(i)*4+2)
+	}
+	samples, sum := bucketize(lowerBounds, values)
+	for _, p := range []float64{0, 10, 25, 50, 90, 100} {
+		want := 4 * p
+		got, err := Percentile(lowerBounds, samples, p)
+		if err != nil {
+			t.Fatalf("Percentile(%v): %v", p, err)
+		}
+		if math.Abs(got-want) > 1e-9 {
+			t.Errorf("Percentile(%v) got %v want %v", p, got, want)
+		}
+		// The sum matches uniform buckets, so it doesn't change the estimate.
+		gotWithSum, err := PercentileWithSum(lowerBounds, samples, sum, p)
+		if err != nil {
+			t.Fatalf("PercentileWithSum(%v): %v", p, err)
+		}
+		if math.Abs(gotWithSum-want) > 1e-9 {
+			t.Errorf("PercentileWithSum(%v) got %v want %v", p, gotWithSum, want)
+		}
+	}
+}
+
+func TestPercentileWithSumExponential(t *testing.T) {
+	// Samples of an exponential distribution with mean 100, whose density
+	// decreases within every bucket.
+	const n = 10000
+	exponentialPercentile := func(p float64) float64 {
+		return -100 * math.Log(1-p/100)
+	}
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = exponentialPercentile(100 * (float64(i) + 0.5) / n)
+	}
+	lowerBounds := make([]int64, 11)
+	for i := range lowerBounds {
+		lowerBounds[i] = int64(i) * 100
+	}
+	samples, sum := bucketize(lowerBounds, values)
+
+	var uniformError, sumError float64
+	for _, p := range []float64{10, 25, 50, 75, 90} {
+		want := exponentialPercentile(p)
+		uniform, err := Percentile(lowerBounds, samples, p)
+		if err != nil {
+			t.Fatalf("Percentile(%v): %v", p, err)
+		}
+		withSum, err := PercentileWithSum(lowerBounds, samples, sum, p)
+		if err != nil {
+			t.Fatalf("PercentileWithSum(%v): %v", p, err)
+		}
+		t.Logf("p%v: exact %.2f, uniform %.2f, with sum %.2f", p, want, uniform, withSum)
+		if math.Abs(withSum-want) > math.Abs(uniform-want) {
+			t.Errorf("p%v: estimate with sum %v is further from %v than uniform estimate %v", p, withSum, want, uniform)
+		}
+		uniformError += math.Abs(uniform - want)
+		sumError += math.Abs(withSum - want)
+	}
+	if sumError > uniformError/2 {
+		t.Errorf("total error with sum %v, want less than half of uniform error %v", sumError, uniformError)
+	}
+}
+
+func TestPercentileErrors(t *testing.T) {
+	lowerBounds := []int64{0, 10}
+	if _, err := Percentile(lowerBounds, []uint64{0, 0, 0}, 50); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Percentile of empty distribution got err %v want %v", err, ErrInvalidArgument)
+	}
+	if _, err := Percentile(lowerBounds, []uint64{0, 1, 0}, 101); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("Percentile(101) got err %v want %v", err, ErrInvalidArgument)
+	}
+	if _, err := PercentileWithSum(lowerBounds, []uint64{0, 1}, 5, 50); !errors.Is(err, ErrInvalidDistribution) {
+		t.Errorf("PercentileWithSum of inconsistent distribution got err %v want %v", err, ErrInvalidDistribution)
+	}
+	// Unbounded buckets are estimated at their finite bound.
+	if got, err := Percentile(lowerBounds, []uint64{1, 0, 1}, 100); err != nil || got != 10 {
+		t.Errorf("Percentile(100) got (%v, %v) want (10, nil)", got, err)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"math"
+
+	"gvisor.dev/gvisor/pkg/metric"
+)
+
+// Bounds of native histogram schemas supported by Prometheus.
+const (
+	minNativeSchema = -4
+	maxNativeSchema = 8
+)
+
+// NativeHistogram is a distribution metric point translated to a Prometheus
+// native (sparse) histogram.
+//
+// Native histogram bucket i of schema s covers the range (base^(i-1), base^i],
+// where base = 2^(2^-s). Each bucket of the distribution is mapped to the
+// single native bucket that contains its geometric midpoint (or, for the
+// overflow bucket, values just above its lower bound), so the total
+// number of samples is preserved exactly, and the shape of the distribution
+// is preserved within the resolution of the coarser of the two bucket
+// schemes. Samples in buckets that only contain values <= 0, including the
+// underflow bucket, are counted in the zero bucket, whose threshold is 0.
+//
+// NativeHistogram only describes the translation; nothing exports it yet.
+// Collector exports distributions as classic histograms, as exposing native
+// histograms requires client_golang v1.14 and client_model v0.3, and this
+// tree pins v1.7.1 and v0.2.0. Once they are upgraded, Collector can gain an
+// option filling the sparse fields of dto.Histogram from NativeHistograms.
+type NativeHistogram struct {
+	// Schema is the resolution of the native histogram.
+	Schema int32
+
+	// ZeroCount is the number of samples in the zero bucket.
+	ZeroCount uint64
+
+	// Count is the total number of samples.
+	Count uint64
+
+	// PositiveBuckets maps the index of non-empty positive native buckets
+	// to their number of samples.
+	PositiveBuckets map[int]uint64
+}
+
+// NativeSchema returns the native histogram schema whose bucket growth factor
+// best matches growth without being coarser, i.e. the smallest schema s such
+// that 2^(2^-s) <= growth, clamped to the schemas supported by Prometheus.
+func NativeSchema(growth float64) int32 {
+	if !(growth > 1) {
+		return maxNativeSchema
+	}
+	schema := math.Ceil(-math.Log2(math.Log2(growth)))
+	switch {
+	case schema < minNativeSchema:
+		return minNativeSchema
+	case schema > maxNativeSchema:
+		return maxNativeSchema
+	default:
+		return int32(schema)
+	}
+}
+
+// ToNativeHistogram translates the samples of a distribution, with the
+// layout of metric.MetricPoint.Samples, to a native histogram of the given
+// schema (see NativeSchema). lowerBounds are the lower bounds of the finite
+// and overflow buckets, as in pb.MetricMetadata.DistributionBucketLowerBounds.
+func ToNativeHistogram(schema int32, lowerBounds []int64, samples []uint64) NativeHistogram {
+	h := NativeHistogram{
+		Schema:          schema,
+		PositiveBuckets: make(map[int]uint64),
+	}
+	scale := math.Exp2(float64(schema))
+	for i, n := range samples {
+		h.Count += n
+		if n == 0 {
+			continue
+		}
+		if i == 0 {
+			h.ZeroCount += n
+			continue
+		}
+		// Bucket i contains integer samples in [low, high].
+		low := lowerBounds[i-1]
+		high := int64(math.MaxInt64)
+		if i < len(lowerBounds) {
+			high = lowerBounds[i] - 1
+		}
+		if high <= 0 {
+			h.ZeroCount += n
+			continue
+		}
+		if low < 1 {
+			low = 1
+		}
+		var index int
+		if i == len(lowerBounds) {
+			// The overflow bucket has no meaningful upper bound, so use the
+			// native bucket containing the values just above its lower bound.
+			index = int(math.Floor(math.Log2(float64(low))*scale)) + 1
+		} else {
+			mid := math.Sqrt(float64(low) * float64(high))
+			index = int(math.Ceil(math.Log2(mid) * scale))
+		}
+		h.PositiveBuckets[index] += n
+	}
+	return h
+}
+
+// inferNativeSchema returns the native schema matching the growth factor of
+// the given distribution lower bounds, which is the ratio of the widths of
+// their last two finite buckets for exponential bucketers.
+func inferNativeSchema(lowerBounds []int64) int32 {
+	n := len(lowerBounds)
+	if n < 3 || lowerBounds[n-2] <= lowerBounds[n-3] {
+		return maxNativeSchema
+	}
+	return NativeSchema(float64(lowerBounds[n-1]-lowerBounds[n-2]) / float64(lowerBounds[n-2]-lowerBounds[n-3]))
+}
+
+// NativeHistograms returns the native histograms of all points of the given
+// distribution metric, in the same order as m.Points, with a schema inferred
+// from its bucket lower bounds. It returns nil for other metric types.
+func NativeHistograms(m metric.MetricSnapshot) []NativeHistogram {
+	lowerBounds := m.Metadata.GetDistributionBucketLowerBounds()
+	if lowerBounds == nil {
+		return nil
+	}
+	schema := inferNativeSchema(lowerBounds)
+	histograms := make([]NativeHistogram, len(m.Points))
+	for i, p := range m.Points {
+		histograms[i] = ToNativeHistogram(schema, lowerBounds, p.Samples)
+	}
+	return histograms
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/metric"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestNativeSchema(t *testing.T) {
+	for _, test := range []struct {
+		growth float64
+		want   int32
+	}{
+		{2, 0},
+		{4, -1},
+		{math.Sqrt2, 1},
+		{1.5, 1},
+		{1.1, 3},
+		{1 << 20, -4},
+		{1.0000001, 8},
+		{1, 8},
+	} {
+		if got := NativeSchema(test.growth); got != test.want {
+			t.Errorf("NativeSchema(%v) got %d want %d", test.growth, got, test.want)
+		}
+	}
+}
+
+func TestToNativeHistogram(t *testing.T) {
+	// Buckets: underflow, [0, 1), [1, 2), [2, 4), [4, 8), [8, 16), overflow.
+	lowerBounds := []int64{0, 1, 2, 4, 8, 16}
+	samples := []uint64{1, 2, 3, 0, 5, 6, 7}
+	h := ToNativeHistogram(0, lowerBounds, samples)
+	if h.Count != 24 {
+		t.Errorf("Count got %d want 24", h.Count)
+	}
+	// The underflow and [0, 1) buckets only contain samples <= 0.
+	if h.ZeroCount != 3 {
+		t.Errorf("ZeroCount got %d want 3", h.ZeroCount)
+	}
+	// With schema 0, native bucket i is (2^(i-1), 2^i]. Samples of each
+	// bucket land in the native bucket containing its geometric midpoint.
+	want := map[int]uint64{
+		0: 3, // [1, 1] -> (0.5, 1]
+		3: 5, // [4, 7] -> (4, 8]
+		4: 6, // [8, 15] -> (8, 16]
+		5: 7, // [16, +Inf) -> (16, 32]
+	}
+	if !reflect.DeepEqual(h.PositiveBuckets, want) {
+		t.Errorf("PositiveBuckets got %v want %v", h.PositiveBuckets, want)
+	}
+}
+
+func TestNativeHistograms(t *testing.T) {
+	md := &pb.MetricMetadata{
+		Type: pb.MetricMetadata_TYPE_DISTRIBUTION,
+		// An exponential bucketer with growth factor 2.
+		DistributionBucketLowerBounds: []int64{0, 10, 30, 70, 150},
+	}
+	m := metric.MetricSnapshot{
+		Metadata: md,
+		Points: []metric.MetricPoint{
+			{Samples: []uint64{0, 1, 2, 3, 4, 5}},
+		},
+	}
+	hs := NativeHistograms(m)
+	if len(hs) != 1 {
+		t.Fatalf("NativeHistograms got %d histograms want 1", len(hs))
+	}
+	h := hs[0]
+	if h.Schema != 0 {
+		t.Errorf("Schema got %d want 0", h.Schema)
+	}
+	var total uint64
+	for _, n := range h.PositiveBuckets {
+		total += n
+	}
+	if h.Count != 15 || total+h.ZeroCount != h.Count {
+		t.Errorf("got Count %d, %d samples in buckets, want 15 in total", h.Count, total+h.ZeroCount)
+	}
+	// Successive buckets map to non-decreasing native buckets.
+	prev := math.MinInt32
+	for i, lb := range md.DistributionBucketLowerBounds[:len(md.DistributionBucketLowerBounds)-1] {
+		h := ToNativeHistogram(0, md.DistributionBucketLowerBounds, oneSample(len(m.Points[0].Samples), i+1))
+		for index := range h.PositiveBuckets {
+			if index < prev {
+				t.Errorf("bucket with lower bound %d maps to native bucket %d, below previous bucket %d", lb, index, prev)
+			}
+			prev = index
+		}
+	}
+}
+
+// oneSample returns the samples of a distribution with numBuckets buckets and
+// a single sample in the given bucket.
+func oneSample(numBuckets, bucket int) []uint64 {
+	samples := make([]uint64, numBuckets)
+	samples[bucket] = 1
+	return samples
+}
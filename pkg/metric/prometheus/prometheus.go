@@ -0,0 +1,346 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prometheus bridges gVisor metrics to the Prometheus Go client
+// library, so that they can be served alongside the metrics of the program
+// embedding gVisor.
+package prometheus
+
+import (
+	"io"
+	"math"
+	"strings"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"gvisor.dev/gvisor/pkg/log"
+	"gvisor.dev/gvisor/pkg/metric"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// Collector implements prometheus.Collector for all gVisor metrics.
+//
+// Each gVisor metric maps to a single Prometheus metric:
+//   - Cumulative uint64 metrics map to counters.
+//   - Non-cumulative uint64 metrics map to gauges.
+//   - Distribution metrics map to histograms.
+//
+// Metric fields map to labels of the same name. Metric names are converted to
+// valid Prometheus names, e.g. "/fs/opens" becomes "fs_opens".
+//
+// Distribution metrics do not track the sum of their samples, so the sum of
+// the resulting histograms is always NaN. Their underflow and overflow
+// buckets are exported according to OutOfRange.
+//
+// Prometheus can't attach descriptions to label values. Instead, metrics
+// whose field values have descriptions have a companion gauge named
+// "<name>_field_info", with a constant value of 1 and "field", "value" and
+// "description" labels for each described field value.
+//
+// A Collector must not be copied once used.
+type Collector struct {
+	// Subsystem controls how the subsystem of metrics is exported. It must
+	// not be changed once the Collector is registered.
+	Subsystem SubsystemMode
+
+	// OutOfRange controls how the underflow and overflow buckets of
+	// distributions are exported. It must not be changed once the Collector
+	// is registered.
+	OutOfRange OutOfRangeMode
+
+	// OutOfRangeLabel is the name of the label distinguishing underflow and
+	// overflow samples with OutOfRangeSeparate. If empty, "range" is used.
+	// No distribution metric may have a field with that name.
+	OutOfRangeLabel string
+
+	// droppedMu protects dropped.
+	droppedMu sync.Mutex
+
+	// dropped contains the number of out-of-range samples of each point
+	// seen by the last collection with OutOfRangeDrop, keyed by
+	// droppedKey, so that only new ones are logged.
+	dropped map[string]outOfRangeCounts
+}
+
+// outOfRangeCounts are the sample counts of the underflow and overflow buckets
+// of a distribution point.
+type outOfRangeCounts struct {
+	underflow uint64
+	overflow  uint64
+}
+
+// SubsystemMode controls how Collector exports the subsystem of metrics, as
+// set by metric.SetSubsystem.
+type SubsystemMode int
+
+const (
+	// SubsystemIgnore does not export subsystems.
+	SubsystemIgnore SubsystemMode = iota
+
+	// SubsystemLabel exports the subsystem of all metrics as a "subsystem"
+	// constant label. Metrics without a subsystem have an empty label. No
+	// metric may have a field named "subsystem".
+	SubsystemLabel
+
+	// SubsystemPrefix prefixes the name of metrics with their subsystem, if
+	// any, e.g. "/opens" in subsystem "fs" becomes "fs_opens".
+	SubsystemPrefix
+)
+
+// OutOfRangeMode controls how Collector exports the samples of distributions
+// that fall in their underflow or overflow bucket.
+type OutOfRangeMode int
+
+const (
+	// OutOfRangeSeparate excludes out-of-range samples from the histogram,
+	// and exports them as a separate "<name>_out_of_range" metric, with
+	// "underflow" and "overflow" values for the label named OutOfRangeLabel.
+	// It is a counter for cumulative distributions, and a gauge otherwise.
+	// This is the default, as it neither loses samples nor misattributes
+	// them to a finite bucket.
+	OutOfRangeSeparate OutOfRangeMode = iota
+
+	// OutOfRangeInline exports the underflow bucket as a histogram bucket
+	// whose upper bound is just below the first finite bucket, and the
+	// overflow bucket as part of the +Inf bucket. All samples are counted in
+	// the histogram, but the +Inf bucket mixes overflow samples with those
+	// of the last finite bucket.
+	OutOfRangeInline
+
+	// OutOfRangeFold counts the samples of the underflow bucket in the first
+	// finite bucket, and those of the overflow bucket in the last finite
+	// bucket. All samples are counted in the histogram, but out-of-range
+	// samples are attributed to the wrong bucket.
+	OutOfRangeFold
+
+	// OutOfRangeDrop excludes out-of-range samples from the histogram, and
+	// logs the number of samples that were added to the underflow or
+	// overflow bucket since the previous collection.
+	OutOfRangeDrop
+)
+
+// outOfRangeLabel is the default value of Collector.OutOfRangeLabel.
+const outOfRangeLabel = "range"
+
+// NewCollector returns a new Collector.
+//
+// Preconditions:
+// * metric.Initialize has been called.
+func NewCollector() *Collector {
+	return &Collector{}
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (c *Collector) Describe(ch chan<- *promclient.Desc) {
+	// The set of metrics is immutable once metric.Initialize has been called,
+	// so collecting them once yields all descriptions.
+	promclient.DescribeByCollect(c, ch)
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (c *Collector) Collect(ch chan<- promclient.Metric) {
+	c.CollectSnapshot(ch, metric.GetSnapshot())
+}
+
+// CollectSnapshot is like Collect, but sends the Prometheus metrics
+// corresponding to the given snapshot rather than to the current values of
+// metrics. This allows rendering the same snapshot in several formats.
+func (c *Collector) CollectSnapshot(ch chan<- promclient.Metric, s metric.Snapshot) {
+	for _, m := range s.Metrics {
+		c.collectMetric(ch, m)
+	}
+}
+
+// WriteText writes the Prometheus metrics corresponding to the given snapshot
+// to w, in the Prometheus text exposition format.
+func (c *Collector) WriteText(w io.Writer, s metric.Snapshot) error {
+	registry := promclient.NewRegistry()
+	if err := registry.Register(&snapshotCollector{c: c, snapshot: s}); err != nil {
+		return err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	for _, f := range families {
+		if _, err := expfmt.MetricFamilyToText(w, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotCollector implements prometheus.Collector for a fixed snapshot.
+type snapshotCollector struct {
+	c        *Collector
+	snapshot metric.Snapshot
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (sc *snapshotCollector) Describe(ch chan<- *promclient.Desc) {
+	promclient.DescribeByCollect(sc, ch)
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (sc *snapshotCollector) Collect(ch chan<- promclient.Metric) {
+	sc.c.CollectSnapshot(ch, sc.snapshot)
+}
+
+// collectMetric sends the Prometheus metrics corresponding to m to ch.
+func (c *Collector) collectMetric(ch chan<- promclient.Metric, m metric.MetricSnapshot) {
+	md := m.Metadata
+	labels := make([]string, len(md.GetFields()))
+	for i, f := range md.GetFields() {
+		labels[i] = metric.SanitizeName(f.GetFieldName())
+	}
+	name := metric.SanitizeName(md.GetName())
+	var constLabels promclient.Labels
+	switch c.Subsystem {
+	case SubsystemLabel:
+		constLabels = promclient.Labels{"subsystem": md.GetSubsystem()}
+	case SubsystemPrefix:
+		if subsystem := md.GetSubsystem(); subsystem != "" {
+			name = metric.SanitizeName(subsystem + "_" + name)
+		}
+	}
+	desc := promclient.NewDesc(name, md.GetDescription(), labels, constLabels)
+	switch md.GetType() {
+	case pb.MetricMetadata_TYPE_UINT64:
+		valueType := promclient.GaugeValue
+		if md.GetCumulative() {
+			valueType = promclient.CounterValue
+		}
+		for _, p := range m.Points {
+			ch <- promclient.MustNewConstMetric(desc, valueType, float64(p.Uint64), p.FieldValues...)
+		}
+	case pb.MetricMetadata_TYPE_DISTRIBUTION:
+		lowerBounds := md.GetDistributionBucketLowerBounds()
+		var outOfRangeDesc *promclient.Desc
+		if c.OutOfRange == OutOfRangeSeparate {
+			label := c.OutOfRangeLabel
+			if label == "" {
+				label = outOfRangeLabel
+			}
+			outOfRangeDesc = promclient.NewDesc(name+"_out_of_range", "Samples of "+name+" out of the range of its histogram buckets.", append(labels, label), constLabels)
+		}
+		for _, p := range m.Points {
+			counts := p.BucketCounts(false /* cumulative */)
+			last := len(counts) - 1
+			underflow, overflow := counts[0], counts[last]
+			switch c.OutOfRange {
+			case OutOfRangeFold:
+				counts[1] += underflow
+				counts[last-1] += overflow
+				counts[0], counts[last] = 0, 0
+			case OutOfRangeSeparate:
+				counts[0], counts[last] = 0, 0
+				valueType := promclient.GaugeValue
+				if md.GetCumulative() {
+					valueType = promclient.CounterValue
+				}
+				fieldValues := p.FieldValues[:len(p.FieldValues):len(p.FieldValues)]
+				ch <- promclient.MustNewConstMetric(outOfRangeDesc, valueType, float64(underflow), append(fieldValues, "underflow")...)
+				ch <- promclient.MustNewConstMetric(outOfRangeDesc, valueType, float64(overflow), append(fieldValues, "overflow")...)
+			case OutOfRangeDrop:
+				counts[0], counts[last] = 0, 0
+				c.logDropped(md.GetName(), p.FieldValues, outOfRangeCounts{underflow, overflow})
+			}
+			count, buckets := histogramBuckets(lowerBounds, cumulativeCounts(counts))
+			ch <- promclient.MustNewConstHistogram(desc, count, math.NaN(), buckets, p.FieldValues...)
+		}
+	}
+	collectFieldInfo(ch, name, md, constLabels)
+}
+
+// logDropped logs the out-of-range samples of the point of the given metric
+// with the given field values that were not already logged by a previous
+// collection.
+func (c *Collector) logDropped(name string, fieldValues []string, cur outOfRangeCounts) {
+	key := droppedKey(name, fieldValues)
+	c.droppedMu.Lock()
+	prev := c.dropped[key]
+	if c.dropped == nil {
+		c.dropped = make(map[string]outOfRangeCounts)
+	}
+	c.dropped[key] = cur
+	c.droppedMu.Unlock()
+
+	underflow, overflow := newSamples(cur.underflow, prev.underflow), newSamples(cur.overflow, prev.overflow)
+	if underflow != 0 || overflow != 0 {
+		log.Warningf("Not exporting %d new underflow and %d new overflow samples of metric %s%v", underflow, overflow, name, fieldValues)
+	}
+}
+
+// droppedKey returns the key of Collector.dropped for the point of the given
+// metric with the given field values.
+func droppedKey(name string, fieldValues []string) string {
+	// Metric names and field values are printable, so NUL unambiguously
+	// separates them.
+	return name + "\x00" + strings.Join(fieldValues, "\x00")
+}
+
+// newSamples returns the number of samples added to a bucket whose count went
+// from prev to cur. A decreasing count means the distribution was reset, so
+// all of cur is new.
+func newSamples(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
+
+// cumulativeCounts converts counts to cumulative counts, in place, and
+// returns it.
+func cumulativeCounts(counts []uint64) []uint64 {
+	for i := 1; i < len(counts); i++ {
+		counts[i] += counts[i-1]
+	}
+	return counts
+}
+
+// collectFieldInfo sends the companion "<name>_field_info" metric describing
+// the field values of md to ch, if any are described.
+func collectFieldInfo(ch chan<- promclient.Metric, name string, md *pb.MetricMetadata, constLabels promclient.Labels) {
+	var desc *promclient.Desc
+	for _, f := range md.GetFields() {
+		for _, value := range f.GetAllowedValues() {
+			description, ok := f.GetValueDescriptions()[value]
+			if !ok {
+				continue
+			}
+			if desc == nil {
+				desc = promclient.NewDesc(name+"_field_info", "Descriptions of the field values of "+name+".", []string{"field", "value", "description"}, constLabels)
+			}
+			ch <- promclient.MustNewConstMetric(desc, promclient.GaugeValue, 1, f.GetFieldName(), value, description)
+		}
+	}
+}
+
+// histogramBuckets converts the cumulative bucket sample counts of a
+// distribution, as returned by metric.MetricPoint.BucketCounts, to Prometheus
+// histogram buckets. It returns the total number of samples and the map of
+// inclusive upper bounds to cumulative sample counts.
+//
+// Samples are integers, so the inclusive upper bound of a bucket is one less
+// than the lower bound of the next bucket. The overflow bucket is implicitly
+// represented by the +Inf bucket, whose count is the total sample count.
+func histogramBuckets(lowerBounds []int64, cumulativeCounts []uint64) (uint64, map[float64]uint64) {
+	buckets := make(map[float64]uint64, len(lowerBounds))
+	for i, lowerBound := range lowerBounds {
+		// cumulativeCounts[i] counts the samples below lowerBounds[i].
+		buckets[float64(lowerBound-1)] = cumulativeCounts[i]
+	}
+	return cumulativeCounts[len(cumulativeCounts)-1], buckets
+}
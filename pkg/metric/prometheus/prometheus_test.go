@@ -0,0 +1,359 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prometheus
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	promclient "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"gvisor.dev/gvisor/pkg/metric"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+var (
+	counter = metric.MustCreateNewUint64Metric("/test/counter", false, "A counter.", metric.NewFieldWithDescriptions("kind", []string{"a", "b"}, map[string]string{"a": "Kind A."}))
+	distrib = metric.MustRegisterDistributionMetric("/test/distrib", false, metric.NewExponentialBucketer(2, 10, 0, 1), pb.MetricMetadata_UNITS_NONE, "A distribution.")
+)
+
+func init() {
+	metric.MustRegisterCustomUint64Metric("/test/gauge", false /* cumulative */, false /* sync */, "A gauge.", func(...string) uint64 { return 42 })
+	if err := metric.SetSubsystem("testsys", "/test/gauge"); err != nil {
+		panic(err)
+	}
+	if err := metric.Initialize(); err != nil {
+		panic(err)
+	}
+}
+
+// gather returns the metric families collected by c, by name.
+func gather(t *testing.T, c *Collector) map[string]*dto.MetricFamily {
+	t.Helper()
+	registry := promclient.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+	return byName
+}
+
+// counterValues returns the values of the counters of f, by the value of their
+// first label.
+func counterValues(f *dto.MetricFamily) map[string]float64 {
+	values := make(map[string]float64)
+	for _, m := range f.GetMetric() {
+		values[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+	}
+	return values
+}
+
+// histogramBucketCounts returns the cumulative counts of the buckets of h, by
+// upper bound.
+func histogramBucketCounts(h *dto.Histogram) map[float64]uint64 {
+	counts := make(map[float64]uint64)
+	for _, b := range h.GetBucket() {
+		counts[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return counts
+}
+
+func TestCollector(t *testing.T) {
+	// Metrics are global and keep their values across test runs, e.g. with
+	// -count, so values are checked relative to those before the test.
+	before := gather(t, NewCollector())
+	counter.IncrementBy(3, "a")
+	distrib.AddSample(-1)
+	distrib.AddSample(5)
+	distrib.AddSample(15)
+	distrib.AddSample(15)
+	distrib.AddSample(100)
+
+	byName := gather(t, NewCollector())
+
+	if f := byName["test_counter"]; f == nil {
+		t.Errorf("test_counter not found in %v", byName)
+	} else if f.GetType() != dto.MetricType_COUNTER || len(f.GetMetric()) != 2 {
+		t.Errorf("test_counter: got %v, want counter with 2 label values", f)
+	} else {
+		prev := counterValues(before["test_counter"])
+		for kind, got := range counterValues(f) {
+			want := prev[kind]
+			if kind == "a" {
+				want += 3
+			}
+			if got != want {
+				t.Errorf("test_counter{kind=%s}: got %v want %v", kind, got, want)
+			}
+		}
+	}
+
+	if f := byName["test_gauge"]; f == nil {
+		t.Errorf("test_gauge not found in %v", byName)
+	} else if f.GetType() != dto.MetricType_GAUGE || f.GetMetric()[0].GetGauge().GetValue() != 42 {
+		t.Errorf("test_gauge: got %v, want gauge with value 42", f)
+	}
+
+	if f := byName["test_distrib"]; f == nil {
+		t.Errorf("test_distrib not found in %v", byName)
+	} else if f.GetType() != dto.MetricType_HISTOGRAM {
+		t.Errorf("test_distrib: got %v, want histogram", f)
+	} else {
+		h := f.GetMetric()[0].GetHistogram()
+		prev := before["test_distrib"].GetMetric()[0].GetHistogram()
+		if got, want := h.GetSampleCount()-prev.GetSampleCount(), uint64(3); got != want {
+			t.Errorf("test_distrib sample count: got %d more want %d more", got, want)
+		}
+		// Out-of-range samples are excluded from the histogram by default.
+		want := map[float64]uint64{
+			-1: 0,
+			9:  1,
+			19: 3,
+		}
+		got := histogramBucketCounts(h)
+		if len(got) != len(want) {
+			t.Errorf("test_distrib buckets: got %v want %v", h.GetBucket(), want)
+		}
+		prevCounts := histogramBucketCounts(prev)
+		for upperBound, count := range got {
+			if count-prevCounts[upperBound] != want[upperBound] {
+				t.Errorf("test_distrib bucket le=%v: got %d more want %d more", upperBound, count-prevCounts[upperBound], want[upperBound])
+			}
+		}
+	}
+
+	if f := byName["test_distrib_out_of_range"]; f == nil {
+		t.Errorf("test_distrib_out_of_range not found in %v", byName)
+	} else if f.GetType() != dto.MetricType_COUNTER || len(f.GetMetric()) != 2 {
+		t.Errorf("test_distrib_out_of_range: got %v, want counter with 2 label values", f)
+	} else {
+		prev := counterValues(before["test_distrib_out_of_range"])
+		for label, got := range counterValues(f) {
+			if got-prev[label] != 1 {
+				t.Errorf("test_distrib_out_of_range{range=%s}: got %v more want 1 more", label, got-prev[label])
+			}
+		}
+	}
+}
+
+func TestCollectorSubsystem(t *testing.T) {
+	byName := gather(t, &Collector{Subsystem: SubsystemLabel})
+	for name, want := range map[string]string{
+		"test_gauge":   "testsys",
+		"test_counter": "",
+	} {
+		f := byName[name]
+		if f == nil {
+			t.Errorf("%s not found in %v", name, byName)
+			continue
+		}
+		found := false
+		for _, l := range f.GetMetric()[0].GetLabel() {
+			if l.GetName() == "subsystem" {
+				found = true
+				if l.GetValue() != want {
+					t.Errorf("%s: got subsystem label %q want %q", name, l.GetValue(), want)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s: subsystem label not found in %v", name, f)
+		}
+	}
+
+	byName = gather(t, &Collector{Subsystem: SubsystemPrefix})
+	for _, name := range []string{"testsys_test_gauge", "test_counter", "test_distrib"} {
+		if byName[name] == nil {
+			t.Errorf("%s not found in %v", name, byName)
+		}
+	}
+}
+
+func TestCollectorFieldInfo(t *testing.T) {
+	byName := gather(t, NewCollector())
+	f := byName["test_counter_field_info"]
+	if f == nil {
+		t.Fatalf("test_counter_field_info not found in %v", byName)
+	}
+	if len(f.GetMetric()) != 1 {
+		t.Fatalf("test_counter_field_info: got %v, want a single metric", f)
+	}
+	got := make(map[string]string)
+	for _, l := range f.GetMetric()[0].GetLabel() {
+		got[l.GetName()] = l.GetValue()
+	}
+	want := map[string]string{"field": "kind", "value": "a", "description": "Kind A."}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("test_counter_field_info labels: got %v want %v", got, want)
+	}
+	if byName["test_gauge_field_info"] != nil {
+		t.Errorf("got test_gauge_field_info, want none for metric without described fields")
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	s := metric.GetSnapshot()
+	// Later changes must not affect the snapshot.
+	counter.IncrementBy(1000, "b")
+
+	var buf bytes.Buffer
+	if err := NewCollector().WriteText(&buf, s); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	var parser expfmt.TextParser
+	byName, err := parser.TextToMetricFamilies(&buf)
+	if err != nil {
+		t.Fatalf("TextToMetricFamilies: %v", err)
+	}
+	f := byName["test_counter"]
+	if f == nil {
+		t.Fatalf("test_counter not found in %v", byName)
+	}
+	var want float64
+	for _, m := range s.Metrics {
+		if m.Metadata.GetName() != "/test/counter" {
+			continue
+		}
+		for _, p := range m.Points {
+			if p.FieldValues[0] == "b" {
+				want = float64(p.Uint64)
+			}
+		}
+	}
+	if got := counterValues(f)["b"]; got != want {
+		t.Errorf("test_counter{kind=b}: got %v, want %v from snapshot", got, want)
+	}
+	if byName["test_gauge"] == nil || byName["test_distrib"] == nil {
+		t.Errorf("got %v, want test_gauge and test_distrib", byName)
+	}
+}
+
+func TestCollectorOutOfRange(t *testing.T) {
+	// 1 underflow sample, 3 samples in finite buckets and 1 overflow sample.
+	snapshot := metric.Snapshot{Metrics: []metric.MetricSnapshot{{
+		Metadata: &pb.MetricMetadata{
+			Name:                          "/test/range",
+			Type:                          pb.MetricMetadata_TYPE_DISTRIBUTION,
+			Cumulative:                    true,
+			DistributionBucketLowerBounds: []int64{0, 10, 20},
+		},
+		Points: []metric.MetricPoint{{Samples: []uint64{1, 1, 2, 1}}},
+	}}}
+	for _, test := range []struct {
+		name       string
+		c          *Collector
+		wantCount  uint64
+		wantBucket map[float64]uint64
+		// wantSeparate maps label values of the separate out-of-range
+		// metric to their value, if any.
+		wantSeparate map[string]float64
+		wantLabel    string
+	}{
+		{
+			name:       "inline",
+			c:          &Collector{OutOfRange: OutOfRangeInline},
+			wantCount:  5,
+			wantBucket: map[float64]uint64{-1: 1, 9: 2, 19: 4},
+		},
+		{
+			name:       "fold",
+			c:          &Collector{OutOfRange: OutOfRangeFold},
+			wantCount:  5,
+			wantBucket: map[float64]uint64{-1: 0, 9: 2, 19: 5},
+		},
+		{
+			name:         "separate",
+			c:            &Collector{},
+			wantCount:    3,
+			wantBucket:   map[float64]uint64{-1: 0, 9: 1, 19: 3},
+			wantSeparate: map[string]float64{"underflow": 1, "overflow": 1},
+			wantLabel:    "range",
+		},
+		{
+			name:         "separate with label",
+			c:            &Collector{OutOfRangeLabel: "bucket"},
+			wantCount:    3,
+			wantBucket:   map[float64]uint64{-1: 0, 9: 1, 19: 3},
+			wantSeparate: map[string]float64{"underflow": 1, "overflow": 1},
+			wantLabel:    "bucket",
+		},
+		{
+			name:       "drop",
+			c:          &Collector{OutOfRange: OutOfRangeDrop},
+			wantCount:  3,
+			wantBucket: map[float64]uint64{-1: 0, 9: 1, 19: 3},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			registry := promclient.NewRegistry()
+			if err := registry.Register(&snapshotCollector{c: test.c, snapshot: snapshot}); err != nil {
+				t.Fatalf("Register: %v", err)
+			}
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatalf("Gather: %v", err)
+			}
+			byName := make(map[string]*dto.MetricFamily, len(families))
+			for _, f := range families {
+				byName[f.GetName()] = f
+			}
+
+			h := byName["test_range"].GetMetric()[0].GetHistogram()
+			if got := h.GetSampleCount(); got != test.wantCount {
+				t.Errorf("sample count: got %d want %d", got, test.wantCount)
+			}
+			if got := histogramBucketCounts(h); !reflect.DeepEqual(got, test.wantBucket) {
+				t.Errorf("buckets: got %v want %v", got, test.wantBucket)
+			}
+
+			f := byName["test_range_out_of_range"]
+			if test.wantSeparate == nil {
+				if f != nil {
+					t.Errorf("got unexpected out-of-range metric %v", f)
+				}
+				return
+			}
+			if f.GetType() != dto.MetricType_COUNTER {
+				t.Errorf("out-of-range metric: got type %v want counter", f.GetType())
+			}
+			separate := make(map[string]float64)
+			total := float64(h.GetSampleCount())
+			for _, m := range f.GetMetric() {
+				label := m.GetLabel()[0]
+				if label.GetName() != test.wantLabel {
+					t.Errorf("out-of-range label: got %q want %q", label.GetName(), test.wantLabel)
+				}
+				separate[label.GetValue()] = m.GetCounter().GetValue()
+				total += m.GetCounter().GetValue()
+			}
+			if !reflect.DeepEqual(separate, test.wantSeparate) {
+				t.Errorf("out-of-range metric: got %v want %v", separate, test.wantSeparate)
+			}
+			// All samples are accounted for.
+			if total != 5 {
+				t.Errorf("total samples: got %v want 5", total)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// GetRegistration returns the metadata of all registered metrics, as sent over
+// the event channel by Initialize.
+//
+// Preconditions:
+// * Initialize has been called.
+func GetRegistration() *pb.MetricRegistration {
+	return allMetrics.registration()
+}
+
+// IsEmptyUpdate returns true if m contains no metric values, either
+// individual or batched, and no stage timing, so that consumers don't need to
+// be sent it.
+func IsEmptyUpdate(m *pb.MetricUpdate) bool {
+	return len(m.GetMetrics()) == 0 && len(m.GetStageTiming()) == 0 && m.GetScalarBatch() == nil
+}
+
+// UpdateReader builds MetricUpdates for consumers that read metrics on their
+// own schedule, e.g. a gRPC server, rather than through the event channel.
+//
+// Each UpdateReader keeps track of the values it last returned, independently
+// of EmitMetricUpdate and of other UpdateReaders.
+type UpdateReader struct {
+	// mu protects last, and ensures that updates are strongly ordered.
+	mu sync.Mutex
+
+	// last contains the state of the metrics at the last update.
+	last metricValues
+}
+
+// NewUpdateReader returns a new UpdateReader. Its first update contains the
+// values of all metrics.
+func NewUpdateReader() *UpdateReader {
+	return &UpdateReader{}
+}
+
+// Update returns the metrics whose values changed since the previous call,
+// with the same semantics as the updates sent by EmitMetricUpdate.
+//
+// If full is true, the update is built as if there were no previous call: it
+// contains the values of all metrics, and distribution values have
+// Samples.was_reset set, so that they replace previously-read values.
+//
+// Preconditions:
+// * Initialize has been called.
+func (r *UpdateReader) Update(full bool) *pb.MetricUpdate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := allMetrics.Values()
+	last := r.last
+	if full {
+		last = metricValues{}
+	}
+	m := metricUpdate(last, snapshot)
+	if full {
+		for _, v := range m.Metrics {
+			if d := v.GetDistributionValue(); d != nil {
+				d.WasReset = true
+			}
+		}
+	}
+	r.last = snapshot
+	return m
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"reflect"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestUpdateReader(t *testing.T) {
+	defer reset()
+
+	foo, err := NewUint64Metric("/foo", false, pb.MetricMetadata_UNITS_NONE, fooDescription)
+	if err != nil {
+		t.Fatalf("NewUint64Metric got err %v want nil", err)
+	}
+	distrib, err := NewDistributionMetric("/distrib", false, NewExponentialBucketer(2, 2, 0, 1), pb.MetricMetadata_UNITS_NONE, distribDescription)
+	if err != nil {
+		t.Fatalf("NewDistributionMetric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if got := len(GetRegistration().GetMetrics()); got != 2 {
+		t.Errorf("GetRegistration() got %d metrics want 2", got)
+	}
+
+	// values returns the uint64 values and distribution samples of an update.
+	values := func(m *pb.MetricUpdate) map[string]interface{} {
+		vals := make(map[string]interface{})
+		for _, v := range m.GetMetrics() {
+			if d := v.GetDistributionValue(); d != nil {
+				vals[v.GetName()] = d.GetNewSamples()
+				if !d.GetWasReset() {
+					vals[v.GetName()+"/delta"] = true
+				}
+				continue
+			}
+			vals[v.GetName()] = v.GetUint64Value()
+		}
+		return vals
+	}
+
+	r := NewUpdateReader()
+	foo.IncrementBy(2)
+	distrib.AddSample(3)
+	// The first update contains all metrics.
+	want := map[string]interface{}{
+		"/foo":           uint64(2),
+		"/distrib":       []uint64{0, 0, 1, 0},
+		"/distrib/delta": true,
+	}
+	if got := values(r.Update(false)); !reflect.DeepEqual(got, want) {
+		t.Errorf("first Update(false) got %v want %v", got, want)
+	}
+
+	// Subsequent updates only contain changes.
+	distrib.AddSample(1)
+	want = map[string]interface{}{
+		"/distrib":       []uint64{0, 1, 0, 0},
+		"/distrib/delta": true,
+	}
+	if got := values(r.Update(false)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Update(false) got %v want %v", got, want)
+	}
+
+	// Full updates contain absolute values.
+	want = map[string]interface{}{
+		"/foo":     uint64(2),
+		"/distrib": []uint64{0, 1, 1, 0},
+	}
+	if got := values(r.Update(true)); !reflect.DeepEqual(got, want) {
+		t.Errorf("Update(true) got %v want %v", got, want)
+	}
+
+	// Readers and EmitMetricUpdate are independent.
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 || len(emitter[0].(*pb.MetricUpdate).GetMetrics()) != 2 {
+		t.Errorf("EmitMetricUpdate got %v want both metrics", emitter)
+	}
+	if got := values(r.Update(false)); len(got) != 0 {
+		t.Errorf("Update(false) without changes got %v want none", got)
+	}
+	if got := values(NewUpdateReader().Update(false)); len(got) != 3 {
+		t.Errorf("Update(false) on new reader got %v want all metrics", got)
+	}
+}
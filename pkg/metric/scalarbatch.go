@@ -0,0 +1,110 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"sort"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+// SetScalarBatchThreshold makes MetricUpdates send the values of uint64
+// metrics without fields in a compact pb.ScalarBatch rather than as
+// individual MetricValues, whenever at least threshold of them changed since
+// the previous update. This reduces the size of updates when many gauges
+// change every time, e.g. sampled resource usage. Consumers map the indexes
+// in the batch to metrics using the MetricRegistration. A threshold of 0, the
+// default, disables ScalarBatches.
+//
+// SetScalarBatchThreshold must be called before Initialize.
+func SetScalarBatchThreshold(threshold int) error {
+	if err := lockRegistration("set the scalar batch threshold"); err != nil {
+		return err
+	}
+	defer registrationMu.Unlock()
+	if initialized {
+		return ErrInitializationDone
+	}
+	if threshold < 0 {
+		return fmt.Errorf("%w: scalar batch threshold must not be negative, got %d", ErrInvalidArgument, threshold)
+	}
+	allMetrics.scalarBatchThreshold = threshold
+	return nil
+}
+
+// batchScalars moves the values of uint64 metrics without fields from
+// m.Metrics to m.ScalarBatch, if there are at least threshold of them. index
+// maps metric names to their index in the MetricRegistration.
+func batchScalars(m *pb.MetricUpdate, threshold int, index map[string]uint32) {
+	numScalars := 0
+	for _, v := range m.Metrics {
+		if isScalar(v, index) {
+			numScalars++
+		}
+	}
+	if numScalars < threshold {
+		return
+	}
+	batch := &pb.ScalarBatch{
+		MetricIndex: make([]uint32, 0, numScalars),
+		Value:       make([]uint64, 0, numScalars),
+	}
+	metrics := m.Metrics[:0]
+	for _, v := range m.Metrics {
+		if !isScalar(v, index) {
+			metrics = append(metrics, v)
+			continue
+		}
+		batch.MetricIndex = append(batch.MetricIndex, index[v.GetName()])
+		batch.Value = append(batch.Value, v.GetUint64Value())
+	}
+	// Sorted indexes make the update deterministic, and compress better.
+	sort.Sort(scalarBatchByIndex{batch})
+	m.Metrics = metrics
+	m.ScalarBatch = batch
+}
+
+// isScalar returns true if v is the value of a registered uint64 metric
+// without fields.
+func isScalar(v *pb.MetricValue, index map[string]uint32) bool {
+	if _, ok := v.Value.(*pb.MetricValue_Uint64Value); !ok || len(v.GetFieldValues()) != 0 {
+		return false
+	}
+	_, ok := index[v.GetName()]
+	return ok
+}
+
+// scalarBatchByIndex implements sort.Interface to sort a ScalarBatch by
+// metric index.
+type scalarBatchByIndex struct {
+	*pb.ScalarBatch
+}
+
+// Len implements sort.Interface.Len.
+func (b scalarBatchByIndex) Len() int {
+	return len(b.MetricIndex)
+}
+
+// Less implements sort.Interface.Less.
+func (b scalarBatchByIndex) Less(i, j int) bool {
+	return b.MetricIndex[i] < b.MetricIndex[j]
+}
+
+// Swap implements sort.Interface.Swap.
+func (b scalarBatchByIndex) Swap(i, j int) {
+	b.MetricIndex[i], b.MetricIndex[j] = b.MetricIndex[j], b.MetricIndex[i]
+	b.Value[i], b.Value[j] = b.Value[j], b.Value[i]
+}
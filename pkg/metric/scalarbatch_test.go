@@ -0,0 +1,92 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestScalarBatch(t *testing.T) {
+	defer reset()
+
+	const numGauges = 200
+	var tick uint64
+	for i := 0; i < numGauges; i++ {
+		i := i
+		if err := RegisterCustomUint64Metric(fmt.Sprintf("/gauge/%03d", i), false /* cumulative */, false /* sync */, pb.MetricMetadata_UNITS_NONE, "A fast-changing gauge", func(...string) uint64 {
+			return tick*1000 + uint64(i)
+		}); err != nil {
+			t.Fatalf("RegisterCustomUint64Metric: %v", err)
+		}
+	}
+	counter, err := NewUint64Metric("/counter", false, pb.MetricMetadata_UNITS_NONE, counterDescription, NewField("field", []string{"a"}))
+	if err != nil {
+		t.Fatalf("NewUint64Metric: %v", err)
+	}
+	if err := SetScalarBatchThreshold(numGauges); err != nil {
+		t.Fatalf("SetScalarBatchThreshold: %v", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+	if err := SetScalarBatchThreshold(1); err != ErrInitializationDone {
+		t.Errorf("SetScalarBatchThreshold after Initialize got err %v want %v", err, ErrInitializationDone)
+	}
+	registration := emitter[0].(*pb.MetricRegistration)
+
+	last := allMetrics.Values()
+	tick++
+	counter.Increment("a")
+	snapshot := allMetrics.Values()
+	update := metricUpdate(last, snapshot)
+
+	// Scalars are batched, other metrics are not.
+	if len(update.GetMetrics()) != 1 || update.GetMetrics()[0].GetName() != "/counter" {
+		t.Errorf("update got metrics %v want only /counter", update.GetMetrics())
+	}
+	batch := update.GetScalarBatch()
+	if len(batch.GetMetricIndex()) != numGauges || len(batch.GetValue()) != numGauges {
+		t.Fatalf("batch got %d indexes and %d values want %d", len(batch.GetMetricIndex()), len(batch.GetValue()), numGauges)
+	}
+	for i, index := range batch.GetMetricIndex() {
+		name := registration.GetMetrics()[index].GetName()
+		var gauge uint64
+		if _, err := fmt.Sscanf(name, "/gauge/%03d", &gauge); err != nil {
+			t.Fatalf("index %d maps to metric %q: %v", index, name, err)
+		}
+		if got, want := batch.GetValue()[i], 1000+gauge; got != want {
+			t.Errorf("value of %s got %d want %d", name, got, want)
+		}
+	}
+
+	unbatched := snapshot
+	unbatched.scalarBatchThreshold = 0
+	compact, full := proto.Size(update), proto.Size(metricUpdate(last, unbatched))
+	t.Logf("update of %d gauges: %d bytes batched, %d bytes unbatched", numGauges, compact, full)
+	if compact >= full/2 {
+		t.Errorf("batched update is %d bytes, want less than half of %d", compact, full)
+	}
+
+	// Fewer changed scalars than the threshold are not batched.
+	last = snapshot
+	counter.Increment("a")
+	if update := metricUpdate(last, allMetrics.Values()); update.GetScalarBatch() != nil || len(update.GetMetrics()) != 1 {
+		t.Errorf("update without changed gauges got %v want only /counter", update)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+	"gvisor.dev/gvisor/pkg/sync"
+)
+
+// SparseUint64Metric is a cumulative uint64 metric with exactly one field,
+// suited to fields with many allowed values of which only a few are expected
+// to ever be incremented.
+//
+// Unlike Uint64Metric, which preallocates a counter for every allowed field
+// value, SparseUint64Metric allocates counters lazily on the first increment
+// of each field value. This costs a little more on that first increment, and
+// saves memory proportional to the number of allowed values that are never
+// incremented. Snapshots only contain the field values that were incremented.
+//
+// Metrics are not saved across save/restore and thus reset to zero on restore.
+type SparseUint64Metric struct {
+	// allowedValues is the sorted list of allowed field values. It is
+	// immutable.
+	allowedValues []string
+
+	// counters maps field values to a *uint64 counter, which must be accessed
+	// atomically. Counters are only added for field values that have been
+	// incremented.
+	counters sync.Map
+}
+
+// NewSparseUint64Metric creates and registers a new cumulative sparse metric
+// with the given name, broken down by field.
+//
+// Metrics must be statically defined (i.e., at init).
+func NewSparseUint64Metric(name string, sync bool, units pb.MetricMetadata_Units, description string, field Field) (*SparseUint64Metric, error) {
+	m := &SparseUint64Metric{
+		allowedValues: append([]string(nil), field.allowedValues...),
+	}
+	sort.Strings(m.allowedValues)
+	if err := checkEnumeratedFields([]Field{field}); err != nil {
+		return nil, err
+	}
+	if err := registerUint64Metric(name, true /* cumulative */, sync, units, description, m.Value, m.values, field); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MustCreateNewSparseUint64Metric calls NewSparseUint64Metric and panics if it
+// returns an error.
+func MustCreateNewSparseUint64Metric(name string, sync bool, description string, field Field) *SparseUint64Metric {
+	m, err := NewSparseUint64Metric(name, sync, pb.MetricMetadata_UNITS_NONE, description, field)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to create metric %q: %s", name, err))
+	}
+	return m
+}
+
+// Value returns the current value of the metric for the given field value.
+func (m *SparseUint64Metric) Value(fieldValues ...string) uint64 {
+	if len(fieldValues) != 1 {
+		panic(fmt.Sprintf("Number of fieldValues %d is not equal to the number of metric fields 1", len(fieldValues)))
+	}
+	m.checkAllowed(fieldValues[0])
+	counter, ok := m.counters.Load(fieldValues[0])
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(counter.(*uint64))
+}
+
+// Increment increments the metric for the given field value by 1.
+func (m *SparseUint64Metric) Increment(fieldValues ...string) {
+	m.IncrementBy(1, fieldValues...)
+}
+
+// IncrementBy increments the metric for the given field value by v.
+func (m *SparseUint64Metric) IncrementBy(v uint64, fieldValues ...string) {
+	if len(fieldValues) != 1 {
+		panic(fmt.Sprintf("Number of fieldValues %d is not equal to the number of metric fields 1", len(fieldValues)))
+	}
+	counter, ok := m.counters.Load(fieldValues[0])
+	if !ok {
+		m.checkAllowed(fieldValues[0])
+		counter, _ = m.counters.LoadOrStore(fieldValues[0], new(uint64))
+	}
+	atomic.AddUint64(counter.(*uint64), v)
+}
+
+// checkAllowed panics if fieldValue is not an allowed field value.
+func (m *SparseUint64Metric) checkAllowed(fieldValue string) {
+	if i := sort.SearchStrings(m.allowedValues, fieldValue); i == len(m.allowedValues) || m.allowedValues[i] != fieldValue {
+		panic(fmt.Sprintf("Metric does not allow to have field value %s", fieldValue))
+	}
+}
+
+// values returns the current value of all field values that have been
+// incremented.
+func (m *SparseUint64Metric) values() map[string]uint64 {
+	values := make(map[string]uint64)
+	m.counters.Range(func(fieldValue, counter interface{}) bool {
+		values[fieldValue.(string)] = atomic.LoadUint64(counter.(*uint64))
+		return true
+	})
+	return values
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metric
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"testing"
+
+	pb "gvisor.dev/gvisor/pkg/metric/metric_go_proto"
+)
+
+func TestSparseUint64Metric(t *testing.T) {
+	defer reset()
+
+	sparse, err := NewSparseUint64Metric("/sparse", false, pb.MetricMetadata_UNITS_NONE, counterDescription, NewField("syscall", []string{"read", "write", "open", "close"}))
+	if err != nil {
+		t.Fatalf("NewSparseUint64Metric got err %v want nil", err)
+	}
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize(): %s", err)
+	}
+
+	sparse.IncrementBy(3, "write")
+	sparse.Increment("open")
+	sparse.Increment("write")
+	if got := sparse.Value("write"); got != 4 {
+		t.Errorf("Value(write) got %d want 4", got)
+	}
+	if got := sparse.Value("read"); got != 0 {
+		t.Errorf("Value(read) got %d want 0", got)
+	}
+
+	// Only incremented field values show up in snapshots.
+	snapshot := GetSnapshot()
+	if len(snapshot.Metrics) != 1 {
+		t.Fatalf("got %d metrics in snapshot, want 1: %+v", len(snapshot.Metrics), snapshot)
+	}
+	want := []MetricPoint{
+		{FieldValues: []string{"open"}, Uint64: 1},
+		{FieldValues: []string{"write"}, Uint64: 4},
+	}
+	if got := snapshot.Metrics[0].Points; !reflect.DeepEqual(got, want) {
+		t.Errorf("/sparse points: got %+v want %+v", got, want)
+	}
+
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 1 {
+		t.Fatalf("EmitMetricUpdate emitted %d events want 1", len(emitter))
+	}
+	update, ok := emitter[0].(*pb.MetricUpdate)
+	if !ok {
+		t.Fatalf("emitter %v got %T want pb.MetricUpdate", emitter[0], emitter[0])
+	}
+	if len(update.Metrics) != 2 {
+		t.Errorf("MetricUpdate got %d metrics want 2: %v", len(update.Metrics), update)
+	}
+
+	// Nothing changed since the last update.
+	emitter.Reset()
+	EmitMetricUpdate()
+	if len(emitter) != 0 {
+		t.Errorf("EmitMetricUpdate emitted %d events want 0: %v", len(emitter), emitter)
+	}
+}
+
+func TestSparseUint64MetricDisallowedValue(t *testing.T) {
+	defer reset()
+
+	sparse := MustCreateNewSparseUint64Metric("/sparse", false, counterDescription, NewField("syscall", []string{"read", "write"}))
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Increment with disallowed field value did not panic")
+		}
+	}()
+	sparse.Increment("open")
+}
+
+// BenchmarkFieldMemory compares the memory used by Uint64Metric and
+// SparseUint64Metric for a field with many allowed values, of which only a
+// few are used.
+func BenchmarkFieldMemory(b *testing.B) {
+	const (
+		numAllowed = 10000
+		numUsed    = 20
+	)
+	allowed := make([]string, numAllowed)
+	for i := range allowed {
+		allowed[i] = fmt.Sprintf("value%d", i)
+	}
+
+	for _, test := range []struct {
+		name   string
+		create func(name string) func(fieldValues ...string)
+	}{
+		{
+			name: "Dense",
+			create: func(name string) func(...string) {
+				m := MustCreateNewUint64Metric(name, false, counterDescription, NewField("field", allowed))
+				return m.Increment
+			},
+		},
+		{
+			name: "Sparse",
+			create: func(name string) func(...string) {
+				m := MustCreateNewSparseUint64Metric(name, false, counterDescription, NewField("field", allowed))
+				return m.Increment
+			},
+		},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			defer reset()
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				increment := test.create(fmt.Sprintf("/metric%d", i))
+				for j := 0; j < numUsed; j++ {
+					increment(allowed[j*(numAllowed/numUsed)])
+				}
+			}
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/float64(b.N), "bytes/metric")
+		})
+	}
+}